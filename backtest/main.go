@@ -0,0 +1,93 @@
+// Command backtest reports the accuracy of the forecast models on a corpus
+// of series.
+//
+//	backtest [flags] path...
+//
+// Each path is a CSV, TSV or JSON Lines file, like goal data exports, or a
+// directory of them.
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Preetam/transverse/internal/backtest"
+	"github.com/Preetam/transverse/internal/forecast"
+	// Forecasters register themselves with the forecast package.
+	_ "github.com/Preetam/transverse/internal/forecast1"
+	_ "github.com/Preetam/transverse/internal/forecast2"
+	_ "github.com/Preetam/transverse/internal/forecast3"
+)
+
+func main() {
+	minTrain := flag.Int("min-train", backtest.DefaultConfig.MinTrain, "Values before the first origin")
+	horizon := flag.Int("horizon", backtest.DefaultConfig.Horizon, "Steps ahead to score")
+	step := flag.Int("step", backtest.DefaultConfig.Step, "Steps between origins")
+	models := flag.String("models", "", "Comma-separated models to backtest. Empty means all of them.")
+	format := flag.String("format", "text", "Output format: text or json")
+	resolution := flag.String("resolution", string(backtest.Auto), "Time between values: hour, day, week, month or auto to infer it from each file's dates")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] path...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format != "text" && *format != "json" {
+		fatal(fmt.Errorf("unknown format %q", *format))
+	}
+	res, err := backtest.ParseResolution(*resolution)
+	if err != nil {
+		fatal(err)
+	}
+
+	names := forecast.Models()
+	if *models != "" {
+		names = strings.Split(*models, ",")
+	}
+	series, err := backtest.LoadSeries(flag.Args(), res)
+	if err != nil {
+		fatal(err)
+	}
+	cfg := backtest.Config{MinTrain: *minTrain, Horizon: *horizon, Step: *step}
+	reports, err := backtest.RunAll(names, series, cfg)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *format == "json" {
+		err = backtest.WriteJSON(os.Stdout, reports)
+	} else {
+		err = backtest.WriteText(os.Stdout, reports)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "backtest:", err)
+	os.Exit(1)
+}
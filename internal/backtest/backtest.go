@@ -0,0 +1,211 @@
+// Package backtest measures forecast accuracy by replaying series: each
+// forecaster is run at every origin of a rolling-origin evaluation and its
+// forecasts are compared with what actually happened.
+package backtest
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/Preetam/transverse/internal/forecast"
+)
+
+// NominalCoverage is the share of actual values a forecast's intervals
+// are meant to contain.
+const NominalCoverage = 0.9
+
+// Series is a named series of values at consecutive steps.
+type Series struct {
+	Name   string
+	Values []float64
+}
+
+// Config controls a backtest.
+type Config struct {
+	// MinTrain is the number of values forecasters get at the first
+	// origin.
+	MinTrain int
+	// Horizon is the number of steps ahead that are scored.
+	Horizon int
+	// Step is the distance between origins.
+	Step int
+}
+
+// DefaultConfig scores two weeks ahead of daily data from every origin
+// after the first two weeks.
+var DefaultConfig = Config{MinTrain: 14, Horizon: 14, Step: 1}
+
+// Metric is a float64 that's written to JSON as null if it's NaN.
+type Metric float64
+
+func (m Metric) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(m)) || math.IsInf(float64(m), 0) {
+		return []byte("null"), nil
+	}
+	return []byte(strconv.FormatFloat(float64(m), 'g', -1, 64)), nil
+}
+
+// HorizonStats are the errors of forecasts a number of steps ahead.
+type HorizonStats struct {
+	Horizon int `json:"horizon"`
+	// N is the number of forecasts scored.
+	N int `json:"n"`
+	// MAE is the mean absolute error.
+	MAE Metric `json:"mae"`
+	// MAPE is the mean absolute percentage error, leaving out actual
+	// values of zero. It's NaN if they're all zero.
+	MAPE Metric `json:"mape"`
+	// Coverage is the share of actual values inside the forecast's
+	// interval, to compare with NominalCoverage.
+	Coverage Metric `json:"coverage"`
+
+	// ETAN is the number of targets actually reached at Horizon, and
+	// ETAMissed how many of those the forecast had no ETA for.
+	ETAN      int `json:"eta_n"`
+	ETAMissed int `json:"eta_missed"`
+	// ETAMAE is the mean absolute error in steps of the ETAs that were
+	// forecast. It's NaN if there weren't any.
+	ETAMAE Metric `json:"eta_mae"`
+}
+
+// totals are the sums HorizonStats are computed from.
+type totals struct {
+	absErr, absPctErr, covered, etaAbsErr float64
+	pctN, etaFound                        int
+}
+
+// Report is a forecaster's backtest result.
+type Report struct {
+	Model    string         `json:"model"`
+	Series   int            `json:"series"`
+	Origins  int            `json:"origins"`
+	Horizons []HorizonStats `json:"horizons"`
+}
+
+// Run backtests a forecaster on every series. At each origin the
+// forecaster gets the values before it. Its forecast's first point is at
+// the last of those values, like goal forecasts, so point h is scored
+// against the value h steps later.
+//
+// ETAs are scored against targets between consecutive actual values, so
+// the actual ETA of each target is known. Both ETAs are found with
+// forecast.ETA.
+func Run(model string, forecaster forecast.Forecaster, series []Series, cfg Config) Report {
+	if cfg.Step < 1 {
+		cfg.Step = 1
+	}
+	if cfg.MinTrain < 1 {
+		cfg.MinTrain = 1
+	}
+	report := Report{Model: model, Series: len(series), Horizons: make([]HorizonStats, cfg.Horizon)}
+	sums := make([]totals, cfg.Horizon)
+	for h := range report.Horizons {
+		report.Horizons[h].Horizon = h + 1
+	}
+
+	for _, s := range series {
+		for origin := cfg.MinTrain; origin < len(s.Values); origin += cfg.Step {
+			report.Origins++
+			points := forecaster.Forecast(s.Values[:origin])
+			last := s.Values[origin-1]
+			// actual[h] is the value h steps after the last one.
+			actual := []float64{last}
+			for h := 1; h <= cfg.Horizon && origin-1+h < len(s.Values); h++ {
+				actual = append(actual, s.Values[origin-1+h])
+			}
+
+			for h := 1; h < len(actual); h++ {
+				report.Horizons[h-1].N++
+				sum := &sums[h-1]
+				// Without a forecast this far ahead, the forecast is
+				// counted as flat and not covering the actual value.
+				p := forecast.ForecastPoint{Low: math.NaN(), Predicted: last, High: math.NaN()}
+				if h < len(points) {
+					p = points[h]
+				}
+				sum.absErr += math.Abs(actual[h] - p.Predicted)
+				if actual[h] != 0 {
+					sum.absPctErr += math.Abs((actual[h] - p.Predicted) / actual[h])
+					sum.pctN++
+				}
+				if actual[h] >= p.Low && actual[h] <= p.High {
+					sum.covered++
+				}
+			}
+
+			actualPoints := make([]forecast.ForecastPoint, len(actual))
+			for i, v := range actual {
+				actualPoints[i] = forecast.ForecastPoint{Low: v, Predicted: v, High: v}
+			}
+			// forecast.ETA doesn't count crossings in the first step, so
+			// targets start between the first and second steps ahead.
+			for h := 2; h < len(actual); h++ {
+				if actual[h] == actual[h-1] {
+					continue
+				}
+				target := (actual[h-1] + actual[h]) / 2
+				actualETA, ok := forecast.ETA(actualPoints, target)
+				if !ok {
+					continue
+				}
+				// forecast.ETA is a step short of the crossing, so
+				// targets are grouped by the step they're reached at.
+				stats, sum := &report.Horizons[actualETA], &sums[actualETA]
+				stats.ETAN++
+				eta, ok := forecast.ETA(points, target)
+				if !ok {
+					stats.ETAMissed++
+					continue
+				}
+				sum.etaFound++
+				sum.etaAbsErr += math.Abs(float64(eta - actualETA))
+			}
+		}
+	}
+
+	for h, sum := range sums {
+		stats := &report.Horizons[h]
+		stats.MAE = mean(sum.absErr, stats.N)
+		stats.MAPE = mean(sum.absPctErr, sum.pctN)
+		stats.Coverage = mean(sum.covered, stats.N)
+		stats.ETAMAE = mean(sum.etaAbsErr, sum.etaFound)
+	}
+	return report
+}
+
+// RunAll backtests each named model.
+func RunAll(models []string, series []Series, cfg Config) ([]Report, error) {
+	reports := []Report{}
+	for _, model := range models {
+		forecaster, err := forecast.New(model)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, Run(model, forecaster, series, cfg))
+	}
+	return reports, nil
+}
+
+func mean(total float64, n int) Metric {
+	if n == 0 {
+		return Metric(math.NaN())
+	}
+	return Metric(total / float64(n))
+}
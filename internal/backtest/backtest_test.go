@@ -0,0 +1,206 @@
+package backtest
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Preetam/transverse/internal/forecast"
+	_ "github.com/Preetam/transverse/internal/forecast1"
+	_ "github.com/Preetam/transverse/internal/forecast2"
+	_ "github.com/Preetam/transverse/internal/forecast3"
+)
+
+// lineForecaster extends the line through the last two values, with an
+// interval of ±1.
+type lineForecaster struct{}
+
+func (lineForecaster) Forecast(data []float64) []forecast.ForecastPoint {
+	if len(data) < 2 {
+		return nil
+	}
+	last, slope := data[len(data)-1], data[len(data)-1]-data[len(data)-2]
+	points := []forecast.ForecastPoint{}
+	for i := 0; i < 5; i++ {
+		v := last + float64(i)*slope
+		points = append(points, forecast.ForecastPoint{Low: v - 1, Predicted: v, High: v + 1})
+	}
+	return points
+}
+
+func TestRun(t *testing.T) {
+	line := Series{Name: "line", Values: []float64{0, 2, 4, 6, 8, 10, 12, 14}}
+	report := Run("line", lineForecaster{}, []Series{line}, Config{MinTrain: 4, Horizon: 6, Step: 1})
+	if report.Origins != 4 {
+		t.Errorf("expected 4 origins, got %d", report.Origins)
+	}
+	// Origins at 4 through 7 have 4, 3, 2 and 1 values after them.
+	for h, n := range []int{4, 3, 2, 1, 0, 0} {
+		stats := report.Horizons[h]
+		if stats.N != n {
+			t.Errorf("horizon %d: expected n %d, got %d", h+1, n, stats.N)
+		}
+		if n == 0 {
+			if !math.IsNaN(float64(stats.MAE)) {
+				t.Errorf("horizon %d: expected no MAE, got %v", h+1, stats.MAE)
+			}
+			continue
+		}
+		// The forecast only has 4 steps ahead, and is flat after that.
+		expectedMAE, expectedCoverage := 0.0, 1.0
+		if h == 4 {
+			expectedMAE, expectedCoverage = 10, 0
+		}
+		if float64(stats.MAE) != expectedMAE || float64(stats.Coverage) != expectedCoverage {
+			t.Errorf("horizon %d: expected MAE %v and coverage %v, got %v and %v",
+				h+1, expectedMAE, expectedCoverage, stats.MAE, stats.Coverage)
+		}
+	}
+	// Targets between each pair of actual values are reached exactly.
+	// forecast.ETA doesn't count crossings in the first step.
+	for h, n := range []int{0, 3, 2, 1, 0, 0} {
+		stats := report.Horizons[h]
+		if stats.ETAN != n || stats.ETAMissed != 0 || (n > 0 && stats.ETAMAE != 0) {
+			t.Errorf("horizon %d: unexpected ETA stats %+v", h+1, stats)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, []Report{report}); err != nil {
+		t.Fatal(err)
+	}
+	decoded := []map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if mae := decoded[0]["horizons"].([]interface{})[5].(map[string]interface{})["mae"]; mae != nil {
+		t.Errorf("expected a null MAE, got %v", mae)
+	}
+	buf.Reset()
+	if err := WriteText(&buf, []Report{report}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		// Exported goal data, with a missing day and a forecast row.
+		"export.csv": "date,value,prediction,low,high\n" +
+			"2018-01-01,1,,,\n2018-01-03,3,,,\n2018-01-04,,4,3,5\n",
+		"export.tsv":   "date\tvalue\n2018-01-01T00:00:00Z\t1\n2018-01-02T00:00:00Z\t2\n",
+		"export.jsonl": `{"date":"2018-01-01","value":5}` + "\n" + `{"date":"2018-01-02","value":null,"prediction":6,"low":5,"high":7}` + "\n",
+		"hourly.csv": "date,value\n2018-01-01T00:00:00Z,1\n2018-01-01T01:00:00Z,2\n" +
+			"2018-01-01T03:00:00Z,4\n2018-01-01T04:00:00Z,5\n",
+		"monthly.csv": "date,value\n2018-01-15,1\n2018-02-15,2\n2018-04-15,4\n2018-05-15,5\n",
+		// Weighed every Monday, except one Sunday, and a skipped week.
+		"weekly.csv": "date,value\n2018-01-01,1\n2018-01-07,2\n2018-01-22,4\n2018-01-29,5\n",
+		"plain.csv":  "1\n2\n4\n",
+		"notes.txt":  "ignored",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	series, err := LoadSeries([]string{dir}, Auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Series{
+		{Name: "export", Values: []float64{1, 2, 3}},
+		{Name: "export", Values: []float64{5}},
+		{Name: "export", Values: []float64{1, 2}},
+		{Name: "hourly", Values: []float64{1, 2, 3, 4, 5}},
+		{Name: "monthly", Values: []float64{1, 2, 3, 4, 5}},
+		{Name: "plain", Values: []float64{1, 2, 4}},
+		{Name: "weekly", Values: []float64{1, 2, 3, 4, 5}},
+	}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("expected %v, got %v", expected, series)
+	}
+
+	// An explicit resolution overrides the inferred one.
+	series, err = LoadSeries([]string{filepath.Join(dir, "monthly.csv")}, Weekly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(series[0].Values); n != 18 {
+		t.Errorf("expected 18 weeks, got %d", n)
+	}
+	if _, err := ParseResolution("fortnight"); err == nil {
+		t.Error("expected an error for an unknown resolution")
+	}
+
+	if _, err := LoadSeries([]string{filepath.Join(dir, "missing.csv")}, Auto); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+// TestFixtures backtests the registered models on the series in testdata.
+// The thresholds are loose; they're meant to catch a model that has
+// broken, not to rank them.
+func TestFixtures(t *testing.T) {
+	series, err := LoadSeries([]string{"testdata"}, Auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) == 0 {
+		t.Fatal("expected fixture series")
+	}
+	cfg := Config{MinTrain: 28, Horizon: 7, Step: 7}
+	if testing.Short() {
+		cfg.Step = 21
+	}
+	reports, err := RunAll(forecast.Models(), series, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	WriteText(&buf, reports)
+	t.Logf("\n%s", buf.String())
+
+	for _, report := range reports {
+		for _, stats := range report.Horizons {
+			if stats.N == 0 {
+				t.Errorf("%s: no forecasts scored at horizon %d", report.Model, stats.Horizon)
+				continue
+			}
+			if float64(stats.MAPE) > 0.15 {
+				t.Errorf("%s: MAPE %.3f at horizon %d", report.Model, stats.MAPE, stats.Horizon)
+			}
+			if float64(stats.Coverage) < 0.4 {
+				t.Errorf("%s: coverage %.3f at horizon %d", report.Model, stats.Coverage, stats.Horizon)
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package backtest
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"text/tabwriter"
+)
+
+// WriteText writes reports as a table per model.
+func WriteText(w io.Writer, reports []Report) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s: %d series, %d origins, nominal coverage %s\n",
+			report.Model, report.Series, report.Origins, percent(NominalCoverage))
+		fmt.Fprintln(tw, "horizon\tn\tMAE\tMAPE\tcoverage\tETA n\tETA missed\tETA MAE\t")
+		for _, stats := range report.Horizons {
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%d\t%d\t%s\t\n",
+				stats.Horizon, stats.N, number(stats.MAE), percent(float64(stats.MAPE)),
+				percent(float64(stats.Coverage)), stats.ETAN, stats.ETAMissed, number(stats.ETAMAE))
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes reports as an indented JSON array.
+func WriteJSON(w io.Writer, reports []Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(reports)
+}
+
+func number(m Metric) string {
+	if math.IsNaN(float64(m)) {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f", float64(m))
+}
+
+func percent(f float64) string {
+	if math.IsNaN(f) {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", f*100)
+}
@@ -0,0 +1,299 @@
+package backtest
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadSeries reads series from files and directories. Directories are read
+// for .csv, .tsv and .jsonl files, not recursively. Files can be plain
+// "date,value" or "value" CSV, or goal data exported as CSV, TSV or JSON
+// Lines. Rows without a value, like forecast rows, are skipped. If every
+// row has a date, there's one value per step at resolution, and missing
+// steps are interpolated. With Auto, each file's resolution is inferred
+// from its dates.
+func LoadSeries(paths []string, resolution Resolution) ([]Series, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".csv", ".tsv", ".jsonl":
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	series := []Series{}
+	for _, file := range files {
+		s, err := loadFile(file, resolution)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// row is a value and its date, which is empty if it doesn't have one.
+type row struct {
+	date  string
+	value float64
+}
+
+func loadFile(path string, resolution Resolution) (Series, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	var rows []row
+	var err error
+	switch filepath.Ext(path) {
+	case ".jsonl":
+		rows, err = readJSONLines(path)
+	case ".tsv":
+		rows, err = readDelimited(path, '\t')
+	default:
+		rows, err = readDelimited(path, ',')
+	}
+	if err != nil {
+		return Series{}, err
+	}
+	return Series{Name: name, Values: fillSteps(rows, resolution)}, nil
+}
+
+func readJSONLines(path string) ([]row, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows := []row{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		r := struct {
+			Date  string   `json:"date"`
+			Value *float64 `json:"value"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if r.Value != nil {
+			rows = append(rows, row{date: r.Date, value: *r.Value})
+		}
+	}
+	return rows, scanner.Err()
+}
+
+func readDelimited(path string, delimiter rune) ([]row, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	// The value is in the "value" column if there's a header, and
+	// otherwise the second column if there's a date.
+	dateColumn, valueColumn := -1, 0
+	if len(records[0]) > 1 {
+		dateColumn, valueColumn = 0, 1
+	}
+	if _, err := parseValue(records[0], valueColumn); err != nil {
+		for i, field := range records[0] {
+			if strings.EqualFold(strings.TrimSpace(field), "value") {
+				valueColumn = i
+			}
+		}
+		records = records[1:]
+	}
+
+	rows := []row{}
+	for i, record := range records {
+		if valueColumn >= len(record) || strings.TrimSpace(record[valueColumn]) == "" {
+			continue
+		}
+		value, err := parseValue(record, valueColumn)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", i+1, err)
+		}
+		r := row{value: value}
+		if dateColumn >= 0 {
+			r.date = strings.TrimSpace(record[dateColumn])
+		}
+		rows = append(rows, r)
+	}
+	return rows, nil
+}
+
+func parseValue(record []string, column int) (float64, error) {
+	if column >= len(record) {
+		return 0, fmt.Errorf("no column %d", column)
+	}
+	return strconv.ParseFloat(strings.TrimSpace(record[column]), 64)
+}
+
+// Resolution is the time between consecutive values of a series.
+type Resolution string
+
+const (
+	// Auto infers a file's resolution from the gaps between its dates.
+	Auto    Resolution = "auto"
+	Hourly  Resolution = "hour"
+	Daily   Resolution = "day"
+	Weekly  Resolution = "week"
+	Monthly Resolution = "month"
+)
+
+// ParseResolution parses auto, hour, day, week or month.
+func ParseResolution(s string) (Resolution, error) {
+	switch r := Resolution(s); r {
+	case Auto, Hourly, Daily, Weekly, Monthly:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown resolution %q", s)
+}
+
+// steps returns the number of the step each time falls in. Consecutive
+// steps differ by one. Weeks are counted from the first time and rounded,
+// so a value recorded a day early or late is still a week after the
+// previous one.
+func (r Resolution) steps(times []time.Time) []int64 {
+	steps := make([]int64, len(times))
+	var firstDay int64
+	for i, t := range times {
+		year, month, day := t.Date()
+		days := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / 86400
+		if i == 0 {
+			firstDay = days
+		}
+		switch r {
+		case Hourly:
+			steps[i] = days*24 + int64(t.Hour())
+		case Weekly:
+			steps[i] = int64(math.Floor(float64(days-firstDay)/7 + 0.5))
+		case Monthly:
+			steps[i] = int64(year)*12 + int64(month) - 1
+		default:
+			steps[i] = days
+		}
+	}
+	return steps
+}
+
+// inferResolution returns the resolution closest to the median gap
+// between times, which must be in order.
+func inferResolution(times []time.Time) Resolution {
+	gaps := []time.Duration{}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+	if len(gaps) == 0 {
+		return Daily
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	switch median := gaps[len(gaps)/2]; {
+	case median < 12*time.Hour:
+		return Hourly
+	case median < 4*24*time.Hour:
+		return Daily
+	case median < 20*24*time.Hour:
+		return Weekly
+	}
+	return Monthly
+}
+
+// fillSteps returns the values of rows, one per step at resolution,
+// interpolating missing steps if every row has a YYYY-MM-DD or RFC3339
+// date. Rows in the same step keep the last value. Without dates, the
+// values are returned as they are.
+func fillSteps(rows []row, resolution Resolution) []float64 {
+	times := make([]time.Time, len(rows))
+	for i, r := range rows {
+		t, err := time.Parse("2006-01-02", r.date)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, r.date)
+		}
+		if err != nil {
+			values := make([]float64, len(rows))
+			for i, r := range rows {
+				values[i] = r.value
+			}
+			return values
+		}
+		times[i] = t
+	}
+	if resolution == Auto {
+		resolution = inferResolution(times)
+	}
+	steps := resolution.steps(times)
+
+	values := []float64{}
+	for i, r := range rows {
+		if i > 0 && steps[i] <= steps[i-1] {
+			if steps[i] == steps[i-1] {
+				values[len(values)-1] = r.value
+			}
+			continue
+		}
+		if i > 0 {
+			prev := values[len(values)-1]
+			gap := steps[i] - steps[i-1]
+			for d := int64(1); d < gap; d++ {
+				values = append(values, prev+float64(d)/float64(gap)*(r.value-prev))
+			}
+		}
+		values = append(values, r.value)
+	}
+	return values
+}
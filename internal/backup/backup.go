@@ -0,0 +1,217 @@
+// Package backup reads and writes full-system backup archives: a metadata
+// snapshot and the data of every live goal in a single tar.gz file.
+package backup
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// An archive contains these files, in this order:
+//
+//	metadata.json      the metadata service snapshot, as written by
+//	                   MetadataService.Snapshot
+//	goals/<id>.json    a JSON array of each live goal's points
+//	manifest.json      a Manifest, written last so it's only present in
+//	                   complete archives
+const (
+	Format       = 1
+	ManifestName = "manifest.json"
+	MetadataName = "metadata.json"
+	goalPrefix   = "goals/"
+	goalSuffix   = ".json"
+)
+
+var (
+	ErrIncomplete = errors.New("backup: archive is incomplete")
+	ErrNoMetadata = errors.New("backup: archive has no metadata snapshot")
+)
+
+type Manifest struct {
+	Format          int         `json:"format"`
+	Created         time.Time   `json:"created"`
+	MetadataVersion uint64      `json:"metadata_version"`
+	Goals           []GoalEntry `json:"goals"`
+}
+
+type GoalEntry struct {
+	ID     string `json:"id"`
+	Points int    `json:"points"`
+	Size   int64  `json:"size"`
+}
+
+// Writer writes an archive.
+type Writer struct {
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	manifest Manifest
+	created  time.Time
+}
+
+func NewWriter(w io.Writer) *Writer {
+	gz := gzip.NewWriter(w)
+	now := time.Now().UTC()
+	return &Writer{
+		gz:       gz,
+		tw:       tar.NewWriter(gz),
+		manifest: Manifest{Format: Format, Created: now, Goals: []GoalEntry{}},
+		created:  now,
+	}
+}
+
+// WriteMetadata writes the metadata snapshot at version. It must be
+// called before any goals are written.
+func (w *Writer) WriteMetadata(version uint64, snapshot []byte) error {
+	w.manifest.MetadataVersion = version
+	return w.writeFile(MetadataName, snapshot)
+}
+
+// WriteGoal writes a goal's data, which should be a JSON array of points.
+func (w *Writer) WriteGoal(id string, points int, data []byte) error {
+	if !validGoalID(id) {
+		return fmt.Errorf("backup: invalid goal ID %q", id)
+	}
+	w.manifest.Goals = append(w.manifest.Goals, GoalEntry{
+		ID:     id,
+		Points: points,
+		Size:   int64(len(data)),
+	})
+	return w.writeFile(goalPrefix+id+goalSuffix, data)
+}
+
+// validGoalID returns true if id can be used in a file and object name.
+func validGoalID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/.\\\x00")
+}
+
+// Close writes the manifest and finishes the archive. It doesn't close
+// the underlying writer.
+func (w *Writer) Close() error {
+	manifest, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = w.writeFile(ManifestName, manifest)
+	if err != nil {
+		return err
+	}
+	err = w.tw.Close()
+	if err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// Manifest returns the manifest of what's been written so far.
+func (w *Writer) Manifest() Manifest {
+	return w.manifest
+}
+
+func (w *Writer) writeFile(name string, data []byte) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: w.created,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.tw.Write(data)
+	return err
+}
+
+// Reader reads an archive.
+type Reader struct {
+	// Metadata is called with the metadata snapshot.
+	Metadata func(snapshot io.Reader) error
+	// Goal is called with each goal's data.
+	Goal func(id string, data io.Reader) error
+}
+
+// Read reads an archive, calling r.Metadata and r.Goal if they're set,
+// and returns its manifest. It returns ErrIncomplete if the archive
+// doesn't end with a manifest or doesn't have the goals it lists. The
+// callbacks may have been called even if Read returns an error.
+func (r Reader) Read(archive io.Reader) (Manifest, error) {
+	manifest := Manifest{}
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return manifest, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	haveManifest := false
+	goals := map[string]bool{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+		switch {
+		case header.Name == MetadataName:
+			if r.Metadata != nil {
+				err = r.Metadata(tr)
+			}
+		case header.Name == ManifestName:
+			err = json.NewDecoder(tr).Decode(&manifest)
+			haveManifest = true
+		case strings.HasPrefix(header.Name, goalPrefix) && strings.HasSuffix(header.Name, goalSuffix):
+			id := strings.TrimSuffix(strings.TrimPrefix(header.Name, goalPrefix), goalSuffix)
+			if !validGoalID(id) {
+				return manifest, fmt.Errorf("backup: invalid goal ID %q", id)
+			}
+			goals[id] = true
+			if r.Goal != nil {
+				err = r.Goal(id, tr)
+			}
+		default:
+			// Unknown file, maybe from a newer version.
+			_, err = io.Copy(ioutil.Discard, tr)
+		}
+		if err != nil {
+			return manifest, err
+		}
+	}
+
+	if !haveManifest {
+		return manifest, ErrIncomplete
+	}
+	if manifest.Format != Format {
+		return manifest, fmt.Errorf("backup: unknown format %d", manifest.Format)
+	}
+	for _, goal := range manifest.Goals {
+		if !goals[goal.ID] {
+			return manifest, ErrIncomplete
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,87 @@
+package backup
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	err := w.WriteMetadata(3, []byte(`[]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteGoal("abc", 1, []byte(`[{"ts":"2018-01-01T00:00:00Z","value":1}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteGoal("../abc", 0, []byte(`[]`)); err == nil {
+		t.Error("expected an error for an invalid goal ID")
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := ""
+	goals := map[string]string{}
+	manifest, err := Reader{
+		Metadata: func(r io.Reader) error {
+			data, err := ioutil.ReadAll(r)
+			metadata = string(data)
+			return err
+		},
+		Goal: func(id string, r io.Reader) error {
+			data, err := ioutil.ReadAll(r)
+			goals[id] = string(data)
+			return err
+		},
+	}.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.MetadataVersion != 3 || len(manifest.Goals) != 1 || manifest.Goals[0].ID != "abc" {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+	if metadata != `[]` {
+		t.Errorf("unexpected metadata %q", metadata)
+	}
+	if len(goals) != 1 || goals["abc"] == "" {
+		t.Errorf("unexpected goals %v", goals)
+	}
+}
+
+func TestReadIncomplete(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.WriteMetadata(1, []byte(`[]`))
+	w.WriteGoal("abc", 0, []byte(`[]`))
+	// Finish the tar stream without the manifest.
+	w.tw.Close()
+	w.gz.Close()
+
+	_, err := Reader{}.Read(bytes.NewReader(buf.Bytes()))
+	if err != ErrIncomplete {
+		t.Errorf("expected ErrIncomplete, got %v", err)
+	}
+}
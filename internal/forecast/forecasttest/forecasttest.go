@@ -0,0 +1,121 @@
+// Package forecasttest has the checks shared by the tests of the forecast
+// models.
+package forecasttest
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Preetam/transverse/internal/forecast"
+)
+
+// Series are forecast by the checks and benchmarks.
+var Series = map[string][]float64{
+	"linear":     {0, 1, 2, 3, 4, 5, 6, 7},
+	"doubling":   {0, 1, 2, 4, 8, 16, 32, 64},
+	"line":       noisy(40, func(i float64) float64 { return 100 - 0.5*i }),
+	"weekly":     noisy(60, func(i float64) float64 { return 50 + 10*math.Sin(2*math.Pi*i/7) }),
+	"levels_off": noisy(60, func(i float64) float64 { return 200 - 40*(1-math.Exp(-i/15)) }),
+}
+
+// noisy returns n values of f with deterministic noise.
+func noisy(n int, f func(i float64) float64) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = f(float64(i)) + 2*math.Sin(float64(i*i))
+	}
+	return values
+}
+
+// Degenerate checks forecasts of too little or constant data. Forecasters
+// return a point for every value after the first, none of them NaN or
+// infinite, and constant data is forecast to stay constant.
+func Degenerate(t *testing.T, forecaster forecast.Forecaster) {
+	for _, test := range []struct {
+		data   []float64
+		points int
+		// constant is set if every point should be data[0].
+		constant bool
+	}{
+		{data: nil, points: 0},
+		{data: []float64{1}, points: 0},
+		{data: []float64{1, 1}, points: 1, constant: true},
+		{data: []float64{5, 5, 5, 5, 5}, points: 4, constant: true},
+		{data: []float64{0, 0, 0}, points: 2, constant: true},
+	} {
+		points := forecaster.Forecast(test.data)
+		if len(points) != test.points {
+			t.Errorf("%v: expected %d points, got %d", test.data, test.points, len(points))
+		}
+		for i, p := range points {
+			for _, v := range []float64{p.Low, p.Predicted, p.High} {
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					t.Errorf("%v: point %d is %v", test.data, i, p)
+				} else if test.constant && math.Abs(v-test.data[0]) > 1e-9 {
+					t.Errorf("%v: expected point %d to be %v, got %v", test.data, i, test.data[0], p)
+				}
+			}
+		}
+	}
+}
+
+// MatchesExhaustive checks that forecasts with fast searches are within 5%
+// of the interval width of the exhaustive ones. They can differ a little:
+// the square error has long, flat valleys, and points along them are about
+// as good as each other.
+func MatchesExhaustive(t *testing.T, fast, exhaustive forecast.Forecaster) {
+	for name, data := range Series {
+		got := fast.Forecast(data)
+		want := exhaustive.Forecast(data)
+		if len(got) != len(want) {
+			t.Errorf("%s: expected %d points, got %d", name, len(want), len(got))
+			continue
+		}
+		for i, expected := range want {
+			tolerance := 0.05*(expected.High-expected.Low) + 1e-9*math.Max(1, math.Abs(expected.Predicted))
+			if math.Abs(got[i].Low-expected.Low) > tolerance ||
+				math.Abs(got[i].Predicted-expected.Predicted) > tolerance ||
+				math.Abs(got[i].High-expected.High) > tolerance {
+				t.Errorf("%s: point %d: expected %v, got %v", name, i, expected, got[i])
+			}
+		}
+	}
+}
+
+// Benchmark benchmarks forecasting Series with fast and exhaustive
+// searches.
+func Benchmark(b *testing.B, fast, exhaustive forecast.Forecaster) {
+	for _, bench := range []struct {
+		name       string
+		forecaster forecast.Forecaster
+	}{
+		{"fast", fast},
+		{"exhaustive", exhaustive},
+	} {
+		forecaster := bench.forecaster
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, data := range Series {
+					forecaster.Forecast(data)
+				}
+			}
+		})
+	}
+}
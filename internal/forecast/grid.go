@@ -0,0 +1,170 @@
+package forecast
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"math"
+	"sort"
+)
+
+// Grid is the values Lo, Lo+Step, ... below Hi that forecasters search
+// for parameters.
+type Grid struct {
+	Lo, Hi, Step float64
+}
+
+// Len returns the number of values in the grid.
+func (g Grid) Len() int {
+	n := int(math.Ceil((g.Hi-g.Lo)/g.Step - 1e-9))
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// At returns the ith value of the grid.
+func (g Grid) At(i int) float64 {
+	return g.Lo + float64(i)*g.Step
+}
+
+// First returns the first value of the grid where ok is true, and Hi if
+// there isn't one. ok has to be monotonic: once it's true for a value it
+// must be true for every larger value. It's a binary search, so ok is
+// called about log2(Len) times.
+func (g Grid) First(ok func(float64) bool) float64 {
+	i := sort.Search(g.Len(), func(i int) bool { return ok(g.At(i)) })
+	if i == g.Len() {
+		return g.Hi
+	}
+	return g.At(i)
+}
+
+// FirstExhaustive is First with a linear scan, for checking First against.
+func (g Grid) FirstExhaustive(ok func(float64) bool) float64 {
+	for i := 0; i < g.Len(); i++ {
+		if ok(g.At(i)) {
+			return g.At(i)
+		}
+	}
+	return g.Hi
+}
+
+// coarseStride is the distance in grid steps between the points Minimize
+// evaluates first, and coarseStarts how many of the best of them it
+// searches from.
+const (
+	coarseStride = 16
+	coarseStarts = 3
+)
+
+// Minimize returns the values x and y of the grid that minimize f. It
+// evaluates f on a coarse grid, then runs a pattern search from each of
+// the best few points: it moves to the best neighbor a stride away until
+// there isn't a better one, then halves the stride. That finds the
+// minimum of smooth functions with a few hundred calls instead of Len²
+// of them. Ties go to the smaller x and then y, like MinimizeExhaustive.
+func (g Grid) Minimize(f func(x, y float64) float64) (float64, float64) {
+	n := g.Len()
+	if n == 0 {
+		return g.Lo, g.Lo
+	}
+
+	type point struct {
+		i, j  int
+		value float64
+	}
+	// less orders points by value, with NaN last, and then position.
+	less := func(a, b point) bool {
+		aNaN, bNaN := math.IsNaN(a.value), math.IsNaN(b.value)
+		if aNaN != bNaN {
+			return bNaN
+		}
+		if !aNaN && a.value != b.value {
+			return a.value < b.value
+		}
+		return a.i < b.i || (a.i == b.i && a.j < b.j)
+	}
+	values := map[[2]int]float64{}
+	eval := func(i, j int) point {
+		v, ok := values[[2]int{i, j}]
+		if !ok {
+			v = f(g.At(i), g.At(j))
+			values[[2]int{i, j}] = v
+		}
+		return point{i, j, v}
+	}
+
+	coarse := []int{}
+	for i := 0; i < n; i += coarseStride {
+		coarse = append(coarse, i)
+	}
+	if coarse[len(coarse)-1] != n-1 {
+		coarse = append(coarse, n-1)
+	}
+	starts := []point{}
+	for _, i := range coarse {
+		for _, j := range coarse {
+			starts = append(starts, eval(i, j))
+		}
+	}
+	sort.Slice(starts, func(a, b int) bool { return less(starts[a], starts[b]) })
+	if len(starts) > coarseStarts {
+		starts = starts[:coarseStarts]
+	}
+
+	best := starts[0]
+	for _, p := range starts {
+		for stride := coarseStride / 2; stride >= 1; stride /= 2 {
+			for moved := true; moved; {
+				moved = false
+				center := p
+				for i := center.i - stride; i <= center.i+stride; i += stride {
+					for j := center.j - stride; j <= center.j+stride; j += stride {
+						if i < 0 || j < 0 || i >= n || j >= n {
+							continue
+						}
+						if q := eval(i, j); less(q, p) {
+							p, moved = q, true
+						}
+					}
+				}
+			}
+		}
+		if less(p, best) {
+			best = p
+		}
+	}
+	return g.At(best.i), g.At(best.j)
+}
+
+// MinimizeExhaustive is Minimize evaluating f at every point of the grid.
+func (g Grid) MinimizeExhaustive(f func(x, y float64) float64) (float64, float64) {
+	bestX, bestY := g.Lo, g.Lo
+	bestValue := math.Inf(1)
+	first := true
+	for i := 0; i < g.Len(); i++ {
+		for j := 0; j < g.Len(); j++ {
+			x, y := g.At(i), g.At(j)
+			if v := f(x, y); first || v < bestValue {
+				bestX, bestY, bestValue = x, y, v
+				first = false
+			}
+		}
+	}
+	return bestX, bestY
+}
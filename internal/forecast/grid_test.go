@@ -0,0 +1,74 @@
+package forecast_test
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Preetam/transverse/internal/forecast"
+)
+
+func TestGridFirst(t *testing.T) {
+	grid := forecast.Grid{Lo: 1, Hi: 3, Step: 0.001}
+	if n := grid.Len(); n != 2000 {
+		t.Fatalf("expected 2000 values, got %d", n)
+	}
+	for _, threshold := range []float64{0, 1, 1.0005, 1.5, 2.999, 3.5} {
+		calls := 0
+		ok := func(m float64) bool {
+			calls++
+			return m >= threshold
+		}
+		first := grid.First(ok)
+		if calls > 12 {
+			t.Errorf("threshold %v: expected a binary search, got %d calls", threshold, calls)
+		}
+		if expected := grid.FirstExhaustive(ok); first != expected {
+			t.Errorf("threshold %v: expected %v, got %v", threshold, expected, first)
+		}
+	}
+	if first := grid.First(func(float64) bool { return false }); first != 3 {
+		t.Errorf("expected Hi without a value, got %v", first)
+	}
+}
+
+func TestGridMinimize(t *testing.T) {
+	grid := forecast.Grid{Lo: 0.001, Hi: 0.3, Step: 0.001}
+	functions := map[string]func(x, y float64) float64{
+		"bowl":   func(x, y float64) float64 { return (x-0.123)*(x-0.123) + 2*(y-0.25)*(y-0.25) },
+		"corner": func(x, y float64) float64 { return x + y },
+		"flat":   func(x, y float64) float64 { return 1 },
+		"valley": func(x, y float64) float64 { return 100*math.Pow(x-0.01-y*y/10, 2) + math.Pow(y-0.2, 2) },
+	}
+	for name, f := range functions {
+		calls := 0
+		counted := func(x, y float64) float64 {
+			calls++
+			return f(x, y)
+		}
+		x, y := grid.Minimize(counted)
+		expectedX, expectedY := grid.MinimizeExhaustive(f)
+		if math.Abs(x-expectedX) > 1e-9 || math.Abs(y-expectedY) > 1e-9 {
+			t.Errorf("%s: expected (%v, %v), got (%v, %v)", name, expectedX, expectedY, x, y)
+		}
+		if calls > 1000 {
+			t.Errorf("%s: expected fewer than 1000 calls, got %d", name, calls)
+		}
+	}
+}
@@ -30,6 +30,38 @@ type Forecaster interface {
 	Forecast(data []float64) []ForecastPoint
 }
 
+// Versioned is implemented by forecasters that number the versions of
+// their model. The version changes when the same data would get a
+// different forecast, so stored forecasts can be recomputed.
+type Versioned interface {
+	Version() int
+}
+
+// Version returns a forecaster's version, or 0 if it isn't Versioned.
+func Version(f Forecaster) int {
+	if v, ok := f.(Versioned); ok {
+		return v.Version()
+	}
+	return 0
+}
+
 func (p ForecastPoint) String() string {
 	return fmt.Sprintf("(%0.3f, %0.3f, %0.3f)", p.Low, p.Predicted, p.High)
 }
+
+// ETA returns the number of steps until a forecast's prediction crosses
+// target from the side its first point is on, and false if it doesn't.
+// Crossings in the first two steps aren't counted.
+func ETA(points []ForecastPoint, target float64) (int, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+	first := points[0].Predicted
+	for i := 2; i < len(points); i++ {
+		predicted := points[i].Predicted
+		if (first >= target && predicted < target) || (first <= target && predicted > target) {
+			return i - 1, true
+		}
+	}
+	return 0, false
+}
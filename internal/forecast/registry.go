@@ -0,0 +1,69 @@
+package forecast
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownModel is returned by New for names that aren't registered.
+var ErrUnknownModel = errors.New("forecast: unknown model")
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]func() Forecaster{}
+)
+
+// Register makes a forecaster available by name. Implementations call it
+// from an init function. It panics if name is already registered.
+func Register(name string, newForecaster func() Forecaster) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if newForecaster == nil {
+		panic("forecast: Register constructor is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("forecast: Register called twice for " + name)
+	}
+	registry[name] = newForecaster
+}
+
+// New returns a new forecaster registered as name.
+func New(name string) (Forecaster, error) {
+	registryLock.RLock()
+	newForecaster, ok := registry[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownModel
+	}
+	return newForecaster(), nil
+}
+
+// Models returns the sorted names of the registered forecasters.
+func Models() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,67 @@
+package forecast_test
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Preetam/transverse/internal/forecast"
+	_ "github.com/Preetam/transverse/internal/forecast1"
+	_ "github.com/Preetam/transverse/internal/forecast2"
+	_ "github.com/Preetam/transverse/internal/forecast3"
+)
+
+func TestRegistry(t *testing.T) {
+	expected := []string{"forecast1", "forecast2", "forecast3"}
+	if models := forecast.Models(); !reflect.DeepEqual(models, expected) {
+		t.Errorf("expected %v, got %v", expected, models)
+	}
+
+	data := []float64{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, name := range expected {
+		forecaster, err := forecast.New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points := forecaster.Forecast(data)
+		if len(points) == 0 {
+			t.Errorf("%s: expected a forecast", name)
+			continue
+		}
+		for _, p := range points {
+			if p.Low > p.Predicted || p.Predicted > p.High {
+				t.Errorf("%s: prediction outside its interval: %v", name, p)
+			}
+		}
+		if len(forecaster.Forecast(nil)) != 0 {
+			t.Errorf("%s: expected no forecast without data", name)
+		}
+	}
+
+	if _, err := forecast.New("unknown"); err != forecast.ErrUnknownModel {
+		t.Errorf("expected ErrUnknownModel, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a name twice to panic")
+		}
+	}()
+	forecast.Register("forecast1", nil)
+}
@@ -0,0 +1,111 @@
+package forecast1
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"math"
+
+	"github.com/Preetam/transverse/internal/forecast"
+)
+
+// maxModels is the number of steps forecast.
+const maxModels = 20
+
+// Forecaster forecasts with one Model per step ahead. The one step model's
+// level and trend are shared by the others, and the forecast is shifted to
+// start at the last value.
+type Forecaster struct {
+}
+
+func NewForecaster() *Forecaster {
+	return &Forecaster{}
+}
+
+func init() {
+	forecast.Register("forecast1", func() forecast.Forecaster { return NewForecaster() })
+}
+
+func (f *Forecaster) Forecast(data []float64) []forecast.ForecastPoint {
+	result := []forecast.ForecastPoint{}
+	if len(data) == 0 {
+		return result
+	}
+
+	// Set up the initial level and trend from the first few points.
+	initialLevel := 0.0
+	initialTrend := 0.0
+	maxInitialPoints := 4
+	if len(data) == 1 {
+		initialLevel = data[0]
+	} else {
+		if len(data) < maxInitialPoints {
+			maxInitialPoints = len(data)
+		}
+		initialVals := data[:maxInitialPoints]
+		for _, v := range initialVals {
+			initialLevel += v
+		}
+		initialLevel /= float64(maxInitialPoints)
+		initialTrend = (initialVals[len(initialVals)-1] - initialVals[0]) / float64(len(initialVals)-1)
+	}
+
+	steps := maxModels
+	if len(data) < steps {
+		steps = len(data)
+	}
+	models := []*Model{}
+	for i := 1; i <= steps; i++ {
+		models = append(models, NewModel(i))
+	}
+
+	lastValue := 0.0
+	for _, v := range data {
+		models[0].Update(float32(v), float32(initialLevel), float32(initialTrend))
+		for _, m := range models[1:] {
+			m.Update(float32(v), models[0].Level, models[0].Trend)
+		}
+		lastValue = v
+	}
+
+	shift := 0.0
+	lastSqrtErr := float32(0.0)
+	for i, m := range models {
+		prediction := m.Forecast()
+		if i == 0 {
+			shift = lastValue - float64(prediction)
+		}
+		// The interval never narrows further out.
+		sqrtErr := float32(math.Sqrt(float64(m.ErrEWMA)))
+		if sqrtErr < lastSqrtErr {
+			sqrtErr = lastSqrtErr
+		}
+		lastSqrtErr = sqrtErr
+
+		predicted := float64(prediction) + shift
+		if i == 0 {
+			result = append(result, forecast.ForecastPoint{Low: predicted, Predicted: predicted, High: predicted})
+			continue
+		}
+		result = append(result, forecast.ForecastPoint{
+			Low:       float64(prediction-2*sqrtErr) + shift,
+			Predicted: predicted,
+			High:      float64(prediction+2*sqrtErr) + shift,
+		})
+	}
+	return result
+}
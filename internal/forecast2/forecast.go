@@ -24,39 +24,53 @@ import (
 )
 
 type Forecaster struct {
+	// exhaustive searches every point of the grids, like forecasters used
+	// to. It's for checking the faster searches against.
+	exhaustive bool
 }
 
+// parameterGrid is searched for the smoothing parameters alpha and beta.
+var parameterGrid = forecast.Grid{Lo: 0.001, Hi: 0.3, Step: 0.001}
+
+// multiplierGrid is searched for the smallest multiplier of the average
+// errors that gives intervals 90% coverage.
+var multiplierGrid = forecast.Grid{Lo: 1, Hi: 3, Step: 0.001}
+
 func NewForecaster() *Forecaster {
 	return &Forecaster{}
 }
 
+func init() {
+	forecast.Register("forecast2", func() forecast.Forecaster { return NewForecaster() })
+}
+
 func (f *Forecaster) Forecast(data []float64) []forecast.ForecastPoint {
 	result := []forecast.ForecastPoint{}
+	if len(data) == 0 {
+		return result
+	}
 
 	maxInitPoints := len(data)
 	if maxInitPoints > 3 && false {
 		maxInitPoints = 3
 	}
 
-	// Find the best double exponential smoothing model.
-	var minModel *simpleModel
-	for alpha := 0.001; alpha < 0.3; alpha += 0.001 {
-		for beta := 0.001; beta < 0.3; beta += 0.001 {
-			model := newSimpleModel(alpha, beta)
-			model.Initialize(data[:maxInitPoints])
-			model.level = data[0]
-			for _, v := range data {
-				model.AddPoint(v)
-			}
-			if minModel == nil {
-				minModel = model
-			}
-			if minModel.SquareError() > model.SquareError() {
-				minModel = model
-			}
+	// fit returns a model of data with the given parameters.
+	fit := func(alpha, beta float64) *simpleModel {
+		model := newSimpleModel(alpha, beta)
+		model.Initialize(data[:maxInitPoints])
+		model.level = data[0]
+		for _, v := range data {
+			model.AddPoint(v)
 		}
+		return model
 	}
 
+	// Find the best double exponential smoothing model.
+	minModel := fit(f.minimize(func(alpha, beta float64) float64 {
+		return fit(alpha, beta).SquareError()
+	}))
+
 	slope := minModel.trend
 	lastPointValue := data[len(data)-1]
 
@@ -106,8 +120,7 @@ func (f *Forecaster) Forecast(data []float64) []forecast.ForecastPoint {
 		avgErrAbove := errorAbove / pointsForecasted
 		avgErrBelow := errorBelow / pointsForecasted
 
-		var multiplier float64
-		for multiplier = 1.0; multiplier < 3; multiplier += 0.001 {
+		multiplier := f.multiplier(func(multiplier float64) bool {
 			covered := []float64{}
 			for i, predicted := range forecastPointsForCoverage {
 				if i >= len(data) {
@@ -126,9 +139,10 @@ func (f *Forecaster) Forecast(data []float64) []forecast.ForecastPoint {
 
 			if sum(covered)/float64(len(covered)) >= 0.9 {
 				// Have >90% coverage
-				break
+				return true
 			}
-		}
+			return false
+		})
 
 		// Add the nth step ahead forecast (finally).
 		//modelPredicted := minModel.Forecast(nStep - 1)
@@ -159,4 +173,26 @@ func (f *Forecaster) Forecast(data []float64) []forecast.ForecastPoint {
 	return result
 }
 
+// Version 2 finds parameters with forecast.Grid.Minimize instead of
+// searching every point of the grid.
+func (f *Forecaster) Version() int {
+	return 2
+}
+
+// minimize returns the alpha and beta with the smallest square error.
+func (f *Forecaster) minimize(squareError func(alpha, beta float64) float64) (float64, float64) {
+	if f.exhaustive {
+		return parameterGrid.MinimizeExhaustive(squareError)
+	}
+	return parameterGrid.Minimize(squareError)
+}
+
+// multiplier returns the smallest multiplier for which ok is true.
+func (f *Forecaster) multiplier(ok func(multiplier float64) bool) float64 {
+	if f.exhaustive {
+		return multiplierGrid.FirstExhaustive(ok)
+	}
+	return multiplierGrid.First(ok)
+}
+
 var _ forecast.Forecaster = &Forecaster{}
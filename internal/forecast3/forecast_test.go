@@ -17,9 +17,25 @@ package forecast3
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/Preetam/transverse/internal/forecast/forecasttest"
+)
 
 func TestForecast(t *testing.T) {
 	forecaster := NewForecaster()
 	t.Logf("%v", forecaster.Forecast([]float64{0, 1, 2, 4, 8, 16, 32, 64}))
 }
+
+func TestForecastDegenerate(t *testing.T) {
+	forecasttest.Degenerate(t, NewForecaster())
+}
+
+func TestForecastMatchesExhaustive(t *testing.T) {
+	forecasttest.MatchesExhaustive(t, NewForecaster(), &Forecaster{exhaustive: true})
+}
+
+func BenchmarkForecast(b *testing.B) {
+	forecasttest.Benchmark(b, NewForecaster(), &Forecaster{exhaustive: true})
+}
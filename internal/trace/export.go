@@ -0,0 +1,271 @@
+package trace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	maxQueuedSpans = 4096
+	maxBatchSize   = 256
+	flushInterval  = 5 * time.Second
+)
+
+// Exporter sends OTLP JSON encoded spans somewhere.
+type Exporter interface {
+	Export(payload []byte) error
+}
+
+var (
+	exporterLock sync.RWMutex
+	queue        chan *Span
+)
+
+// Start starts exporting finished spans for the named service.
+// Spans are dropped until Start is called.
+func Start(service string, exporter Exporter) {
+	exporterLock.Lock()
+	defer exporterLock.Unlock()
+	if queue != nil {
+		panic("trace: already started")
+	}
+	queue = make(chan *Span, maxQueuedSpans)
+	go exportLoop(service, exporter, queue)
+}
+
+// NewExporter returns a FileExporter if path is set, an HTTPExporter if
+// endpoint is set, or nil if neither is set.
+func NewExporter(path, endpoint string) (Exporter, error) {
+	if path != "" {
+		return NewFileExporter(path)
+	}
+	if endpoint != "" {
+		return NewHTTPExporter(endpoint), nil
+	}
+	return nil, nil
+}
+
+func record(s *Span) {
+	exporterLock.RLock()
+	defer exporterLock.RUnlock()
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- s:
+	default:
+		// Full, so drop the span rather than block the request.
+	}
+}
+
+func exportLoop(service string, exporter Exporter, queue chan *Span) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := []*Span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		payload, err := Encode(service, batch)
+		if err == nil {
+			err = exporter.Export(payload)
+		}
+		if err != nil {
+			log.Warnln("trace: error exporting spans:", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-queue:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// OTLP JSON types. See
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+// Encode returns spans encoded as an OTLP JSON export request.
+func Encode(service string, spans []*Span) ([]byte, error) {
+	scopeSpans := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/Preetam/transverse/internal/trace"},
+	}
+	for _, s := range spans {
+		s.lock.Lock()
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		keys := []string{}
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: k, Value: otlpValue(s.Attributes[k])})
+		}
+		if s.Error != "" {
+			// STATUS_CODE_ERROR
+			span.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		s.lock.Unlock()
+		scopeSpans.Spans = append(scopeSpans.Spans, span)
+	}
+
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue(service)}},
+			},
+			ScopeSpans: []otlpScopeSpans{scopeSpans},
+		}},
+	})
+}
+
+// FileExporter appends each export request to a file as a line of JSON,
+// like the OpenTelemetry Collector's file exporter.
+type FileExporter struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+// NewFileExporter opens path for appending.
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f}, nil
+}
+
+func (e *FileExporter) Export(payload []byte) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := e.f.Write(append(payload, '\n'))
+	return err
+}
+
+// HTTPExporter posts export requests to an OTLP/HTTP collector endpoint,
+// e.g. http://localhost:4318/v1/traces.
+type HTTPExporter struct {
+	endpoint string
+	http     *http.Client
+}
+
+func NewHTTPExporter(endpoint string) *HTTPExporter {
+	return &HTTPExporter{
+		endpoint: endpoint,
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (e *HTTPExporter) Export(payload []byte) error {
+	resp, err := e.http.Post(e.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("trace: collector status code %d", resp.StatusCode)
+	}
+	return nil
+}
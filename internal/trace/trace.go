@@ -0,0 +1,187 @@
+// Package trace records spans for requests that cross the web and
+// metadata services and exports them in the OpenTelemetry (OTLP) JSON format.
+package trace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header used to
+// propagate spans between services.
+const TraceparentHeader = "Traceparent"
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is a timed operation within a trace.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         Kind
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	// Error is the error message if the operation failed.
+	Error string
+
+	lock  sync.Mutex
+	ended bool
+}
+
+type spanContextKey struct{}
+
+// remoteParent is the span context of a caller in another service.
+type remoteParent struct {
+	traceID string
+	spanID  string
+}
+
+// StartSpan starts a span that's a child of the span in ctx, if any,
+// and returns a context containing the new span.
+func StartSpan(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	span := &Span{
+		SpanID:     newID(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+	}
+	switch parent := ctx.Value(spanContextKey{}).(type) {
+	case *Span:
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	case remoteParent:
+		span.TraceID = parent.traceID
+		span.ParentSpanID = parent.spanID
+	default:
+		span.TraceID = newID(16)
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// FromContext returns the span in ctx, or nil if there isn't one.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// ContextWithTraceparent returns a context whose next span is a child of
+// the span described by a traceparent header. ctx is returned unchanged
+// if the header is missing or invalid.
+func ContextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+	traceID, spanID, ok := ParseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, remoteParent{traceID: traceID, spanID: spanID})
+}
+
+// ParseTraceparent parses a version 00 W3C traceparent header.
+func ParseTraceparent(traceparent string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return "", "", false
+	}
+	if !isHexID(parts[1], 16) || !isHexID(parts[2], 8) || !isHexID(parts[3], 1) {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// Traceparent returns the W3C traceparent header value for the span.
+func (s *Span) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// SetAttribute sets an attribute on the span. Values should be strings,
+// bools, integers or floats.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.lock.Lock()
+	s.Attributes[key] = value
+	s.lock.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.lock.Lock()
+	s.Error = err.Error()
+	s.lock.Unlock()
+}
+
+// Finish ends the span and queues it for export. Only the
+// first call has an effect.
+func (s *Span) Finish() {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.lock.Unlock()
+	record(s)
+}
+
+func newID(size int) string {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func isHexID(s string, size int) bool {
+	if len(s) != size*2 {
+		return false
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return false
+	}
+	if size == 1 {
+		// Flags can be zero.
+		return true
+	}
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	// All zero IDs are invalid.
+	return false
+}
@@ -0,0 +1,88 @@
+package trace
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestPropagation(t *testing.T) {
+	ctx, parent := StartSpan(context.Background(), "web", KindServer)
+	_, child := StartSpan(ctx, "metadata GET", KindClient)
+	if child.TraceID != parent.TraceID || child.ParentSpanID != parent.SpanID {
+		t.Fatalf("expected child of %v, got %v", parent, child)
+	}
+
+	// Simulate the metadata service receiving the client's header.
+	remoteCtx := ContextWithTraceparent(context.Background(), child.Traceparent())
+	_, server := StartSpan(remoteCtx, "GET /goals/abc", KindServer)
+	if server.TraceID != parent.TraceID || server.ParentSpanID != child.SpanID {
+		t.Errorf("expected remote child of %v, got %v", child, server)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, spanID, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spanID != "00f067aa0ba902b7" {
+		t.Errorf("unexpected result %q %q %v", traceID, spanID, ok)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		if _, _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	_, span := StartSpan(context.Background(), "forecast", KindInternal)
+	span.SetAttribute("points", 10)
+	span.SetError(errors.New("failed"))
+	span.Finish()
+
+	payload, err := Encode("test", []*Span{span})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := otlpRequest{}
+	err = json.Unmarshal(payload, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := decoded.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].SpanID != span.SpanID || spans[0].Status.Code != 2 {
+		t.Errorf("unexpected span %+v", spans[0])
+	}
+	if spans[0].Attributes[0].Value["intValue"] != "10" {
+		t.Errorf("unexpected attributes %+v", spans[0].Attributes)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/Preetam/rig"
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+// maxLoggedChanges is the number of applied operations remembered for
+// clients following changes.
+const maxLoggedChanges = 10000
+
+// change is the user or goal an operation wrote.
+type change struct {
+	version uint64
+	user    string
+	goal    string
+}
+
+// changeLog remembers which users and goals recent operations wrote, so
+// clients caching them can drop only what changed.
+type changeLog struct {
+	lock sync.Mutex
+	// changes are in version order.
+	changes []change
+	// complete is the version after which every change is logged.
+	complete uint64
+}
+
+func newChangeLog(version uint64) *changeLog {
+	return &changeLog{complete: version}
+}
+
+// record logs the user or goal written by an operation applied at version.
+// Operations replayed at or before the last logged version are ignored.
+func (l *changeLog) record(version uint64, o rig.Operation) {
+	object := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.Unmarshal(o.Data, &object); err != nil {
+		return
+	}
+	c := change{version: version}
+	switch o.Method {
+	case client.OpUserCreate, client.OpUserUpdate, client.OpUserDelete:
+		c.user = object.ID
+	case client.OpGoalCreate, client.OpGoalUpdate:
+		c.goal = object.ID
+	default:
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if version <= l.complete || (len(l.changes) > 0 && version <= l.changes[len(l.changes)-1].version) {
+		return
+	}
+	l.changes = append(l.changes, c)
+	if len(l.changes) > maxLoggedChanges {
+		l.complete = l.changes[0].version
+		l.changes = l.changes[1:]
+	}
+}
+
+// reset forgets every change, for when the data is replaced at version.
+func (l *changeLog) reset(version uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.changes = nil
+	l.complete = version
+}
+
+// since returns the changes after a version, up to version current.
+func (l *changeLog) since(version, current uint64) client.Changes {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	changes := client.Changes{
+		Version:  current,
+		Complete: version >= l.complete || version >= current,
+		Users:    []string{},
+		Goals:    []string{},
+	}
+	if !changes.Complete {
+		return changes
+	}
+	for _, c := range l.changes {
+		if c.version <= version || c.version > current {
+			continue
+		}
+		if c.user != "" {
+			changes.Users = append(changes.Users, c.user)
+		}
+		if c.goal != "" {
+			changes.Goals = append(changes.Goals, c.goal)
+		}
+	}
+	return changes
+}
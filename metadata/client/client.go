@@ -20,13 +20,24 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/Preetam/transverse/internal/trace"
+	"github.com/Preetam/transverse/metadata/middleware"
+)
+
+const (
+	defaultMaxAttempts = 4
+	defaultBaseBackoff = 100 * time.Millisecond
+	defaultMaxBackoff  = 2 * time.Second
 )
 
 type Client struct {
@@ -34,12 +45,64 @@ type Client struct {
 	base    string
 	token   string
 	headers map[string]string
+
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+}
+
+// ServerError is returned when the server responds with a non-2xx status code.
+type ServerError struct {
+	StatusCode int
+	// Message is the error message returned by the server, if any.
+	Message string
+	// RequestID is the server's ID for the failed request.
+	RequestID string
+}
+
+func (e *ServerError) Error() string {
+	msg := fmt.Sprintf("client: server status code %d", e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// StatusCode returns the HTTP status code of a ServerError,
+// or 0 if err is not a ServerError.
+func StatusCode(err error) int {
+	if serverErr, ok := err.(*ServerError); ok {
+		return serverErr.StatusCode
+	}
+	return 0
 }
 
-type ServerError int
+// IsNotFound returns true if err is a ServerError for a missing resource.
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// IsConflict returns true if err is a ServerError for a write that
+// conflicts with existing data.
+func IsConflict(err error) bool {
+	return StatusCode(err) == http.StatusConflict
+}
+
+type idempotencyKeyContextKey struct{}
 
-func (e ServerError) Error() string {
-	return fmt.Sprintf("client: server status code %d", e)
+// WithIdempotencyKey returns a context that makes writes send key as their
+// idempotency key. The server applies a write with a given key at most once,
+// so writes with a key are retried like reads.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return key
 }
 
 func New(baseURI, token string) *Client {
@@ -53,22 +116,84 @@ func New(baseURI, token string) *Client {
 		},
 		base:  strings.TrimRight(baseURI, "/"),
 		token: token,
+
+		maxAttempts: defaultMaxAttempts,
+		baseBackoff: defaultBaseBackoff,
+		maxBackoff:  defaultMaxBackoff,
 	}
 }
 
-func (c *Client) doRequest(verb string, address string, body, response interface{}) error {
-	payload := bytes.NewBuffer(nil)
+// doRequest sends a request. GET requests and requests with an idempotency
+// key are retried.
+func (c *Client) doRequest(ctx context.Context, verb string, address string, body, response interface{}) error {
+	retryable := verb == "GET" || idempotencyKey(ctx) != ""
+	return c.do(ctx, verb, address, body, response, retryable)
+}
+
+// doReadRequest sends a request that doesn't modify anything on the server,
+// like a batch read, so it's always retried.
+func (c *Client) doReadRequest(ctx context.Context, verb string, address string, body, response interface{}) error {
+	return c.do(ctx, verb, address, body, response, true)
+}
+
+func (c *Client) do(ctx context.Context, verb string, address string, body, response interface{}, retryable bool) error {
+	var payload []byte
 	if body != nil {
-		err := json.NewEncoder(payload).Encode(body)
+		var err error
+		payload, err = json.Marshal(body)
 		if err != nil {
 			return err
 		}
 	}
 
-	request, err := http.NewRequest(verb, c.base+address, payload)
+	maxAttempts := 1
+	if retryable {
+		maxAttempts = c.maxAttempts
+	}
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			err := c.sleep(ctx, attempt)
+			if err != nil {
+				return err
+			}
+		}
+		err = c.attempt(ctx, verb, address, payload, response)
+		if !shouldRetry(ctx, err) {
+			return err
+		}
+	}
+	return err
+}
+
+// attempt sends a request once, recording a client span for it.
+func (c *Client) attempt(ctx context.Context, verb string, address string, payload []byte, response interface{}) error {
+	ctx, span := trace.StartSpan(ctx, "metadata "+verb, trace.KindClient)
+	span.SetAttribute("http.method", verb)
+	span.SetAttribute("http.url", c.base+address)
+	err := c.send(ctx, verb, address, payload, response)
+	if serverErr, ok := err.(*ServerError); ok {
+		span.SetAttribute("http.status_code", serverErr.StatusCode)
+	}
+	span.SetError(err)
+	span.Finish()
+	return err
+}
+
+func (c *Client) send(ctx context.Context, verb string, address string, payload []byte, response interface{}) error {
+	request, err := http.NewRequest(verb, c.base+address, bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
+	request = request.WithContext(ctx)
+
+	if requestID := middleware.RequestIDFromContext(ctx); requestID != "" {
+		request.Header.Set(middleware.RequestIDHeader, requestID)
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		request.Header.Set(trace.TraceparentHeader, span.Traceparent())
+	}
 
 	if c.token != "" {
 		request.Header.Set("X-Api-Key", c.token)
@@ -78,6 +203,10 @@ func (c *Client) doRequest(verb string, address string, body, response interface
 		request.Header.Set(key, val)
 	}
 
+	if key := idempotencyKey(ctx); key != "" {
+		request.Header.Set("Idempotency-Key", key)
+	}
+
 	res, err := c.http.Do(request)
 	if err != nil {
 		return err
@@ -86,11 +215,17 @@ func (c *Client) doRequest(verb string, address string, body, response interface
 	defer io.Copy(ioutil.Discard, res.Body)
 
 	if res.StatusCode/100 != 2 {
-		if response != nil {
-			json.NewDecoder(res.Body).Decode(response)
-			// Ignore errors
+		serverErr := &ServerError{
+			StatusCode: res.StatusCode,
+			RequestID:  res.Header.Get(middleware.RequestIDHeader),
+		}
+		errResponse := struct {
+			Error string `json:"error"`
+		}{}
+		if json.NewDecoder(res.Body).Decode(&errResponse) == nil {
+			serverErr.Message = errResponse.Error
 		}
-		return ServerError(res.StatusCode)
+		return serverErr
 	}
 
 	if response != nil {
@@ -102,3 +237,44 @@ func (c *Client) doRequest(verb string, address string, body, response interface
 
 	return nil
 }
+
+// sleep waits before a retry using exponential backoff with full jitter.
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	backoff := c.baseBackoff << uint(attempt-1)
+	if backoff > c.maxBackoff || backoff <= 0 {
+		backoff = c.maxBackoff
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// shouldRetry returns true if a request that failed with err may succeed
+// if it's sent again.
+func shouldRetry(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if serverErr, ok := err.(*ServerError); ok {
+		switch serverErr.StatusCode {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return false
+	}
+	// Network errors, truncated responses, etc.
+	return true
+}
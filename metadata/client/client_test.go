@@ -0,0 +1,185 @@
+package client
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(url string) *ServiceClient {
+	c := NewServiceClient(url, "")
+	c.client.baseBackoff = time.Millisecond
+	c.client.maxBackoff = time.Millisecond
+	return c
+}
+
+func TestRetryRead(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"data": {"id": "abc", "name": "test"}}`))
+	}))
+	defer server.Close()
+
+	goal, err := newTestClient(server.URL).GetGoal(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goal.Name != "test" {
+		t.Errorf("expected goal name test, got %q", goal.Name)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestNoRetryWithoutIdempotencyKey(t *testing.T) {
+	var requests int32
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := newTestClient(server.URL)
+	err := c.UpdateGoal(context.Background(), Goal{ID: "abc"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+
+	requests = 0
+	keys = nil
+	err = c.UpdateGoal(WithIdempotencyKey(context.Background(), "key1"), Goal{ID: "abc"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if requests != defaultMaxAttempts {
+		t.Errorf("expected %d requests, got %d", defaultMaxAttempts, requests)
+	}
+	for _, key := range keys {
+		if key != "key1" {
+			t.Errorf("expected idempotency key key1, got %q", key)
+		}
+	}
+}
+
+func TestServerError(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("X-Request-Id", "0000abcd")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error": "goal exists"}`))
+	}))
+	defer server.Close()
+
+	err := newTestClient(server.URL).CreateGoal(WithIdempotencyKey(context.Background(), "key1"), Goal{ID: "abc"})
+	if !IsConflict(err) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if IsNotFound(err) {
+		t.Error("expected IsNotFound to be false")
+	}
+	serverErr := err.(*ServerError)
+	if serverErr.Message != "goal exists" || serverErr.RequestID != "0000abcd" {
+		t.Errorf("unexpected server error %#v", serverErr)
+	}
+	if requests != 1 {
+		t.Errorf("expected conflicts not to be retried, got %d requests", requests)
+	}
+}
+
+func TestContextCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := newTestClient(server.URL).GetGoal(ctx, "abc")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestGetGoalsAndUsers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := BatchGetRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Method != "POST" || len(req.IDs) != 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/goals:batchGet":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": GoalBatch{
+				Goals:    map[string]Goal{req.IDs[0]: {ID: req.IDs[0], Name: "test"}},
+				NotFound: req.IDs[1:],
+			}})
+		case "/users:batchGet":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": UserBatch{
+				Users:    map[string]User{req.IDs[0]: {ID: req.IDs[0], Email: "test@example.com"}},
+				NotFound: req.IDs[1:],
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	c := newTestClient(server.URL)
+
+	goals, err := c.GetGoals(context.Background(), []string{"abc", "def"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(goals.Goals) != 1 || goals.Goals["abc"].Name != "test" {
+		t.Errorf("unexpected goals %v", goals.Goals)
+	}
+	if len(goals.NotFound) != 1 || goals.NotFound[0] != "def" {
+		t.Errorf("expected def to be not found, got %v", goals.NotFound)
+	}
+
+	users, err := c.GetUsers(context.Background(), []string{"abc", "def"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users.Users) != 1 || users.Users["abc"].Email != "test@example.com" {
+		t.Errorf("unexpected users %v", users.Users)
+	}
+	if len(users.NotFound) != 1 || users.NotFound[0] != "def" {
+		t.Errorf("expected def to be not found, got %v", users.NotFound)
+	}
+}
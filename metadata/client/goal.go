@@ -18,6 +18,7 @@ package client
  */
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -36,6 +37,26 @@ type Goal struct {
 	Created     int64   `json:"created"`
 	Updated     int64   `json:"updated"`
 	Deleted     int64   `json:"deleted"`
+	// Duplicates is how points with the same timestamp are combined
+	// when data is posted: "last" (the default for level goals), "sum"
+	// (the default for counter goals), "mean" or "max".
+	Duplicates string `json:"duplicates,omitempty"`
+	// Resolution is the period points are bucketed into: "hourly",
+	// "daily" (the default), "weekly" or "monthly".
+	Resolution string `json:"resolution,omitempty"`
+	// Type is "level" (the default), where each point is the current
+	// value, or "counter", where each point is an increment and the
+	// target is for the running total.
+	Type string `json:"type,omitempty"`
+	// Model is the name of the forecaster used for the goal. Empty means
+	// the deployment's default.
+	Model string `json:"model,omitempty"`
+}
+
+// GoalBatch is the result of a batch goal read.
+type GoalBatch struct {
+	Goals    map[string]Goal `json:"goals"`
+	NotFound []string        `json:"not_found"`
 }
 
 const (
@@ -43,14 +64,14 @@ const (
 	OpGoalUpdate = "goal_update"
 )
 
-func (c *ServiceClient) CreateGoal(goal Goal) error {
+func (c *ServiceClient) CreateGoal(ctx context.Context, goal Goal) error {
 	marshaled, err := json.Marshal(goal)
 	if err != nil {
 		return err
 	}
 
 	payload := rig.Operation{Method: OpGoalCreate, Data: marshaled}
-	err = c.client.doRequest("POST", "/do?ignore-version=true", &payload, nil)
+	err = c.client.doRequest(ctx, "POST", "/do?ignore-version=true", &payload, nil)
 	if err != nil {
 		return err
 	}
@@ -58,14 +79,14 @@ func (c *ServiceClient) CreateGoal(goal Goal) error {
 	return nil
 }
 
-func (c *ServiceClient) UpdateGoal(goal Goal) error {
+func (c *ServiceClient) UpdateGoal(ctx context.Context, goal Goal) error {
 	marshaled, err := json.Marshal(goal)
 	if err != nil {
 		return err
 	}
 
 	payload := rig.Operation{Method: OpGoalUpdate, Data: marshaled}
-	err = c.client.doRequest("POST", "/do?ignore-version=true", &payload, nil)
+	err = c.client.doRequest(ctx, "POST", "/do?ignore-version=true", &payload, nil)
 	if err != nil {
 		return err
 	}
@@ -73,14 +94,28 @@ func (c *ServiceClient) UpdateGoal(goal Goal) error {
 	return nil
 }
 
-func (c *ServiceClient) GetGoal(id string) (Goal, error) {
+func (c *ServiceClient) GetGoal(ctx context.Context, id string) (Goal, error) {
 	goal := Goal{}
 	resp := middleware.APIResponse{
 		Data: &goal,
 	}
-	err := c.client.doRequest("GET", fmt.Sprintf("/goals/%s", id), nil, &resp)
+	err := c.client.doRequest(ctx, "GET", fmt.Sprintf("/goals/%s", id), nil, &resp)
 	if err != nil {
 		return goal, err
 	}
 	return goal, nil
 }
+
+// GetGoals returns the goals with the given IDs in a single request.
+// IDs that don't exist are listed in GoalBatch.NotFound.
+func (c *ServiceClient) GetGoals(ctx context.Context, ids []string) (GoalBatch, error) {
+	batch := GoalBatch{}
+	resp := middleware.APIResponse{
+		Data: &batch,
+	}
+	err := c.client.doReadRequest(ctx, "POST", "/goals:batchGet", &BatchGetRequest{IDs: ids}, &resp)
+	if err != nil {
+		return batch, err
+	}
+	return batch, nil
+}
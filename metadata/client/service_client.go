@@ -17,6 +17,14 @@ package client
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Preetam/transverse/metadata/middleware"
+)
+
 type ServiceClient struct {
 	client *Client
 }
@@ -26,3 +34,76 @@ func NewServiceClient(baseURI string, token string) *ServiceClient {
 		client: New(baseURI, token),
 	}
 }
+
+// SetMaxAttempts sets the maximum number of times a retryable request is
+// sent. 1 disables retries.
+func (c *ServiceClient) SetMaxAttempts(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.client.maxAttempts = n
+}
+
+// BatchGetRequest is the request body for the batch read endpoints.
+type BatchGetRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// DataVersion is the version of the last operation applied by the metadata
+// service. It increases with every write.
+type DataVersion struct {
+	Version uint64 `json:"version"`
+}
+
+// Changes lists the users and goals written after a version.
+type Changes struct {
+	// Version is the version the changes go up to.
+	Version uint64 `json:"version"`
+	// Complete is false if the service doesn't know every change since
+	// the requested version, so anything cached from before it is stale.
+	Complete bool     `json:"complete"`
+	Users    []string `json:"users"`
+	Goals    []string `json:"goals"`
+}
+
+// Snapshot is a snapshot of all metadata, in the format used by rig
+// snapshots.
+type Snapshot struct {
+	Version uint64 `json:"version"`
+	// Goals are the IDs of goals that haven't been deleted.
+	Goals []string        `json:"goals"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Snapshot returns a snapshot of all metadata.
+func (c *ServiceClient) Snapshot(ctx context.Context) (Snapshot, error) {
+	snapshot := Snapshot{}
+	resp := middleware.APIResponse{
+		Data: &snapshot,
+	}
+	err := c.client.doRequest(ctx, "GET", "/snapshot", nil, &resp)
+	return snapshot, err
+}
+
+// Version returns the current data version.
+func (c *ServiceClient) Version(ctx context.Context) (uint64, error) {
+	version := DataVersion{}
+	resp := middleware.APIResponse{
+		Data: &version,
+	}
+	err := c.client.doRequest(ctx, "GET", "/version", nil, &resp)
+	if err != nil {
+		return 0, err
+	}
+	return version.Version, nil
+}
+
+// Changes returns the users and goals written after version since.
+func (c *ServiceClient) Changes(ctx context.Context, since uint64) (Changes, error) {
+	changes := Changes{}
+	resp := middleware.APIResponse{
+		Data: &changes,
+	}
+	err := c.client.doRequest(ctx, "GET", fmt.Sprintf("/changes?since=%d", since), nil, &resp)
+	return changes, err
+}
@@ -18,6 +18,7 @@ package client
  */
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -42,16 +43,25 @@ type User struct {
 	Updated      int64  `json:"updated"`
 	Deleted      int64  `json:"deleted"`
 	LastEmail    int64  `json:"last_email"`
+	// TimeZone is an IANA time zone name like "America/Los_Angeles" used
+	// to find day boundaries. Users without one use UTC.
+	TimeZone string `json:"time_zone,omitempty"`
 }
 
-func (c *ServiceClient) CreateUser(user User) error {
+// UserBatch is the result of a batch user read.
+type UserBatch struct {
+	Users    map[string]User `json:"users"`
+	NotFound []string        `json:"not_found"`
+}
+
+func (c *ServiceClient) CreateUser(ctx context.Context, user User) error {
 	marshaled, err := json.Marshal(user)
 	if err != nil {
 		return err
 	}
 
 	payload := rig.Operation{Method: OpUserCreate, Data: marshaled}
-	err = c.client.doRequest("POST", "/do?ignore-version=true", &payload, nil)
+	err = c.client.doRequest(ctx, "POST", "/do?ignore-version=true", &payload, nil)
 	if err != nil {
 		return err
 	}
@@ -59,14 +69,14 @@ func (c *ServiceClient) CreateUser(user User) error {
 	return nil
 }
 
-func (c *ServiceClient) UpdateUser(user User) error {
+func (c *ServiceClient) UpdateUser(ctx context.Context, user User) error {
 	marshaled, err := json.Marshal(user)
 	if err != nil {
 		return err
 	}
 
 	payload := rig.Operation{Method: OpUserUpdate, Data: marshaled}
-	err = c.client.doRequest("POST", "/do?ignore-version=true", &payload, nil)
+	err = c.client.doRequest(ctx, "POST", "/do?ignore-version=true", &payload, nil)
 	if err != nil {
 		return err
 	}
@@ -74,13 +84,13 @@ func (c *ServiceClient) UpdateUser(user User) error {
 	return nil
 }
 
-func (c *ServiceClient) DeleteUser(user User) error {
+func (c *ServiceClient) DeleteUser(ctx context.Context, user User) error {
 	marshaled, err := json.Marshal(user)
 	if err != nil {
 		return err
 	}
 	payload := rig.Operation{Method: OpUserDelete, Data: marshaled}
-	err = c.client.doRequest("POST", "/do?ignore-version=true", &payload, nil)
+	err = c.client.doRequest(ctx, "POST", "/do?ignore-version=true", &payload, nil)
 	if err != nil {
 		return err
 	}
@@ -88,36 +98,53 @@ func (c *ServiceClient) DeleteUser(user User) error {
 	return nil
 }
 
-func (c *ServiceClient) GetUserByID(id string) (User, error) {
+func (c *ServiceClient) GetUserByID(ctx context.Context, id string) (User, error) {
 	user := User{}
 	resp := middleware.APIResponse{
 		Data: &user,
 	}
-	err := c.client.doRequest("GET", fmt.Sprintf("/users/%s", id), nil, &resp)
+	err := c.client.doRequest(ctx, "GET", fmt.Sprintf("/users/%s", id), nil, &resp)
 	if err != nil {
 		return user, err
 	}
 	return user, nil
 }
 
-func (c *ServiceClient) GetUserByEmail(email string) (User, error) {
+// GetUsers returns the users with the given IDs in a single request.
+// IDs that don't exist are listed in UserBatch.NotFound.
+func (c *ServiceClient) GetUsers(ctx context.Context, ids []string) (UserBatch, error) {
+	batch := UserBatch{}
+	resp := middleware.APIResponse{
+		Data: &batch,
+	}
+	err := c.client.doReadRequest(ctx, "POST", "/users:batchGet", &BatchGetRequest{IDs: ids}, &resp)
+	if err != nil {
+		return batch, err
+	}
+	return batch, nil
+}
+
+func (c *ServiceClient) GetUserByEmail(ctx context.Context, email string) (User, error) {
 	user := User{}
 	resp := middleware.APIResponse{
 		Data: &user,
 	}
-	err := c.client.doRequest("GET", fmt.Sprintf("/users?email=%s", url.QueryEscape(email)), nil, &resp)
+	err := c.client.doRequest(ctx, "GET", fmt.Sprintf("/users?email=%s", url.QueryEscape(email)), nil, &resp)
 	if err != nil {
 		return user, err
 	}
 	return user, nil
 }
 
-func (c *ServiceClient) GetUserGoals(userID string, archived bool) (map[string]Goal, error) {
+// GetUserGoals returns a user's goals keyed by ID in a single request.
+// Deleted goals are left out, and so are archived ones unless archived is
+// set. Use GetGoals to read goals by ID instead.
+func (c *ServiceClient) GetUserGoals(ctx context.Context, userID string, archived bool) (map[string]Goal, error) {
 	goals := map[string]Goal{}
 	resp := middleware.APIResponse{
 		Data: &goals,
 	}
-	err := c.client.doRequest("GET", fmt.Sprintf("/users/%s/goals?showArchived=%v", userID, archived), nil, &resp)
+	err := c.client.doRequest(ctx, "GET", fmt.Sprintf("/users/%s/goals?showArchived=%v", userID, archived), nil, &resp)
 	if err != nil {
 		return nil, err
 	}
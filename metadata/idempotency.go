@@ -0,0 +1,92 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"sync"
+)
+
+// maxIdempotencyKeys is the number of write results remembered
+// for retried requests.
+const maxIdempotencyKeys = 10000
+
+// idempotentResult is the result of a write with an idempotency key.
+type idempotentResult struct {
+	// done is closed once the write completes.
+	done          chan struct{}
+	statusCode    int
+	responseError string
+	// retry is set if the write was rejected before it was applied, so
+	// a retry should apply it again.
+	retry bool
+}
+
+// idempotencyCache remembers the results of recent writes that had an
+// Idempotency-Key header so a retried write is only applied once.
+type idempotencyCache struct {
+	lock    sync.Mutex
+	results map[string]*idempotentResult
+	// order holds keys from oldest to newest for eviction.
+	order []string
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		results: map[string]*idempotentResult{},
+	}
+}
+
+// start returns the result for key. If the returned bool is true, the key
+// is new and the caller must apply the write and call finish. Otherwise
+// the caller should wait on result.done and reuse the result.
+func (c *idempotencyCache) start(key string) (*idempotentResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	existing, ok := c.results[key]
+	if ok && !existing.retry {
+		return existing, false
+	}
+
+	result := &idempotentResult{
+		done: make(chan struct{}),
+	}
+	c.results[key] = result
+	if ok {
+		// Retrying a rejected write. The key is already in order.
+		return result, true
+	}
+	c.order = append(c.order, key)
+	for len(c.order) > maxIdempotencyKeys {
+		delete(c.results, c.order[0])
+		c.order = c.order[1:]
+	}
+	return result, true
+}
+
+// finish records the result of a write started with start. Writes that
+// were applied keep their result whatever the status, since applying them
+// again would apply them twice.
+func (c *idempotencyCache) finish(result *idempotentResult, statusCode int, responseError string, applied bool) {
+	c.lock.Lock()
+	result.statusCode = statusCode
+	result.responseError = responseError
+	result.retry = !applied
+	c.lock.Unlock()
+	close(result.done)
+}
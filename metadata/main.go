@@ -21,10 +21,14 @@ package main
 import (
 	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Preetam/lm2"
 	"github.com/Preetam/rig"
+	"github.com/Preetam/transverse/internal/trace"
 	"github.com/Preetam/transverse/metadata/middleware"
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
@@ -46,9 +50,56 @@ func main() {
 	s3Region := flag.String("s3-region", "nyc3", "S3 region")
 	s3Endpoint := flag.String("s3-endpoint", "https://nyc3.digitaloceanspaces.com", "S3 endpoint")
 	flag.StringVar(&middleware.Token, "token", middleware.Token, "Auth token")
+	tokenFile := flag.String("token-file", "", "Path to a JSON file of named, scoped auth tokens. Reloaded on SIGHUP.")
+	traceFile := flag.String("trace-file", "", "Append OTLP JSON trace spans to this file")
+	traceEndpoint := flag.String("trace-endpoint", "", "OTLP/HTTP endpoint for trace spans, e.g. http://localhost:4318/v1/traces")
+	restore := flag.String("restore", "", "Restore metadata from this backup archive into a fresh data directory and rig object store, then exit")
 	flag.Parse()
 
+	traceExporter, err := trace.NewExporter(*traceFile, *traceEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if traceExporter != nil {
+		trace.Start("transverse-metadata", traceExporter)
+	}
+
+	if *tokenFile != "" {
+		err := middleware.LoadTokenFile(*tokenFile)
+		if err != nil {
+			log.Fatal("couldn't load token file:", err)
+		}
+		go func() {
+			sighup := make(chan os.Signal, 1)
+			signal.Notify(sighup, syscall.SIGHUP)
+			for range sighup {
+				err := middleware.LoadTokenFile(*tokenFile)
+				if err != nil {
+					log.Warnln("error reloading token file:", err)
+				} else {
+					log.Infoln("reloaded token file", *tokenFile)
+				}
+			}
+		}()
+	}
+
 	s3Service := s3.New(session.New(aws.NewConfig().WithRegion(*s3Region).WithEndpoint(*s3Endpoint).WithCredentials(credentials.NewStaticCredentials(*s3Key, *s3Secret, ""))))
+	var objectStore rig.ObjectStore
+	if *s3Key == "" {
+		objectStore = rig.NewFileObjectStore(*dataDir)
+	} else {
+		objectStore = rig.NewS3ObjectStore(s3Service, "transverse-rig")
+	}
+
+	if *restore != "" {
+		version, err := restoreBackup(*dataDir, objectStore, *restore)
+		if err != nil {
+			log.Fatal("couldn't restore backup:", err)
+		}
+		log.Infoln("restored version", version, "from", *restore)
+		return
+	}
+
 	MetadataService, err := OpenMetadataService(*dataDir)
 	if err != nil {
 		if err == lm2.ErrDoesNotExist {
@@ -61,12 +112,6 @@ func main() {
 		}
 	}
 
-	var objectStore rig.ObjectStore
-	if *s3Key == "" {
-		objectStore = rig.NewFileObjectStore(*dataDir)
-	} else {
-		objectStore = rig.NewS3ObjectStore(s3Service, "transverse-rig")
-	}
 	riggedService, err := rig.NewRiggedService(MetadataService, objectStore, "rig")
 	if err != nil {
 		log.Fatal(err)
@@ -18,13 +18,16 @@ package middleware
  */
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"time"
 
 	"github.com/Preetam/siesta"
+	"github.com/Preetam/transverse/internal/trace"
 	log "github.com/Sirupsen/logrus"
 )
 
@@ -40,6 +43,12 @@ const (
 	RequestDataKey   = "request-data"
 )
 
+// RequestIDHeader carries the request ID between services.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the longest request ID adopted from a caller.
+const maxRequestIDLength = 64
+
 type RequestData struct {
 	RequestID     string
 	StatusCode    int
@@ -47,6 +56,23 @@ type RequestData struct {
 	ResponseError string
 	Response      interface{}
 	Start         time.Time
+	// Token is the service token used to authenticate the request.
+	// It's nil if authentication is disabled.
+	Token *ServiceToken
+	// Span is the server span for the request.
+	Span *trace.Span
+	// RawResponse, if set, writes the response body instead of the JSON
+	// envelope, for downloads. Handlers that set it also set the
+	// Content-Type header.
+	RawResponse func(w io.Writer) error
+}
+
+// TokenName returns the name of the token used for the request.
+func (d *RequestData) TokenName() string {
+	if d.Token == nil {
+		return ""
+	}
+	return d.Token.Name
 }
 
 type APIResponse struct {
@@ -54,13 +80,76 @@ type APIResponse struct {
 	Error string      `json:"error,omitempty"`
 }
 
+type requestIDContextKey struct{}
+
+// WithRequestID returns a context carrying a request ID. The metadata
+// client sends it with every request so both services log the same ID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID in ctx, if any.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// validRequestID returns true if a request ID sent by a caller is safe
+// to adopt and log.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIdentifier assigns a request ID and starts the request's server
+// span. It adopts the caller's request ID and traceparent headers, so it's
+// only for services that trusted callers reach, like the metadata service.
 func RequestIdentifier(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	identifyRequest(c, r, true)
+}
+
+// PublicRequestIdentifier is RequestIdentifier for services anyone can
+// reach. It ignores the caller's request ID and traceparent, so every
+// request gets a new ID and starts a new trace that callers can't link to
+// others.
+func PublicRequestIdentifier(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	identifyRequest(c, r, false)
+}
+
+func identifyRequest(c siesta.Context, r *http.Request, trustHeaders bool) {
+	requestID := r.Header.Get(RequestIDHeader)
+	if !trustHeaders || !validRequestID(requestID) {
+		requestID = fmt.Sprintf("%08x", rand.Intn(0xffffffff))
+	}
+
+	ctx := r.Context()
+	if trustHeaders {
+		ctx = trace.ContextWithTraceparent(ctx, r.Header.Get(trace.TraceparentHeader))
+	}
+	ctx, span := trace.StartSpan(ctx, r.Method+" "+r.URL.Path, trace.KindServer)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.String())
+	span.SetAttribute("request_id", requestID)
+
+	// Handlers reach the request ID and span through r.Context(), so
+	// anything they pass it to is tied to this request.
+	*r = *r.WithContext(WithRequestID(ctx, requestID))
+
 	requestData := &RequestData{
-		RequestID: fmt.Sprintf("%08x", rand.Intn(0xffffffff)),
+		RequestID: requestID,
 		Start:     time.Now(),
+		Span:      span,
 	}
 	log.
 		WithField("request_id", requestData.RequestID).
+		WithField("trace_id", span.TraceID).
 		WithField("method", r.Method).
 		WithField("url", r.URL.String()).
 		Printf("[Req %s] %s %s", requestData.RequestID, r.Method, r.URL)
@@ -85,24 +174,39 @@ func ResponseGenerator(c siesta.Context, w http.ResponseWriter, r *http.Request)
 func ResponseWriter(c siesta.Context, w http.ResponseWriter, r *http.Request, q func()) {
 	requestData := c.Get(RequestDataKey).(*RequestData)
 	if requestData.RequestID != "" {
-		w.Header().Set("X-Request-Id", requestData.RequestID)
+		w.Header().Set(RequestIDHeader, requestData.RequestID)
 	}
-	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Metadata-Version", VersionStr)
 
-	enc := json.NewEncoder(w)
-
 	if requestData.StatusCode == 0 {
 		requestData.StatusCode = 200
 	}
-	w.WriteHeader(requestData.StatusCode)
-
-	response := c.Get(ResponseKey)
-	if response != nil {
-		enc.Encode(response)
+	if requestData.RawResponse != nil && requestData.StatusCode == 200 {
+		w.WriteHeader(requestData.StatusCode)
+		err := requestData.RawResponse(w)
+		if err != nil {
+			// Too late to change the status code.
+			log.WithField("request_id", requestData.RequestID).Warnln("error writing response:", err)
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Del("Content-Disposition")
+		w.WriteHeader(requestData.StatusCode)
+		response := c.Get(ResponseKey)
+		if response != nil {
+			json.NewEncoder(w).Encode(response)
+		}
 	}
 	q()
 
+	if requestData.Span != nil {
+		requestData.Span.SetAttribute("http.status_code", requestData.StatusCode)
+		if requestData.StatusCode/100 == 5 {
+			requestData.Span.SetError(fmt.Errorf("status code %d: %s", requestData.StatusCode, requestData.ResponseError))
+		}
+		requestData.Span.Finish()
+	}
+
 	log.Printf("[Req %s] status code %d, latency %0.2f ms", requestData.RequestID, requestData.StatusCode,
 		time.Now().Sub(requestData.Start).Seconds()*1000)
 	log.
@@ -110,6 +214,7 @@ func ResponseWriter(c siesta.Context, w http.ResponseWriter, r *http.Request, q
 		WithField("method", r.Method).
 		WithField("url", r.URL.String()).
 		WithField("status", requestData.StatusCode).
+		WithField("token", requestData.TokenName()).
 		WithField("latency", time.Now().Sub(requestData.Start).Seconds()*1000).
 		Printf("[Req %s] status code %d, latency %0.2f ms", requestData.RequestID, requestData.StatusCode,
 			time.Now().Sub(requestData.Start).Seconds()*1000)
@@ -117,14 +222,16 @@ func ResponseWriter(c siesta.Context, w http.ResponseWriter, r *http.Request, q
 
 func CheckAuth(c siesta.Context, w http.ResponseWriter, r *http.Request, q func()) {
 	requestData := c.Get(RequestDataKey).(*RequestData)
-	if Token == "" {
+	if !authEnabled() {
 		// No token defined
 		return
 	}
-	if r.Header.Get("X-Api-Key") != Token {
+	token, ok := lookupToken(r.Header.Get("X-Api-Key"))
+	if !ok {
 		requestData.StatusCode = http.StatusUnauthorized
 		requestData.ResponseError = "invalid token"
 		q()
 		return
 	}
+	requestData.Token = token
 }
@@ -0,0 +1,60 @@
+package middleware
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Preetam/siesta"
+
+	"github.com/Preetam/transverse/internal/trace"
+)
+
+func TestRequestIdentifierHeaders(t *testing.T) {
+	const (
+		requestID = "abcdef12"
+		traceID   = "0123456789abcdef0123456789abcdef"
+	)
+
+	identify := func(f func(siesta.Context, http.ResponseWriter, *http.Request)) *RequestData {
+		r := httptest.NewRequest("GET", "/goals", nil)
+		r.Header.Set(RequestIDHeader, requestID)
+		r.Header.Set(trace.TraceparentHeader, "00-"+traceID+"-0123456789abcdef-01")
+		c := siesta.NewSiestaContext()
+		f(c, httptest.NewRecorder(), r)
+		return c.Get(RequestDataKey).(*RequestData)
+	}
+
+	trusted := identify(RequestIdentifier)
+	if trusted.RequestID != requestID {
+		t.Errorf("trusted request ID = %q, want %q", trusted.RequestID, requestID)
+	}
+	if trusted.Span.TraceID != traceID {
+		t.Errorf("trusted trace ID = %q, want %q", trusted.Span.TraceID, traceID)
+	}
+
+	public := identify(PublicRequestIdentifier)
+	if public.RequestID == requestID {
+		t.Errorf("public request ID adopted the header")
+	}
+	if public.Span.TraceID == traceID || public.Span.ParentSpanID != "" {
+		t.Errorf("public request continued the caller's trace: %+v", public.Span)
+	}
+}
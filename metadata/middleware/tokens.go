@@ -0,0 +1,158 @@
+package middleware
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	ScopeReadOnly  = "read-only"
+	ScopeReadWrite = "read-write"
+)
+
+// defaultTokenName is the name used in logs for the legacy
+// single Token.
+const defaultTokenName = "default"
+
+// ServiceToken is a named API token accepted by CheckAuth.
+type ServiceToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Scope string `json:"scope"`
+	// Methods optionally limits a read-write token to the listed
+	// operation methods. An empty list allows every method.
+	Methods []string `json:"methods,omitempty"`
+	// Snapshot allows reading a snapshot of all data, which includes
+	// every user's email address and password hash.
+	Snapshot bool `json:"snapshot,omitempty"`
+}
+
+// CanWrite returns true if the token may apply an operation with
+// the given method. A nil token means authentication is disabled,
+// so everything is allowed.
+func (t *ServiceToken) CanWrite(method string) bool {
+	if t == nil {
+		return true
+	}
+	if t.Scope != ScopeReadWrite {
+		return false
+	}
+	if len(t.Methods) == 0 {
+		return true
+	}
+	for _, m := range t.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSnapshot returns true if the token may read a snapshot of all
+// data. A nil token means authentication is disabled.
+func (t *ServiceToken) CanSnapshot() bool {
+	return t == nil || t.Snapshot
+}
+
+type tokenFile struct {
+	Tokens []ServiceToken `json:"tokens"`
+}
+
+var (
+	tokensLock sync.RWMutex
+	tokens     []ServiceToken
+)
+
+// LoadTokenFile reads named service tokens from the JSON file at path
+// and replaces the current set. The current set is left untouched
+// if the file is invalid.
+func LoadTokenFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	parsed := tokenFile{}
+	err = json.NewDecoder(f).Decode(&parsed)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for _, t := range parsed.Tokens {
+		if t.Name == "" {
+			return fmt.Errorf("token file %s: token with no name", path)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("token file %s: duplicate token name %q", path, t.Name)
+		}
+		names[t.Name] = true
+		if t.Token == "" {
+			return fmt.Errorf("token file %s: token %q is empty", path, t.Name)
+		}
+		if t.Scope != ScopeReadOnly && t.Scope != ScopeReadWrite {
+			return fmt.Errorf("token file %s: token %q has invalid scope %q", path, t.Name, t.Scope)
+		}
+		if t.Scope == ScopeReadOnly && len(t.Methods) > 0 {
+			return fmt.Errorf("token file %s: read-only token %q can't list methods", path, t.Name)
+		}
+	}
+
+	tokensLock.Lock()
+	tokens = parsed.Tokens
+	tokensLock.Unlock()
+	return nil
+}
+
+// authEnabled returns true if any token is configured.
+func authEnabled() bool {
+	tokensLock.RLock()
+	defer tokensLock.RUnlock()
+	return Token != "" || len(tokens) > 0
+}
+
+// lookupToken returns the service token matching key.
+func lookupToken(key string) (*ServiceToken, bool) {
+	if key == "" {
+		return nil, false
+	}
+	if Token != "" && subtle.ConstantTimeCompare([]byte(key), []byte(Token)) == 1 {
+		return &ServiceToken{
+			Name:     defaultTokenName,
+			Token:    Token,
+			Scope:    ScopeReadWrite,
+			Snapshot: true,
+		}, true
+	}
+
+	tokensLock.RLock()
+	defer tokensLock.RUnlock()
+	for i := range tokens {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(tokens[i].Token)) == 1 {
+			t := tokens[i]
+			return &t, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,115 @@
+package middleware
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTokenFile(t *testing.T, dir, contents string) string {
+	path := filepath.Join(dir, "tokens.json")
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTokenFile(t, dir, `{"tokens": [
+		{"name": "web", "token": "aaa", "scope": "read-write"},
+		{"name": "backup", "token": "bbb", "scope": "read-only"},
+		{"name": "verifier", "token": "ccc", "scope": "read-write", "methods": ["user_update"]}
+	]}`)
+	err = LoadTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web, ok := lookupToken("aaa")
+	if !ok || web.Name != "web" {
+		t.Fatalf("expected web token, got %v", web)
+	}
+	if !web.CanWrite("goal_create") {
+		t.Error("expected web token to be able to write")
+	}
+
+	backup, ok := lookupToken("bbb")
+	if !ok || backup.Name != "backup" {
+		t.Fatalf("expected backup token, got %v", backup)
+	}
+	if backup.CanWrite("goal_create") {
+		t.Error("expected backup token to be read-only")
+	}
+	if backup.CanSnapshot() || web.CanSnapshot() {
+		t.Error("expected tokens without snapshot set to not read snapshots")
+	}
+
+	verifier, _ := lookupToken("ccc")
+	if !verifier.CanWrite("user_update") || verifier.CanWrite("user_delete") {
+		t.Error("expected verifier token to be limited to user_update")
+	}
+
+	if _, ok := lookupToken("zzz"); ok {
+		t.Error("expected unknown token to be rejected")
+	}
+
+	// An invalid file doesn't replace the loaded tokens.
+	path = writeTokenFile(t, dir, `{"tokens": [{"name": "web", "token": "aaa", "scope": "admin"}]}`)
+	if err := LoadTokenFile(path); err == nil {
+		t.Error("expected invalid scope to be rejected")
+	}
+	if _, ok := lookupToken("bbb"); !ok {
+		t.Error("expected previous tokens to be kept")
+	}
+
+	// Rotation
+	path = writeTokenFile(t, dir, `{"tokens": [{"name": "web", "token": "ddd", "scope": "read-write"}]}`)
+	err = LoadTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lookupToken("aaa"); ok {
+		t.Error("expected rotated token to be rejected")
+	}
+	if _, ok := lookupToken("ddd"); !ok {
+		t.Error("expected new token to be accepted")
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	Token = "legacy"
+	defer func() { Token = "" }()
+
+	token, ok := lookupToken("legacy")
+	if !ok {
+		t.Fatal("expected legacy token to be accepted")
+	}
+	if token.Name != defaultTokenName || !token.CanWrite("user_delete") {
+		t.Errorf("expected legacy token to be read-write, got %v", token)
+	}
+}
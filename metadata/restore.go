@@ -0,0 +1,92 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Preetam/lm2"
+	"github.com/Preetam/rig"
+	"github.com/Preetam/transverse/internal/backup"
+)
+
+// restoreBackup loads the metadata snapshot in a backup archive into a new
+// collection in dataDir and writes it to the rig object store as the
+// latest snapshot, so the next start recovers it. Both dataDir and the rig
+// object store must be fresh.
+func restoreBackup(dataDir string, objectStore rig.ObjectStore, archivePath string) (uint64, error) {
+	if service, err := OpenMetadataService(dataDir); err != lm2.ErrDoesNotExist {
+		if err == nil {
+			service.col.Close()
+			return 0, errors.New("data directory already has data")
+		}
+		return 0, err
+	}
+	if latest, err := objectStore.GetObject("rig/LATEST"); err == nil {
+		latest.Close()
+		return 0, errors.New("rig object store already has a snapshot")
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var snapshot []byte
+	manifest, err := backup.Reader{
+		Metadata: func(r io.Reader) error {
+			snapshot, err = ioutil.ReadAll(r)
+			return err
+		},
+	}.Read(f)
+	if err != nil {
+		return 0, err
+	}
+	if snapshot == nil {
+		return 0, backup.ErrNoMetadata
+	}
+
+	service, err := NewMetadataService(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	defer service.col.Close()
+	err = service.Restore(manifest.MetadataVersion, bytes.NewReader(snapshot))
+	if err != nil {
+		return 0, err
+	}
+	version, err := service.Version()
+	if err != nil {
+		return 0, err
+	}
+	if version != manifest.MetadataVersion {
+		return 0, fmt.Errorf("restored version %d doesn't match archive version %d",
+			version, manifest.MetadataVersion)
+	}
+
+	riggedService, err := rig.NewRiggedService(service, objectStore, "rig")
+	if err != nil {
+		return 0, err
+	}
+	return version, riggedService.Snapshot()
+}
@@ -22,10 +22,12 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/Preetam/lm2"
@@ -38,8 +40,31 @@ import (
 
 var (
 	errNotFound = errors.New("lm2: not found")
+
+	errInvalidMethod    = errors.New("invalid method")
+	errGoalExists       = errors.New("goal exists")
+	errGoalDoesNotExist = errors.New("goal doesn't exist")
+	errUnknownUser      = errors.New("unknown user")
+	errUserExists       = errors.New("user exists")
+	errUserEmailExists  = errors.New("user email exists")
+	errUserDoesNotExist = errors.New("user doesn't exist")
+	errEmailTaken       = errors.New("another user has that email address")
 )
 
+// operationStatusCode returns the HTTP status code for an error
+// returned while applying an operation.
+func operationStatusCode(err error) int {
+	switch err {
+	case errInvalidMethod, errUnknownUser:
+		return http.StatusBadRequest
+	case errGoalDoesNotExist, errUserDoesNotExist:
+		return http.StatusNotFound
+	case errGoalExists, errUserExists, errUserEmailExists, errEmailTaken:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 const (
 	prefixUser      = "00:" // users
 	prefixUserEmail = "01:" // index for user.Email => user.ID
@@ -52,6 +77,13 @@ const (
 	tupleSeparator = "\x00\x00"
 )
 
+// operationApplier applies operations. It's a *rig.RiggedService, which
+// validates and applies operations with the MetadataService and then
+// waits for them to be durable.
+type operationApplier interface {
+	Apply(op rig.Operation, waitUntilDurable bool) error
+}
+
 type MetadataService struct {
 	// Main metadata collection
 	col  *lm2.Collection
@@ -59,7 +91,9 @@ type MetadataService struct {
 
 	dataDir string
 
-	riggedService *rig.RiggedService
+	riggedService operationApplier
+	idempotency   *idempotencyCache
+	changes       *changeLog
 }
 
 func NewMetadataService(dataDir string) (*MetadataService, error) {
@@ -80,8 +114,10 @@ func NewMetadataService(dataDir string) (*MetadataService, error) {
 		return nil, err
 	}
 	return &MetadataService{
-		col:     col,
-		dataDir: dataDir,
+		col:         col,
+		dataDir:     dataDir,
+		idempotency: newIdempotencyCache(),
+		changes:     newChangeLog(0),
 	}, nil
 }
 
@@ -91,14 +127,40 @@ func OpenMetadataService(dataDir string) (*MetadataService, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MetadataService{
-		col:     col,
-		dataDir: dataDir,
-	}, nil
+	s := &MetadataService{
+		col:         col,
+		dataDir:     dataDir,
+		idempotency: newIdempotencyCache(),
+	}
+	version, err := s.Version()
+	if err != nil {
+		col.Close()
+		return nil, err
+	}
+	s.changes = newChangeLog(version)
+	return s, nil
+}
+
+// rejectedError wraps errors returned to rig by Validate and Apply, so
+// apply can tell an operation that wasn't applied from one rig applied
+// but couldn't make durable in time.
+type rejectedError struct {
+	err error
+}
+
+func (e rejectedError) Error() string {
+	return e.err.Error()
 }
 
 func (s *MetadataService) Validate(o rig.Operation) error {
 	log.Println("Validate", o.Method, string(o.Data))
+	if err := s.validate(o); err != nil {
+		return rejectedError{err}
+	}
+	return nil
+}
+
+func (s *MetadataService) validate(o rig.Operation) error {
 	switch o.Method {
 	case client.OpUserCreate:
 		return s.CreateUserValidate(o.Data)
@@ -112,7 +174,7 @@ func (s *MetadataService) Validate(o rig.Operation) error {
 	case client.OpGoalUpdate:
 		return s.UpdateGoalValidate(o.Data)
 	}
-	return errors.New("invalid method")
+	return errInvalidMethod
 }
 
 func (s *MetadataService) LockResources(o rig.Operation) bool {
@@ -126,6 +188,14 @@ func (s *MetadataService) UnlockResources(o rig.Operation) {
 
 func (s *MetadataService) Apply(version uint64, o rig.Operation) error {
 	log.Println("Apply", version, o.Method, string(o.Data))
+	if err := s.applyOperation(version, o); err != nil {
+		return rejectedError{err}
+	}
+	s.changes.record(version, o)
+	return nil
+}
+
+func (s *MetadataService) applyOperation(version uint64, o rig.Operation) error {
 	switch o.Method {
 	case client.OpUserCreate:
 		return s.CreateUserApply(version, o.Data)
@@ -140,7 +210,7 @@ func (s *MetadataService) Apply(version uint64, o rig.Operation) error {
 		return s.UpdateGoalApply(version, o.Data)
 
 	}
-	return errors.New("invalid method")
+	return errInvalidMethod
 }
 
 func (s *MetadataService) Version() (uint64, error) {
@@ -198,7 +268,11 @@ func (s *MetadataService) Restore(version uint64, r io.Reader) error {
 		wb.Set(kv.Key, kv.Value)
 	}
 	_, err = s.col.Update(wb)
-	return err
+	if err != nil {
+		return err
+	}
+	s.changes.reset(version)
+	return nil
 }
 
 func (s *MetadataService) Service() *siesta.Service {
@@ -219,25 +293,201 @@ func (s *MetadataService) Service() *siesta.Service {
 			return
 		}
 
-		err = s.riggedService.Apply(doPayload, true)
-		if err != nil {
-			requestData.ResponseError = err.Error()
-			requestData.StatusCode = http.StatusInternalServerError
+		if !requestData.Token.CanWrite(doPayload.Method) {
+			requestData.ResponseError = "token not allowed to " + doPayload.Method
+			requestData.StatusCode = http.StatusForbidden
+			return
+		}
+
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			s.apply(requestData, doPayload)
 			return
 		}
+
+		// Keys are only unique per caller.
+		key = requestData.TokenName() + ":" + key
+		result, isNew := s.idempotency.start(key)
+		if !isNew {
+			<-result.done
+			requestData.StatusCode = result.statusCode
+			requestData.ResponseError = result.responseError
+			return
+		}
+		applied := s.apply(requestData, doPayload)
+		s.idempotency.finish(result, requestData.StatusCode, requestData.ResponseError, applied)
 	})
 
 	// Read endpoints
 
+	MetadataService.Route("GET", "/version", "Gets the current data version", s.GetVersion)
+	MetadataService.Route("GET", "/changes", "Gets the users and goals changed since a version", s.GetChanges)
+	MetadataService.Route("GET", "/snapshot", "Gets a snapshot of all data", s.GetSnapshot)
+
 	MetadataService.Route("GET", "/goals/:id", "Gets a goal by ID", s.GetGoal)
 
 	MetadataService.Route("GET", "/users/:id", "Gets a user by ID", s.GetUserByID)
 	MetadataService.Route("GET", "/users/:id/goals", "Gets a user's goals", s.GetUserGoals)
 	MetadataService.Route("GET", "/users", "Searches for a user", s.GetUsers)
 
+	// Batch read endpoints. These are POSTs so the ID list can go in the body.
+	MetadataService.Route("POST", "/goals:action", "Gets goals by ID (:batchGet)",
+		customMethod("batchGet", s.BatchGetGoals))
+	MetadataService.Route("POST", "/users:action", "Gets users by ID (:batchGet)",
+		customMethod("batchGet", s.BatchGetUsers))
+
 	return MetadataService
 }
 
+// GetVersion returns the version of the last applied operation. Clients use
+// it to tell whether data they've cached is still current.
+func (s *MetadataService) GetVersion(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+
+	version, err := s.Version()
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+	requestData.ResponseData = client.DataVersion{Version: version}
+}
+
+// GetChanges returns the users and goals changed after the version in the
+// "since" parameter, so clients can drop what they've cached for them.
+func (s *MetadataService) GetChanges(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+
+	var params siesta.Params
+	since := params.Uint64("since", 0, "Version to return changes after")
+	err := params.Parse(r.Form)
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+
+	// The version is read first so no change up to it can be missed.
+	version, err := s.Version()
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+	requestData.ResponseData = s.changes.since(*since, version)
+}
+
+// GetSnapshot returns a snapshot of all data, for backups. The version and
+// the live goal IDs are read from the snapshot itself so they're consistent
+// with it. The snapshot includes password hashes, so only tokens allowed to
+// take snapshots can read it.
+func (s *MetadataService) GetSnapshot(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+
+	if !requestData.Token.CanSnapshot() {
+		requestData.ResponseError = "token not allowed to read snapshots"
+		requestData.StatusCode = http.StatusForbidden
+		return
+	}
+
+	snapshot, _, err := s.Snapshot()
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+	data, err := ioutil.ReadAll(snapshot)
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+	pairs := []kvPair{}
+	err = json.Unmarshal(data, &pairs)
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+
+	result := client.Snapshot{
+		Goals: []string{},
+		Data:  json.RawMessage(data),
+	}
+	for _, kv := range pairs {
+		switch {
+		case kv.Key == prefixMetadata+"version":
+			result.Version, err = strconv.ParseUint(kv.Value, 10, 64)
+			if err != nil {
+				requestData.ResponseError = err.Error()
+				requestData.StatusCode = http.StatusInternalServerError
+				return
+			}
+		case strings.HasPrefix(kv.Key, prefixGoal):
+			goal := client.Goal{}
+			err = json.Unmarshal([]byte(kv.Value), &goal)
+			if err != nil {
+				requestData.ResponseError = err.Error()
+				requestData.StatusCode = http.StatusInternalServerError
+				return
+			}
+			if goal.Deleted == 0 {
+				result.Goals = append(result.Goals, goal.ID)
+			}
+		}
+	}
+	requestData.ResponseData = result
+}
+
+// maxBatchGetIDs is the maximum number of IDs allowed in a batch read.
+const maxBatchGetIDs = 1000
+
+// customMethod returns a handler for a "/collection:method" route. siesta
+// treats everything after the collection name as the "action" parameter,
+// so this checks that it matches the expected method.
+func customMethod(method string, handler func(siesta.Context, http.ResponseWriter, *http.Request)) func(siesta.Context, http.ResponseWriter, *http.Request) {
+	return func(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+		if r.Form.Get("action") != ":"+method {
+			requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+			requestData.StatusCode = http.StatusNotFound
+			return
+		}
+		handler(c, w, r)
+	}
+}
+
+func decodeBatchGetRequest(r *http.Request) ([]string, error) {
+	req := client.BatchGetRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.IDs) > maxBatchGetIDs {
+		return nil, errors.New("too many IDs")
+	}
+	return req.IDs, nil
+}
+
+// apply applies an operation and sets the response status. It returns
+// false if the operation was rejected without being applied. An operation
+// that was applied but not made durable before rig timed out is still
+// applied, and fails with a 500.
+func (s *MetadataService) apply(requestData *middleware.RequestData, op rig.Operation) bool {
+	err := s.riggedService.Apply(op, true)
+	if rejected, ok := err.(rejectedError); ok {
+		requestData.ResponseError = rejected.err.Error()
+		requestData.StatusCode = operationStatusCode(rejected.err)
+		return false
+	}
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusInternalServerError
+		return true
+	}
+	requestData.StatusCode = http.StatusOK
+	return true
+}
+
 func cursorGet(cur *lm2.Cursor, key string) (string, error) {
 	cur.Seek(key)
 	for cur.Next() {
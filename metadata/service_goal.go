@@ -19,7 +19,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
 	"strconv"
 
@@ -49,7 +48,7 @@ func (s *MetadataService) CreateGoalValidate(data []byte) error {
 	_, err = cursorGet(cur, prefixGoal+goal.ID)
 	if err != errNotFound {
 		if err == nil {
-			return errors.New("goal exists")
+			return errGoalExists
 		}
 		return err
 	}
@@ -57,7 +56,7 @@ func (s *MetadataService) CreateGoalValidate(data []byte) error {
 	// Make sure the user exists
 	_, err = cursorGet(cur, prefixUser+goal.User)
 	if err == errNotFound {
-		return errors.New("unknown user")
+		return errUnknownUser
 	} else if err != nil {
 		return err
 	}
@@ -125,7 +124,7 @@ func (s *MetadataService) UpdateGoalValidate(data []byte) error {
 
 	_, err = cursorGet(cur, prefixGoal+goal.ID)
 	if err == errNotFound {
-		return errors.New("goal doesn't exist")
+		return errGoalDoesNotExist
 	} else if err != nil {
 		return err
 	}
@@ -133,7 +132,7 @@ func (s *MetadataService) UpdateGoalValidate(data []byte) error {
 	// Make sure the user exists
 	_, err = cursorGet(cur, prefixUser+goal.User)
 	if err == errNotFound {
-		return errors.New("unknown user")
+		return errUnknownUser
 	}
 
 	return nil
@@ -221,3 +220,50 @@ func (s *MetadataService) GetGoal(c siesta.Context, w http.ResponseWriter, r *ht
 
 	requestData.ResponseData = goal
 }
+
+// BatchGetGoals returns the goals with the given IDs using a single cursor.
+func (s *MetadataService) BatchGetGoals(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+
+	ids, err := decodeBatchGetRequest(r)
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+
+	cur, err := s.col.NewCursor()
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+
+	batch := client.GoalBatch{
+		Goals:    map[string]client.Goal{},
+		NotFound: []string{},
+	}
+	for _, id := range ids {
+		goalStr, err := cursorGet(cur, prefixGoal+id)
+		if err != nil {
+			if err == errNotFound {
+				batch.NotFound = append(batch.NotFound, id)
+				continue
+			}
+			requestData.ResponseError = err.Error()
+			requestData.StatusCode = http.StatusInternalServerError
+			return
+		}
+
+		goal := client.Goal{}
+		err = json.Unmarshal([]byte(goalStr), &goal)
+		if err != nil {
+			requestData.ResponseError = err.Error()
+			requestData.StatusCode = http.StatusInternalServerError
+			return
+		}
+		batch.Goals[id] = goal
+	}
+
+	requestData.ResponseData = batch
+}
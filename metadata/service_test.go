@@ -0,0 +1,348 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/Preetam/rig"
+	"github.com/Preetam/transverse/metadata/client"
+	"github.com/Preetam/transverse/metadata/middleware"
+)
+
+// testApplier validates and applies operations with a MetadataService like
+// rig does, without a log.
+type testApplier struct {
+	service *MetadataService
+
+	lock    sync.Mutex
+	version uint64
+	applied int
+	// timeout makes Apply fail after applying an operation, like rig does
+	// when the operation isn't durable in time.
+	timeout bool
+	// reject is returned, like an error from Validate, by the next Apply.
+	reject error
+}
+
+func (a *testApplier) Apply(op rig.Operation, waitUntilDurable bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.reject != nil {
+		err := a.reject
+		a.reject = nil
+		return rejectedError{err}
+	}
+	err := a.service.Validate(op)
+	if err != nil {
+		return err
+	}
+	err = a.service.Apply(a.version+1, op)
+	if err != nil {
+		return err
+	}
+	a.version++
+	a.applied++
+	if a.timeout {
+		return errors.New("rig: timeout")
+	}
+	return nil
+}
+
+func (a *testApplier) appliedCount() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.applied
+}
+
+// newTestService returns a metadata service in a temporary directory and
+// a test server for it. The returned function cleans them up.
+func newTestService(t *testing.T) (*MetadataService, *testApplier, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewMetadataService(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	applier := &testApplier{service: s}
+	s.riggedService = applier
+	server := httptest.NewServer(s.Service())
+	return s, applier, server, func() {
+		server.Close()
+		s.col.Destroy()
+		os.RemoveAll(dir)
+	}
+}
+
+// postOperation posts an operation to /do and returns the status code.
+func postOperation(t *testing.T, url, key, method string, data interface{}) int {
+	marshaled, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(rig.Operation{Method: method, Data: marshaled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url+"/do", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestIdempotentTimeout(t *testing.T) {
+	_, applier, server, cleanup := newTestService(t)
+	defer cleanup()
+
+	// The user is created, but isn't durable before rig times out, so the
+	// response is a 500. A retry with the same key gets the same result
+	// instead of a 409 from creating the user again.
+	applier.timeout = true
+	user := client.User{ID: "user", Email: "user@example.com"}
+	for i := 0; i < 2; i++ {
+		if status := postOperation(t, server.URL, "create", client.OpUserCreate, user); status != http.StatusInternalServerError {
+			t.Errorf("attempt %d: expected status 500, got %d", i+1, status)
+		}
+	}
+	if n := applier.appliedCount(); n != 1 {
+		t.Errorf("expected the operation to be applied once, got %d", n)
+	}
+
+	// A write rejected before it's applied is applied by a retry.
+	applier.timeout = false
+	applier.reject = errors.New("disk full")
+	user = client.User{ID: "user2", Email: "user2@example.com"}
+	if status := postOperation(t, server.URL, "create2", client.OpUserCreate, user); status != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", status)
+	}
+	if status := postOperation(t, server.URL, "create2", client.OpUserCreate, user); status != http.StatusOK {
+		t.Errorf("expected the retry to succeed, got %d", status)
+	}
+	if n := applier.appliedCount(); n != 2 {
+		t.Errorf("expected 2 applied operations, got %d", n)
+	}
+
+	// Without a key, nothing is remembered.
+	if status := postOperation(t, server.URL, "", client.OpUserCreate, user); status != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", status)
+	}
+}
+
+// postBatchGet posts a batch read to path and decodes the response data
+// into batch. It returns the status code.
+func postBatchGet(t *testing.T, url, path string, ids []string, batch interface{}) int {
+	body, err := json.Marshal(client.BatchGetRequest{IDs: ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&struct {
+			Data interface{} `json:"data"`
+		}{batch})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestBatchGet(t *testing.T) {
+	_, _, server, cleanup := newTestService(t)
+	defer cleanup()
+
+	for _, user := range []client.User{
+		{ID: "u1", Email: "u1@example.com"},
+		{ID: "u2", Email: "u2@example.com"},
+	} {
+		if status := postOperation(t, server.URL, "", client.OpUserCreate, user); status != http.StatusOK {
+			t.Fatalf("creating user %s: got status %d", user.ID, status)
+		}
+	}
+	for _, goal := range []client.Goal{
+		{ID: "g1", User: "u1", Name: "one"},
+		{ID: "g2", User: "u2", Name: "two"},
+	} {
+		if status := postOperation(t, server.URL, "", client.OpGoalCreate, goal); status != http.StatusOK {
+			t.Fatalf("creating goal %s: got status %d", goal.ID, status)
+		}
+	}
+
+	goals := client.GoalBatch{}
+	if status := postBatchGet(t, server.URL, "/goals:batchGet", []string{"g1", "missing", "g2"}, &goals); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if len(goals.Goals) != 2 || goals.Goals["g1"].Name != "one" || goals.Goals["g2"].Name != "two" {
+		t.Errorf("unexpected goals %v", goals.Goals)
+	}
+	if len(goals.NotFound) != 1 || goals.NotFound[0] != "missing" {
+		t.Errorf("expected missing to be not found, got %v", goals.NotFound)
+	}
+
+	users := client.UserBatch{}
+	if status := postBatchGet(t, server.URL, "/users:batchGet", []string{"u2", "missing"}, &users); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if len(users.Users) != 1 || users.Users["u2"].Email != "u2@example.com" {
+		t.Errorf("unexpected users %v", users.Users)
+	}
+	if len(users.NotFound) != 1 || users.NotFound[0] != "missing" {
+		t.Errorf("expected missing to be not found, got %v", users.NotFound)
+	}
+
+	// Too many IDs.
+	ids := make([]string, maxBatchGetIDs+1)
+	for i := range ids {
+		ids[i] = "g1"
+	}
+	for _, path := range []string{"/goals:batchGet", "/users:batchGet"} {
+		if status := postBatchGet(t, server.URL, path, ids, nil); status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400 for %d IDs, got %d", path, len(ids), status)
+		}
+		if status := postBatchGet(t, server.URL, path, ids[:maxBatchGetIDs], nil); status != http.StatusOK {
+			t.Errorf("%s: expected status 200 for %d IDs, got %d", path, maxBatchGetIDs, status)
+		}
+	}
+
+	// Other custom methods don't exist.
+	for _, path := range []string{"/goals:batchDelete", "/users:get", "/goals:"} {
+		if status := postBatchGet(t, server.URL, path, []string{"g1"}, nil); status != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, status)
+		}
+	}
+}
+
+func TestSnapshotPermission(t *testing.T) {
+	_, _, server, cleanup := newTestService(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+	err = ioutil.WriteFile(path, []byte(`{"tokens": [
+		{"name": "web", "token": "aaa", "scope": "read-write"},
+		{"name": "reader", "token": "bbb", "scope": "read-only"},
+		{"name": "backup", "token": "ccc", "scope": "read-only", "snapshot": true}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := middleware.LoadTokenFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ioutil.WriteFile(path, []byte(`{"tokens": []}`), 0600)
+		middleware.LoadTokenFile(path)
+	}()
+
+	for key, expected := range map[string]int{
+		"aaa": http.StatusForbidden,
+		"bbb": http.StatusForbidden,
+		"ccc": http.StatusOK,
+		"":    http.StatusUnauthorized,
+	} {
+		req, err := http.NewRequest("GET", server.URL+"/snapshot", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Api-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("token %q: expected status %d, got %d", key, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	s, _, server, cleanup := newTestService(t)
+	defer cleanup()
+
+	getChanges := func(since uint64) client.Changes {
+		resp, err := http.Get(fmt.Sprintf("%s/changes?since=%d", server.URL, since))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		changes := client.Changes{}
+		err = json.NewDecoder(resp.Body).Decode(&struct {
+			Data *client.Changes `json:"data"`
+		}{&changes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+
+	postOperation(t, server.URL, "", client.OpUserCreate, client.User{ID: "u1", Email: "u1@example.com"})
+	postOperation(t, server.URL, "", client.OpGoalCreate, client.Goal{ID: "g1", User: "u1"})
+	postOperation(t, server.URL, "", client.OpGoalUpdate, client.Goal{ID: "g1", User: "u1", Name: "renamed"})
+
+	changes := getChanges(0)
+	if changes.Version != 3 || !changes.Complete ||
+		!reflect.DeepEqual(changes.Users, []string{"u1"}) || !reflect.DeepEqual(changes.Goals, []string{"g1", "g1"}) {
+		t.Errorf("unexpected changes since 0: %+v", changes)
+	}
+	changes = getChanges(2)
+	if !changes.Complete || len(changes.Users) != 0 || !reflect.DeepEqual(changes.Goals, []string{"g1"}) {
+		t.Errorf("unexpected changes since 2: %+v", changes)
+	}
+	changes = getChanges(3)
+	if !changes.Complete || len(changes.Users) != 0 || len(changes.Goals) != 0 {
+		t.Errorf("expected no changes since 3, got %+v", changes)
+	}
+
+	// Changes from before the log are unknown.
+	s.changes.reset(3)
+	if changes = getChanges(1); changes.Complete {
+		t.Errorf("expected incomplete changes after a reset, got %+v", changes)
+	}
+}
@@ -19,7 +19,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
 	"strconv"
 	"strings"
@@ -47,7 +46,7 @@ func (s *MetadataService) CreateUserValidate(data []byte) error {
 	_, err = cursorGet(cur, prefixUser+user.ID)
 	if err != errNotFound {
 		if err == nil {
-			return errors.New("user exists")
+			return errUserExists
 		}
 		return err
 	}
@@ -55,7 +54,7 @@ func (s *MetadataService) CreateUserValidate(data []byte) error {
 	_, err = cursorGet(cur, prefixUserEmail+user.Email)
 	if err != errNotFound {
 		if err == nil {
-			return errors.New("user email exists")
+			return errUserEmailExists
 		}
 		return err
 	}
@@ -120,7 +119,7 @@ func (s *MetadataService) DeleteUserValidate(data []byte) error {
 
 	_, err = cursorGet(cur, prefixUser+user.ID)
 	if err == errNotFound {
-		return errors.New("user doesn't exist")
+		return errUserDoesNotExist
 	} else if err != nil {
 		return err
 	}
@@ -133,7 +132,7 @@ func (s *MetadataService) DeleteUserValidate(data []byte) error {
 		// errNotFound is OK
 	} else {
 		if userID != user.ID {
-			return errors.New("another user has that email address")
+			return errEmailTaken
 		}
 	}
 
@@ -220,7 +219,7 @@ func (s *MetadataService) UpdateUserValidate(data []byte) error {
 
 	_, err = cursorGet(cur, prefixUser+user.ID)
 	if err == errNotFound {
-		return errors.New("user doesn't exist")
+		return errUserDoesNotExist
 	} else if err != nil {
 		return err
 	}
@@ -233,7 +232,7 @@ func (s *MetadataService) UpdateUserValidate(data []byte) error {
 		// errNotFound is OK
 	} else {
 		if userID != user.ID {
-			return errors.New("another user has that email address")
+			return errEmailTaken
 		}
 	}
 
@@ -458,3 +457,50 @@ func (s *MetadataService) GetUserGoals(c siesta.Context, w http.ResponseWriter,
 
 	requestData.ResponseData = goals
 }
+
+// BatchGetUsers returns the users with the given IDs using a single cursor.
+func (s *MetadataService) BatchGetUsers(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+
+	ids, err := decodeBatchGetRequest(r)
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+
+	cur, err := s.col.NewCursor()
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+
+	batch := client.UserBatch{
+		Users:    map[string]client.User{},
+		NotFound: []string{},
+	}
+	for _, id := range ids {
+		userStr, err := cursorGet(cur, prefixUser+id)
+		if err != nil {
+			if err == errNotFound {
+				batch.NotFound = append(batch.NotFound, id)
+				continue
+			}
+			requestData.ResponseError = err.Error()
+			requestData.StatusCode = http.StatusInternalServerError
+			return
+		}
+
+		user := client.User{}
+		err = json.Unmarshal([]byte(userStr), &user)
+		if err != nil {
+			requestData.ResponseError = err.Error()
+			requestData.StatusCode = http.StatusInternalServerError
+			return
+		}
+		batch.Users[id] = user
+	}
+
+	requestData.ResponseData = batch
+}
@@ -67,7 +67,7 @@ var SummaryTable = function(goal) {
       components.push(m("div", [
         m("span.tv-summary-label", "current rate:"),
         " ",
-        m("span.summary-text", goal.slope.toFixed(2) + " per day")
+        m("span.summary-text", goal.slope.toFixed(2) + " per " + Goal.unit(goal).replace(/s$/, ""))
       ]));
     }
 
@@ -75,7 +75,7 @@ var SummaryTable = function(goal) {
       components.push(m("div", [
         m("span.tv-summary-label", "eta:"),
         " ",
-        m("span.summary-text", "~" + goal.eta + " days " + "(" + moment().add(goal.eta, "days").format("LL") + ")")
+        m("span.summary-text", "~" + goal.eta + " " + Goal.unit(goal) + " (" + (goal.eta_date ? moment(goal.eta_date) : moment().add(goal.eta, Goal.unit(goal))).format("LL") + ")")
       ]));
     }
     return m("div.summary-table", [
@@ -246,7 +246,7 @@ var GoalAddDataPage = function(goal) {
         }
       }
       if (vnode.state.fieldContent != "") {
-        vnode.state.parsedEvents = parse.csv(vnode.state.fieldContent);
+        vnode.state.parsedEvents = parse.csv(vnode.state.fieldContent, Goal.toServerTime);
       }
     })
 
@@ -268,7 +268,7 @@ var GoalAddDataPage = function(goal) {
     var events = [];
     vnode.state.parsedEvents.forEach(function(e) {
       events.push(m("li", [
-        m("strong", (new Date(e.ts.getTime() + e.ts.getTimezoneOffset()*60*1000)).toDateString()),
+        m("strong", Goal.fromServerTime(e.ts).toDateString()),
         ": ",
         m("span", e.value)
       ]))
@@ -301,7 +301,7 @@ var GoalAddDataPage = function(goal) {
             vnode.state.fieldContent = this.value;
             if (this.value.length > 0) {
               try {
-                vnode.state.parsedEvents = parse.csv(this.value);
+                vnode.state.parsedEvents = parse.csv(this.value, Goal.toServerTime);
                 vnode.state.parsedOK = true;
               } catch(e) {
                 vnode.state.parsedOK = false;
@@ -131,6 +131,44 @@ var UpdateGoalForm = {
         m("div#form-goal-target-help", {class: "pure-form-message-inline"},
           "Set a target value. This has to be a number. If you want to make it \"473 pages\", just put \"473\".")
       ]),
+      m("div.pure-control-group", [
+        m("label", {for: "form-goal-type"}, "Type"),
+        m("select#form-goal-type", {
+          class: "form-control",
+          onchange: function(ev) {vnode.state.goal.type = ev.target.value},
+          value: vnode.state.goal.type || "level"
+        }, [
+          m("option", {value: "level"}, "level"),
+          m("option", {value: "counter"}, "counter")
+        ]),
+        m("div#form-goal-type-help", {class: "pure-form-message-inline"},
+          "Use counter if you log how much you did each time, like pages written. The target is for the total.")
+      ]),
+      m("div.pure-control-group", [
+        m("label", {for: "form-goal-resolution"}, "Resolution"),
+        m("select#form-goal-resolution", {
+          class: "form-control",
+          onchange: function(ev) {vnode.state.goal.resolution = ev.target.value},
+          value: vnode.state.goal.resolution || "daily"
+        }, ["hourly", "daily", "weekly", "monthly"].map(function(resolution) {
+          return m("option", {value: resolution}, resolution)
+        })),
+        m("div#form-goal-resolution-help", {class: "pure-form-message-inline"},
+          "Data points are grouped into one per hour, day, week or month.")
+      ]),
+      m("div.pure-control-group", [
+        m("label", {for: "form-goal-model"}, "Forecast model"),
+        m("select#form-goal-model", {
+          class: "form-control",
+          onchange: function(ev) {vnode.state.goal.model = ev.target.value},
+          value: vnode.state.goal.model
+        }, [
+          m("option", {value: ""}, "default"),
+          m("option", {value: "forecast1"}, "forecast1"),
+          m("option", {value: "forecast2"}, "forecast2"),
+          m("option", {value: "forecast3"}, "forecast3")
+        ])
+      ]),
       m("button", {style: {marginTop: "10px"}, class: "pure-button"}, "Update goal")
     ]))
   }
@@ -17,6 +17,31 @@
 
 var m = require("mithril")
 var req = require("./req")
+var User = require("./user")
+
+// shiftsTimes returns true if the user has no time zone. The server then
+// finds days in UTC, so local times are sent and shown shifted by the
+// browser's offset to keep the UTC date the same as the local date. Users
+// with a time zone get days in that zone and times aren't shifted.
+function shiftsTimes() {
+  var tz = User.get().time_zone;
+  return !tz || tz === "UTC";
+}
+
+function fromServerTime(ts) {
+  ts = new Date(ts);
+  if (!shiftsTimes()) {
+    return ts;
+  }
+  return new Date(ts.getTime() + ts.getTimezoneOffset()*60*1000);
+}
+
+function toServerTime(d) {
+  if (!shiftsTimes()) {
+    return d;
+  }
+  return new Date(d.getTime() - d.getTimezoneOffset()*60*1000);
+}
 
 var Goals = function(data) {
   var data = data || {};
@@ -44,6 +69,10 @@ var Goal = function(data) {
   this.created = data.created || 0;
   this.updated = data.updated || 0;
   this.deleted = data.deleted || 0;
+  this.duplicates = data.duplicates || "";
+  this.resolution = data.resolution || "";
+  this.type = data.type || "";
+  this.model = data.model || "";
 
   this.setName = function(v) {
     this.name = v;
@@ -72,9 +101,26 @@ Goal.get = function(goal) {
     goal.created = d.created;
     goal.updated = d.updated;
     goal.deleted = d.deleted;
+    goal.duplicates = d.duplicates || "";
+    goal.resolution = d.resolution || "";
+    goal.type = d.type || "";
+    goal.model = d.model || "";
   })
 }
 
+// resolutionUnits maps a goal's resolution to the unit of its ETA and
+// rate, in moment's names.
+Goal.resolutionUnits = {
+  hourly: "hours",
+  daily: "days",
+  weekly: "weeks",
+  monthly: "months"
+}
+
+Goal.unit = function(goal) {
+  return Goal.resolutionUnits[goal.resolution] || "days";
+}
+
 Goal.create = function(goal) {
   return req({
     method: "POST",
@@ -126,8 +172,7 @@ Goal.getData = function(goal) {
       return;
     }
     for (var i in d.series) {
-      d.series[i].ts = new Date(d.series[i].ts)
-      d.series[i].ts = new Date(d.series[i].ts.getTime() + d.series[i].ts.getTimezoneOffset()*60*1000)
+      d.series[i].ts = fromServerTime(d.series[i].ts)
       if (!goal.data_start || d.series[i].ts < goal.data_start) {
         goal.data_start = d.series[i].ts;
       }
@@ -151,8 +196,7 @@ Goal.getData = function(goal) {
       }
     }
     for (var i in d.prediction) {
-      d.prediction[i].ts = new Date(d.prediction[i].ts)
-      d.prediction[i].ts = new Date(d.prediction[i].ts.getTime() + d.prediction[i].ts.getTimezoneOffset()*60*1000)
+      d.prediction[i].ts = fromServerTime(d.prediction[i].ts)
 
       if (!goal.data_start || d.prediction[i].ts < goal.data_start) {
         goal.data_start = d.prediction[i].ts;
@@ -161,12 +205,10 @@ Goal.getData = function(goal) {
         goal.data_end = d.prediction[i].ts;
       }
       if (d.low[i]) {
-        d.low[i].ts = new Date(d.low[i].ts)
-        d.low[i].ts = new Date(d.low[i].ts.getTime() + d.low[i].ts.getTimezoneOffset()*60*1000)
+        d.low[i].ts = fromServerTime(d.low[i].ts)
       }
       if (d.high[i]) {
-        d.high[i].ts = new Date(d.high[i].ts)
-        d.high[i].ts = new Date(d.high[i].ts.getTime() + d.high[i].ts.getTimezoneOffset()*60*1000)
+        d.high[i].ts = fromServerTime(d.high[i].ts)
       }
     }
     if (d.prediction.length > 1) {
@@ -175,6 +217,7 @@ Goal.getData = function(goal) {
     if (d.eta) {
       if (d.eta > 0) {
         goal.eta = d.eta;
+        goal.eta_date = d.eta_date;
       }
     }
     goal.data = d;
@@ -200,8 +243,7 @@ Goal.getRawData = function(goal) {
   }).then(function(d) {
     var d = d.data;
     for (var i in d.series) {
-      d.series[i].ts = new Date(d.series[i].ts)
-      d.series[i].ts = new Date(d.series[i].ts.getTime() + d.series[i].ts.getTimezoneOffset()*60*1000)
+      d.series[i].ts = fromServerTime(d.series[i].ts)
     }
     goal.rawData = d;
   })
@@ -216,31 +258,30 @@ Goal.addData = function(goal, data) {
 }
 
 Goal.addDataAddPoint = function(goal, value) {
-  var now = new Date();
-  var normalized = new Date(now.getTime() - (now.getTimezoneOffset()*60*1000))
   return req({
     method: "POST",
     url: "/api/v1/goals/"+goal.id+"/data/single?add=true",
     body: {
       value: value,
-      date: normalized
+      date: toServerTime(new Date())
     }
   })
 }
 
 Goal.addDataSetPoint = function(goal, value) {
-  var now = new Date();
-  var normalized = new Date(now.getTime() - (now.getTimezoneOffset()*60*1000))
   return req({
     method: "POST",
     url: "/api/v1/goals/"+goal.id+"/data/single?add=false",
     body: {
       value: value,
-      date: normalized
+      date: toServerTime(new Date())
     }
   })
 }
 
+Goal.fromServerTime = fromServerTime;
+Goal.toServerTime = toServerTime;
+
 module.exports = {
   Goals: Goals,
   Goal: Goal,
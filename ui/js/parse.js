@@ -17,7 +17,9 @@
 
 var papaparse = require("papaparse")
 
-function parseCSV(str) {
+// parseCSV parses "date, value" lines. toServerTime converts parsed dates
+// to what the server expects.
+function parseCSV(str, toServerTime) {
   str = str.trim();
   var events = [];
 
@@ -31,14 +33,10 @@ function parseCSV(str) {
     throw "invalid";
   }
 
-  var now = new Date();
-  var normalized = new Date(now.getTime() - (now.getTimezoneOffset()*60*1000))
-
   for (var i in parsed.data) {
     var d = new Date(parsed.data[i][0]);
-    var normalized = new Date(d.getTime() - (d.getTimezoneOffset()*60*1000))
     var event = {
-      ts: normalized,
+      ts: toServerTime ? toServerTime(d) : d,
       value: parseFloat(parsed.data[i][1])
     }
     // Validate
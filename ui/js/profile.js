@@ -43,6 +43,26 @@ var ProfilePage = {
 
     vnode.state.newPassword = "";
 
+    // The browser's time zone is suggested until the user has one.
+    vnode.state.timeZone = vnode.state.user.time_zone ||
+      Intl.DateTimeFormat().resolvedOptions().timeZone || "";
+    vnode.state.submitTimeZone = (function() {
+      var state = this;
+      this.error = "";
+      this.updated = false;
+      User.updateTimeZone(this.timeZone).then(function() {
+        state.updated = true;
+      }).catch(function(e) {
+        state.updated = false;
+        if (e.status === 400) { // bad request
+          state.error = "Unknown time zone."
+        } else {
+          state.error = "Something went wrong."
+        }
+      });
+      return false;
+    }).bind(vnode.state);
+
     vnode.state.error = "";
     vnode.state.updated = false;
   },
@@ -74,6 +94,22 @@ var ProfilePage = {
           m("button", {style: {marginTop: "10px"}, class: "pure-button", onclick: vnode.state.submit}, "Update password")
         ]),
       ]),
+      m("form", {class: "pure-form pure-form-stacked", style: {width: "400px"}}, [
+        m("fieldset", [
+          m("label", {for: "time-zone"}, "Time zone"),
+          m("input",
+            {
+              type: "text",
+              oninput: function(ev) { vnode.state.timeZone = ev.target.value; },
+              name: "time-zone",
+              value: vnode.state.timeZone,
+              placeholder: "America/Los_Angeles"
+            }
+          ),
+          m("span", {class: "pure-form-message"}, "Days start at midnight in this time zone. Existing data isn't moved."),
+          m("button", {style: {marginTop: "10px"}, class: "pure-button", onclick: vnode.state.submitTimeZone}, "Update time zone")
+        ]),
+      ]),
       m("form", {
         class: "pure-form pure-form-stacked",
         style: {width: "400px"},
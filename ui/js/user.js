@@ -44,6 +44,14 @@ User.updatePassword = function(password) {
   })
 }
 
+User.updateTimeZone = function(timeZone) {
+  return req({
+    method: "PUT",
+    url: "/api/v1/user/time-zone",
+    data: timeZone
+  })
+}
+
 User.delete = function() {
   return req({
     method: "DELETE",
@@ -53,6 +61,9 @@ User.delete = function() {
 
 var user = new User();
 user.updatePassword = User.updatePassword;
+user.updateTimeZone = function(timeZone) {
+  return User.updateTimeZone(timeZone).then(user.refresh);
+};
 user.delete = User.delete;
 
 module.exports = user;
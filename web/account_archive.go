@@ -0,0 +1,344 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/Preetam/siesta"
+	"github.com/Preetam/transverse/metadata/client"
+	"github.com/Preetam/transverse/metadata/middleware"
+	"github.com/Preetam/transverse/metadata/token"
+	log "github.com/Sirupsen/logrus"
+)
+
+// An account archive is a zip file with:
+//
+//	manifest.json      an accountArchiveManifest
+//	user.json          the user, without the password hash
+//	goals/<id>.json    each goal
+//	goals/<id>.csv     each goal's data, as exported by ExportGoalData
+const (
+	accountArchiveFormat   = 1
+	accountArchiveManifest = "manifest.json"
+	accountArchiveUser     = "user.json"
+	// maxAccountArchiveBytes is the largest archive accepted for import.
+	maxAccountArchiveBytes = 50 << 20
+)
+
+type accountArchiveManifestData struct {
+	Format   int                       `json:"format"`
+	Exported time.Time                 `json:"exported"`
+	User     string                    `json:"user"`
+	Goals    []accountArchiveGoalEntry `json:"goals"`
+}
+
+type accountArchiveGoalEntry struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Goal   string `json:"goal"`
+	Data   string `json:"data"`
+	Points int    `json:"points"`
+}
+
+// importedGoal is the result of importing one goal from an archive.
+type importedGoal struct {
+	PreviousID string `json:"previous_id"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Points     int    `json:"points"`
+}
+
+// writeAccountArchive writes a user's archive. Deleted goals aren't
+// included. Dates are written in the user's time zone.
+func (api *API) writeAccountArchive(ctx context.Context, w io.Writer, user client.User, goals map[string]client.Goal) error {
+	user.PasswordHash = ""
+	manifest := accountArchiveManifestData{
+		Format:   accountArchiveFormat,
+		Exported: time.Now().UTC(),
+		User:     user.ID,
+		Goals:    []accountArchiveGoalEntry{},
+	}
+	opts := exportOptions{Format: exportFormats["csv"], Location: userLocation(user)}
+
+	zipWriter := zip.NewWriter(w)
+	writeFile := func(name string, data []byte) error {
+		f, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: manifest.Exported,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	writeJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeFile(name, data)
+	}
+
+	err := writeJSON(accountArchiveUser, user)
+	if err != nil {
+		return err
+	}
+	goalIDs := []string{}
+	for goalID, goal := range goals {
+		if goal.Deleted == 0 {
+			goalIDs = append(goalIDs, goalID)
+		}
+	}
+	sort.Strings(goalIDs)
+	for _, goalID := range goalIDs {
+		goal := goals[goalID]
+		points, err := api.series.Read(ctx, goalID, time.Time{}, time.Time{})
+		if err != nil && err != errDoesNotExist {
+			return err
+		}
+		sort.Sort(pointsByTime(points))
+		data := &bytes.Buffer{}
+		err = writeExport(data, exportRows(ctx, goal, opts.Location, points, false), opts)
+		if err != nil {
+			return err
+		}
+
+		entry := accountArchiveGoalEntry{
+			ID:     goalID,
+			Name:   goal.Name,
+			Goal:   path.Join("goals", goalID+".json"),
+			Data:   path.Join("goals", goalID+".csv"),
+			Points: len(points),
+		}
+		err = writeJSON(entry.Goal, goal)
+		if err == nil {
+			err = writeFile(entry.Data, data.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+		manifest.Goals = append(manifest.Goals, entry)
+	}
+	err = writeJSON(accountArchiveManifest, manifest)
+	if err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
+
+// archivedGoal is a goal read from an archive.
+type archivedGoal struct {
+	entry  accountArchiveGoalEntry
+	goal   client.Goal
+	points []goalDataPoint
+}
+
+// readAccountArchive reads and checks every goal in an archive. Dates
+// without a time zone and buckets are in loc.
+func readAccountArchive(data []byte, loc *time.Location) ([]archivedGoal, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zipReader.File {
+		files[f.Name] = f
+	}
+	readFile := func(name string) ([]byte, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("archive is missing %s", name)
+		}
+		reader, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(io.LimitReader(reader, maxAccountArchiveBytes))
+	}
+
+	manifestData, err := readFile(accountArchiveManifest)
+	if err != nil {
+		return nil, err
+	}
+	manifest := accountArchiveManifestData{}
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Format != accountArchiveFormat {
+		return nil, fmt.Errorf("unknown archive format %d", manifest.Format)
+	}
+
+	goals := []archivedGoal{}
+	for _, entry := range manifest.Goals {
+		goalData, err := readFile(entry.Goal)
+		if err != nil {
+			return nil, err
+		}
+		archived := archivedGoal{entry: entry}
+		err = json.Unmarshal(goalData, &archived.goal)
+		if err != nil {
+			return nil, fmt.Errorf("invalid goal %s: %v", entry.ID, err)
+		}
+		if archived.goal.Name == "" {
+			return nil, fmt.Errorf("goal %s has no name", entry.ID)
+		}
+		if !validDuplicatePolicy(archived.goal.Duplicates) {
+			return nil, fmt.Errorf("goal %s has an unknown duplicates policy", entry.ID)
+		}
+		if !validResolution(archived.goal.Resolution) {
+			return nil, fmt.Errorf("goal %s has an unknown resolution", entry.ID)
+		}
+		if !validGoalType(archived.goal.Type) {
+			return nil, fmt.Errorf("goal %s has an unknown type", entry.ID)
+		}
+		if !validForecastModel(archived.goal.Model) {
+			return nil, fmt.Errorf("goal %s has an unknown forecast model", entry.ID)
+		}
+		pointData, err := readFile(entry.Data)
+		if err != nil {
+			return nil, err
+		}
+		archived.points = []goalDataPoint{}
+		if len(bytes.TrimSpace(pointData)) > 0 {
+			imported, err := parseDelimitedGoalData(pointData, csvImportOptions{Delimiter: ',', Column: "value", Location: loc})
+			if err != nil {
+				return nil, fmt.Errorf("invalid data for goal %s: %v", entry.ID, err)
+			}
+			if len(imported.Errors) > 0 {
+				return nil, fmt.Errorf("invalid data for goal %s: row %d: %s",
+					entry.ID, imported.Errors[0].Row, imported.Errors[0].Error)
+			}
+			archived.points = normalizeGoalData(imported.Points, goalBucketing(archived.goal, loc), duplicatePolicy(archived.goal))
+		}
+		goals = append(goals, archived)
+	}
+	return goals, nil
+}
+
+// GetAccountArchive downloads a zip archive of the user's account, which
+// can be imported with PostAccountArchive.
+func (api *API) GetAccountArchive(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
+
+	user, err := MetadataClient.GetUserByID(r.Context(), userTokenData.User)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
+		}
+		return
+	}
+
+	goals, err := MetadataClient.GetUserGoals(r.Context(), user.ID, true)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
+		}
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = api.writeAccountArchive(r.Context(), buf, user, goals)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+
+	setAttachment(w, "application/zip", "transverse-account-"+time.Now().UTC().Format("2006-01-02")+".zip")
+	requestData.RawResponse = func(w io.Writer) error {
+		_, err := buf.WriteTo(w)
+		return err
+	}
+}
+
+// PostAccountArchive creates the goals in an account archive, with new IDs,
+// for the user. The whole archive is checked before anything is created.
+// If creating a goal fails, the goals created before it are kept and
+// listed in the response.
+func (api *API) PostAccountArchive(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAccountArchiveBytes+1))
+	if err == nil && len(data) > maxAccountArchiveBytes {
+		err = errors.New("archive too large")
+	}
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	archived, err := readAccountArchive(data, requestLocation(c))
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+
+	imported := []importedGoal{}
+	for _, a := range archived {
+		goal := a.goal
+		goal.ID = generateCode(8)
+		goal.User = userTokenData.User
+		goal.Updated = time.Now().Unix()
+		goal.Deleted = 0
+		if goal.Created == 0 {
+			goal.Created = goal.Updated
+		}
+
+		err = MetadataClient.CreateGoal(writeContext(r.Context()), goal)
+		if err == nil && len(a.points) > 0 {
+			err = api.series.Replace(r.Context(), goal.ID, a.points)
+		}
+		if err != nil {
+			log.Println(requestData.RequestID, err)
+			requestData.StatusCode = http.StatusInternalServerError
+			requestData.ResponseError = "error importing goal " + a.entry.ID
+			requestData.ResponseData = map[string]interface{}{"goals": imported}
+			return
+		}
+		imported = append(imported, importedGoal{
+			PreviousID: a.entry.ID,
+			ID:         goal.ID,
+			Name:       goal.Name,
+			Points:     len(a.points),
+		})
+	}
+	requestData.ResponseData = map[string]interface{}{"goals": imported}
+}
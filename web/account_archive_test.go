@@ -0,0 +1,91 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+func TestAccountArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	api := NewAPI(&fileObjectStore{basePath: dir})
+
+	points := []goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 1.5},
+		{Timestamp: day(2018, 1, 2).Add(time.Hour), Value: -2},
+	}
+	err = api.series.Replace(ctx, "withdata", points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goals := map[string]client.Goal{
+		"withdata": {ID: "withdata", Name: "Weight", Target: 70, Archived: true, Created: 100, Resolution: resolutionHourly},
+		"empty":    {ID: "empty", Name: "Steps", Target: 10000},
+		"deleted":  {ID: "deleted", Name: "Old", Deleted: 1},
+	}
+	user := client.User{ID: "user", Email: "user@example.com", PasswordHash: "secret"}
+
+	buf := &bytes.Buffer{}
+	err = api.writeAccountArchive(ctx, buf, user, goals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Error("archive contains the password hash")
+	}
+
+	archived, err := readAccountArchive(buf.Bytes(), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 2 {
+		t.Fatalf("expected 2 goals, got %d", len(archived))
+	}
+	// Goals are sorted by ID.
+	if archived[0].goal.Name != "Steps" || len(archived[0].points) != 0 {
+		t.Errorf("unexpected goal %+v", archived[0])
+	}
+	if archived[1].goal != goals["withdata"] {
+		t.Errorf("expected %+v, got %+v", goals["withdata"], archived[1].goal)
+	}
+	if !reflect.DeepEqual(archived[1].points, points) {
+		t.Errorf("expected %v, got %v", points, archived[1].points)
+	}
+
+	invalid := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(invalid)
+	zipWriter.Create("user.json")
+	zipWriter.Close()
+	if _, err := readAccountArchive(invalid.Bytes(), time.UTC); err == nil {
+		t.Error("expected an error for an archive without a manifest")
+	}
+}
@@ -18,16 +18,23 @@ package main
  */
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"math"
+	"mime"
 	"net/http"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/Preetam/siesta"
-	"github.com/Preetam/transverse/internal/forecast1"
-	"github.com/Preetam/transverse/internal/forecast3"
+	"github.com/Preetam/transverse/internal/forecast"
+	// Forecasters register themselves with the forecast package.
+	_ "github.com/Preetam/transverse/internal/forecast1"
+	_ "github.com/Preetam/transverse/internal/forecast2"
+	_ "github.com/Preetam/transverse/internal/forecast3"
+	"github.com/Preetam/transverse/internal/trace"
 	"github.com/Preetam/transverse/metadata/client"
 	"github.com/Preetam/transverse/metadata/middleware"
 	"github.com/Preetam/transverse/metadata/token"
@@ -38,28 +45,40 @@ import (
 const APIBasePath = "/api/v1/"
 const UserContextKey = "user"
 
+// defaultForecastModel is the forecaster used for goals without a model.
+// It's set with -forecast-model.
+var defaultForecastModel = "forecast3"
+
+// UserRecordContextKey holds the client.User making a request.
+const UserRecordContextKey = "user_record"
+
 type API struct {
-	os ObjectStore
+	os     ObjectStore
+	series *goalSeriesStore
 }
 
 func NewAPI(os ObjectStore) *API {
 	return &API{
-		os: os,
+		os:     os,
+		series: newGoalSeriesStore(os),
 	}
 }
 
 // Service returns a siesta service for the API.
 func (api *API) Service() *siesta.Service {
 	APIService := siesta.NewService(APIBasePath)
-	APIService.AddPre(middleware.RequestIdentifier)
+	APIService.AddPre(requestIdentifier)
 	APIService.AddPre(api.CheckAuth)
 	APIService.AddPost(middleware.ResponseGenerator)
 	APIService.AddPost(middleware.ResponseWriter)
 
 	APIService.Route("GET", "/user", "serves user API endpoint", api.GetUser)
 	APIService.Route("GET", "/user/data", "gets all user data", api.GetUserData)
+	APIService.Route("GET", "/user/export", "downloads an account archive", api.GetAccountArchive)
+	APIService.Route("POST", "/user/import", "imports goals from an account archive", api.PostAccountArchive)
 	APIService.Route("DELETE", "/user", "serves user deletion API endpoint", api.DeleteUser)
 	APIService.Route("PUT", "/user/password", "updates user password", api.PutPassword)
+	APIService.Route("PUT", "/user/time-zone", "updates user time zone", api.PutTimeZone)
 	APIService.Route("GET", "/goals", "serves goals API endpoint", api.GetGoals)
 	APIService.Route("GET", "/goals/:goalID", "serves goal API endpoint", api.GetGoal)
 	APIService.Route("PUT", "/goals/:goalID", "serves update goal API endpoint", api.UpdateGoal)
@@ -70,12 +89,22 @@ func (api *API) Service() *siesta.Service {
 	APIService.Route("GET", "/goals/:goalID/data", "serves get goal data API endpoint", api.GetGoalData)
 	APIService.Route("GET", "/goals/:goalID/eta", "serves get goal eta API endpoint", api.GetGoalETA)
 	APIService.Route("GET", "/goals/:goalID/raw-data", "serves get raw goal data API endpoint", api.GetRawGoalData)
+	APIService.Route("GET", "/goals/:goalID/export", "serves goal data export API endpoint", api.ExportGoalData)
 	APIService.Route("POST", "/goals/:goalID/data", "serves add goal data API endpoint", api.PostGoalData)
+	APIService.Route("PATCH", "/goals/:goalID/data", "serves patch goal data API endpoint", api.PatchGoalData)
 	APIService.Route("POST", "/goals/:goalID/data/single", "serves add goal single data API endpoint", api.PostGoalDataSingle)
+	APIService.Route("GET", "/goals/:goalID/data/revisions", "serves goal data revisions API endpoint", api.GetGoalDataRevisions)
+	APIService.Route("POST", "/goals/:goalID/data/revisions/:rev/restore", "serves restore goal data revision API endpoint", api.RestoreGoalDataRevision)
 
 	return APIService
 }
 
+// writeContext returns a context for a metadata write with a new idempotency
+// key, so the client can safely retry it.
+func writeContext(ctx context.Context) context.Context {
+	return client.WithIdempotencyKey(ctx, generateCode(16))
+}
+
 func (api *API) CheckAuth(c siesta.Context, w http.ResponseWriter, r *http.Request, q func()) {
 	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
 
@@ -96,7 +125,7 @@ func (api *API) CheckAuth(c siesta.Context, w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user, err := MetadataClient.GetUserByID(userTokenData.User)
+	user, err := MetadataClient.GetUserByID(r.Context(), userTokenData.User)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
@@ -119,18 +148,27 @@ func (api *API) CheckAuth(c siesta.Context, w http.ResponseWriter, r *http.Reque
 	}
 
 	c.Set(UserContextKey, userTokenData)
+	c.Set(UserRecordContextKey, user)
+}
+
+// requestLocation returns the time zone of the user making a request.
+func requestLocation(c siesta.Context) *time.Location {
+	if user, ok := c.Get(UserRecordContextKey).(client.User); ok {
+		return userLocation(user)
+	}
+	return time.UTC
 }
 
 func (api *API) GetUser(c siesta.Context, w http.ResponseWriter, r *http.Request) {
 	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
 	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
 
-	user, err := MetadataClient.GetUserByID(userTokenData.User)
+	user, err := MetadataClient.GetUserByID(r.Context(), userTokenData.User)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -142,12 +180,12 @@ func (api *API) GetUserData(c siesta.Context, w http.ResponseWriter, r *http.Req
 	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
 	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
 
-	user, err := MetadataClient.GetUserByID(userTokenData.User)
+	user, err := MetadataClient.GetUserByID(r.Context(), userTokenData.User)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -156,12 +194,12 @@ func (api *API) GetUserData(c siesta.Context, w http.ResponseWriter, r *http.Req
 	response := map[string]interface{}{}
 	response["user"] = user
 
-	goals, err := MetadataClient.GetUserGoals(user.ID, true)
+	goals, err := MetadataClient.GetUserGoals(r.Context(), user.ID, true)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -171,22 +209,15 @@ func (api *API) GetUserData(c siesta.Context, w http.ResponseWriter, r *http.Req
 	goalDataMap := map[string]interface{}{}
 
 	for _, goal := range goals {
-		reader, err := api.os.GetObject(goal.ID)
+		goalData, err := api.series.Read(r.Context(), goal.ID, time.Time{}, time.Time{})
 		if err != nil {
-			if err == errDoesNotExist {
+			if err == errDoesNotExist || err == errInvalidGoalData {
 				continue
 			}
 			requestData.StatusCode = http.StatusInternalServerError
 			return
 		}
 
-		goalData := []goalDataPoint{}
-
-		err = json.NewDecoder(reader).Decode(&goalData)
-		if err != nil {
-			continue
-		}
-
 		goalDataMap[goal.ID] = goalData
 	}
 
@@ -198,22 +229,38 @@ func (api *API) DeleteUser(c siesta.Context, w http.ResponseWriter, r *http.Requ
 	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
 	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
 
-	user, err := MetadataClient.GetUserByID(userTokenData.User)
+	user, err := MetadataClient.GetUserByID(r.Context(), userTokenData.User)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
 
-	err = MetadataClient.DeleteUser(user)
+	goals, err := MetadataClient.GetUserGoals(r.Context(), user.ID, true)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
 		return
 	}
+
+	err = MetadataClient.DeleteUser(writeContext(r.Context()), user)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+
+	// Anything left behind is cleaned up by the garbage collector.
+	for goalID := range goals {
+		err = api.series.Delete(r.Context(), goalID)
+		if err != nil {
+			log.Println(requestData.RequestID, err)
+		}
+		forecasts.invalidate(r.Context(), goalID)
+	}
 }
 
 func (api *API) PutPassword(c siesta.Context, w http.ResponseWriter, r *http.Request) {
@@ -234,12 +281,12 @@ func (api *API) PutPassword(c siesta.Context, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	user, err := MetadataClient.GetUserByID(userTokenData.User)
+	user, err := MetadataClient.GetUserByID(r.Context(), userTokenData.User)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -252,7 +299,7 @@ func (api *API) PutPassword(c siesta.Context, w http.ResponseWriter, r *http.Req
 	}
 
 	user.PasswordHash = string(hash)
-	err = MetadataClient.UpdateUser(user)
+	err = MetadataClient.UpdateUser(writeContext(r.Context()), user)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
@@ -260,6 +307,61 @@ func (api *API) PutPassword(c siesta.Context, w http.ResponseWriter, r *http.Req
 	}
 }
 
+// validTimeZone returns true if name is empty or an IANA time zone name.
+func validTimeZone(name string) bool {
+	if name == "" {
+		return true
+	}
+	if name == "Local" {
+		// The server's zone, which isn't meaningful to users.
+		return false
+	}
+	_, err := loadLocation(name)
+	return err == nil
+}
+
+// PutTimeZone sets the user's time zone, which is used to find day
+// boundaries. The body is a JSON string like "America/Los_Angeles", or ""
+// for UTC. Data already stored isn't changed.
+func (api *API) PutTimeZone(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
+
+	timeZone := ""
+	err := json.NewDecoder(r.Body).Decode(&timeZone)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	if !validTimeZone(timeZone) {
+		requestData.ResponseError = "unknown time zone"
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+
+	user, err := MetadataClient.GetUserByID(r.Context(), userTokenData.User)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
+		}
+		return
+	}
+
+	user.TimeZone = timeZone
+	user.Updated = time.Now().Unix()
+	err = MetadataClient.UpdateUser(writeContext(r.Context()), user)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+	user.PasswordHash = ""
+	requestData.ResponseData = user
+}
+
 func (api *API) GetGoals(c siesta.Context, w http.ResponseWriter, r *http.Request) {
 	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
 	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
@@ -273,12 +375,12 @@ func (api *API) GetGoals(c siesta.Context, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	goals, err := MetadataClient.GetUserGoals(userTokenData.User, *showArchived)
+	goals, err := MetadataClient.GetUserGoals(r.Context(), userTokenData.User, *showArchived)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -297,13 +399,19 @@ func (api *API) GetGoal(c siesta.Context, w http.ResponseWriter, r *http.Request
 		requestData.StatusCode = http.StatusBadRequest
 		return
 	}
+	if *goalID == "export" {
+		// The router can't have a /goals/export route next to
+		// /goals/:goalID, and "export" can't be a goal ID.
+		api.ExportGoals(c, w, r)
+		return
+	}
 
-	goal, err := MetadataClient.GetGoal(*goalID)
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -333,18 +441,38 @@ func (api *API) CreateGoal(c siesta.Context, w http.ResponseWriter, r *http.Requ
 		requestData.StatusCode = http.StatusBadRequest
 		return
 	}
+	if !validDuplicatePolicy(goal.Duplicates) {
+		requestData.ResponseError = "duplicates must be last, sum, mean or max"
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	if !validResolution(goal.Resolution) {
+		requestData.ResponseError = "resolution must be hourly, daily, weekly or monthly"
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	if !validGoalType(goal.Type) {
+		requestData.ResponseError = "type must be level or counter"
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	if !validForecastModel(goal.Model) {
+		requestData.ResponseError = "model must be one of " + strings.Join(forecast.Models(), ", ")
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
 
 	goal.ID = generateCode(8)
 	goal.User = userTokenData.User
 	goal.Created = time.Now().Unix()
 	goal.Updated = time.Now().Unix()
 
-	err = MetadataClient.CreateGoal(goal)
+	err = MetadataClient.CreateGoal(writeContext(r.Context()), goal)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -376,20 +504,41 @@ func (api *API) UpdateGoal(c siesta.Context, w http.ResponseWriter, r *http.Requ
 		requestData.StatusCode = http.StatusBadRequest
 		return
 	}
+	if !validDuplicatePolicy(goal.Duplicates) {
+		requestData.ResponseError = "duplicates must be last, sum, mean or max"
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	if !validResolution(goal.Resolution) {
+		requestData.ResponseError = "resolution must be hourly, daily, weekly or monthly"
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	if !validGoalType(goal.Type) {
+		requestData.ResponseError = "type must be level or counter"
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	if !validForecastModel(goal.Model) {
+		requestData.ResponseError = "model must be one of " + strings.Join(forecast.Models(), ", ")
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
 
 	goal.ID = *goalID
 	goal.User = userTokenData.User
 	goal.Updated = time.Now().Unix()
 
-	err = MetadataClient.UpdateGoal(goal)
+	err = MetadataClient.UpdateGoal(writeContext(r.Context()), goal)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
+	forecasts.invalidate(r.Context(), goal.ID)
 	requestData.ResponseData = goal
 }
 
@@ -406,12 +555,12 @@ func (api *API) DeleteGoal(c siesta.Context, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	goal, err := MetadataClient.GetGoal(*goalID)
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -425,17 +574,21 @@ func (api *API) DeleteGoal(c siesta.Context, w http.ResponseWriter, r *http.Requ
 	goal.Updated = time.Now().Unix()
 	goal.Deleted = time.Now().Unix()
 
-	err = MetadataClient.UpdateGoal(goal)
+	err = MetadataClient.UpdateGoal(writeContext(r.Context()), goal)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
 
-	api.os.DeleteObject(*goalID)
+	err = api.series.Delete(r.Context(), *goalID)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+	}
+	forecasts.invalidate(r.Context(), *goalID)
 }
 
 func (api *API) GetRawGoalData(c siesta.Context, w http.ResponseWriter, r *http.Request) {
@@ -444,19 +597,28 @@ func (api *API) GetRawGoalData(c siesta.Context, w http.ResponseWriter, r *http.
 
 	var params siesta.Params
 	goalID := params.String("goalID", "", "Goal ID")
+	startTimestamp := params.Int64("start", 0, "Start of the range as a Unix timestamp")
+	endTimestamp := params.Int64("end", 0, "End of the range as a Unix timestamp")
 	err := params.Parse(r.Form)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusBadRequest
 		return
 	}
+	start, end := time.Time{}, time.Time{}
+	if *startTimestamp != 0 {
+		start = time.Unix(*startTimestamp, 0)
+	}
+	if *endTimestamp != 0 {
+		end = time.Unix(*endTimestamp, 0)
+	}
 
-	goal, err := MetadataClient.GetGoal(*goalID)
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -467,7 +629,7 @@ func (api *API) GetRawGoalData(c siesta.Context, w http.ResponseWriter, r *http.
 		return
 	}
 
-	reader, err := api.os.GetObject(*goalID)
+	goalData, err := api.series.Read(r.Context(), *goalID, start, end)
 	if err != nil {
 		if err == errDoesNotExist {
 			requestData.StatusCode = http.StatusNotFound
@@ -475,15 +637,9 @@ func (api *API) GetRawGoalData(c siesta.Context, w http.ResponseWriter, r *http.
 		}
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		return
-	}
-
-	goalData := []goalDataPoint{}
-
-	err = json.NewDecoder(reader).Decode(&goalData)
-	if err != nil {
-		log.Println(requestData.RequestID, err)
-		requestData.StatusCode = http.StatusBadRequest
+		if err == errInvalidGoalData {
+			requestData.StatusCode = http.StatusBadRequest
+		}
 		return
 	}
 
@@ -492,41 +648,85 @@ func (api *API) GetRawGoalData(c siesta.Context, w http.ResponseWriter, r *http.
 	}
 }
 
-func getGoalDataInternal(goal client.Goal, goalData []goalDataPoint) map[string]interface{} {
-	type forecastT struct {
-		Timestamp time.Time `json:"ts"`
-		Value     float64   `json:"value"`
-	}
+// forecastT is a forecast point returned by getGoalDataInternal.
+type forecastT struct {
+	Timestamp time.Time `json:"ts"`
+	Value     float64   `json:"value"`
+}
+
+// getGoalDataInternal fills gaps in a goal's data and forecasts it. Buckets
+// are computed in loc. Counter goals are forecast from their running total,
+// which is returned as the series, with the increments returned too. The
+// forecast uses the goal's model, or the default if it has none, and is
+// cached in forecasts.
+func getGoalDataInternal(ctx context.Context, goal client.Goal, loc *time.Location, goalData []goalDataPoint) map[string]interface{} {
+	ctx, span := trace.StartSpan(ctx, "forecast", trace.KindInternal)
+	span.SetAttribute("goal", goal.ID)
+	span.SetAttribute("points", len(goalData))
+	defer span.Finish()
 
 	predictionForecast := []forecastT{}
 	lowForecast := []forecastT{}
 	highForecast := []forecastT{}
 
-	goalData = fillGaps(goalData)
+	// Points stored before validation may not be finite.
+	finite := []goalDataPoint{}
+	for _, p := range goalData {
+		if !math.IsNaN(p.Value) && !math.IsInf(p.Value, 0) {
+			finite = append(finite, p)
+		}
+	}
+	model := goal.Model
+	if model == "" {
+		model = defaultForecastModel
+	}
+	b := goalBucketing(goal, loc)
+	goalType := goalTypeLevel
+	var increments []goalDataPoint
+	if isCounter(goal) {
+		goalType = goalTypeCounter
+		increments, goalData = cumulativeSeries(finite, b)
+	} else {
+		goalData = fillGaps(finite, b)
+	}
+	response := func() map[string]interface{} {
+		resp := map[string]interface{}{
+			"series":     goalData,
+			"prediction": predictionForecast,
+			"low":        lowForecast,
+			"high":       highForecast,
+			"resolution": b.resolution,
+			"time_zone":  b.location.String(),
+			"type":       goalType,
+			"model":      model,
+		}
+		if increments != nil {
+			resp["increments"] = increments
+		}
+		return resp
+	}
+	if len(goalData) == 0 {
+		return response()
+	}
 	haveETA := false
 	eta := 0
 
-	if true {
-		forecaster := forecast3.NewForecaster()
-
-		lastValue := 0.0
-		points := []float64{}
+	forecaster, err := forecast.New(model)
+	if err != nil {
+		// The goal's model was removed, so use the default.
+		model = defaultForecastModel
+		forecaster, err = forecast.New(model)
+	}
+	if err == nil {
+		values := []float64{}
 		for _, v := range goalData {
-			points = append(points, v.Value)
-			lastValue = v.Value
+			values = append(values, v.Value)
 		}
-		forecastPoints := forecaster.Forecast(points)
-		firstPrediction := 0.0
-		for i, v := range forecastPoints {
-			if lastValue == goal.Target {
-				// Reached goal
-				break
-			}
-			if i == 0 {
-				firstPrediction = v.Predicted
-			}
-
-			timestamp := goalData[len(goalData)-1].Timestamp.Add(time.Hour * 24 * time.Duration(i))
+		f, cached := goalForecast(ctx, goal.ID, model, forecaster, goal.Target, values)
+		span.SetAttribute("forecast_cached", cached)
+		haveETA, eta = f.HaveETA, f.ETA
+		for i, v := range f.Points {
+			timestamp := b.forecastTime(goalData[len(goalData)-1].Timestamp, i)
 			predictionForecast = append(predictionForecast, forecastT{
 				Timestamp: timestamp,
 				Value:     v.Predicted,
@@ -539,162 +739,78 @@ func getGoalDataInternal(goal client.Goal, goalData []goalDataPoint) map[string]
 				Timestamp: timestamp,
 				Value:     v.High,
 			})
-
-			if i > 1 {
-				// ETA detection
-
-				if firstPrediction >= goal.Target && predictionForecast[len(predictionForecast)-1].Value < goal.Target {
-					haveETA = true
-					eta = i - 1
-					break
-				}
-
-				if firstPrediction <= goal.Target && predictionForecast[len(predictionForecast)-1].Value > goal.Target {
-					haveETA = true
-					eta = i - 1
-					break
-				}
-			}
-		}
-	} else {
-		// set up initial data
-		initialLevel := 0.0
-		initialTrend := 0.0
-		maxInitialPoints := 4
-		if len(goalData) == 1 {
-			initialLevel = goalData[0].Value
-		} else {
-			if len(goalData) < maxInitialPoints {
-				maxInitialPoints = len(goalData)
-			}
-
-			initialVals := []float64{}
-			for i := 0; i < maxInitialPoints; i++ {
-				initialVals = append(initialVals, goalData[i].Value)
-			}
-
-			initialLevel = sum(initialVals) / float64(maxInitialPoints)
-			differences := diff(initialVals)
-			initialTrend = sum(differences) / float64(len(differences))
-		}
-
-		models := []*forecast1.Model{}
-		maxModels := 20
-		if len(goalData) < maxModels {
-			maxModels = len(goalData)
-		}
-		for i := 1; i <= maxModels; i++ {
-			models = append(models, forecast1.NewModel(i))
-		}
-
-		lastValue := 0.0
-		for _, point := range goalData {
-			models[0].Update(float32(point.Value), float32(initialLevel), float32(initialTrend))
-			for j, m := range models {
-				if j == 0 {
-					continue
-				}
-				m.Update(float32(point.Value), models[0].Level, models[0].Trend)
-			}
-			lastValue = point.Value
-		}
-
-		firstPrediction := 0.0
-		shift := 0.0
-		lastSqrtErr := float32(0.0)
-		for i, m := range models {
-			if lastValue == goal.Target {
-				// Reached?
-				break
-			}
-			timestamp := goalData[len(goalData)-1].Timestamp.Add(time.Hour * 24 * time.Duration(i))
-			prediction := m.Forecast()
-			if i == 0 {
-				firstPrediction = float64(prediction)
-				shift = lastValue - firstPrediction
-			}
-			sqrtErr := float32(math.Sqrt(float64(m.ErrEWMA)))
-			if sqrtErr < lastSqrtErr {
-				sqrtErr = lastSqrtErr
-			}
-			lastSqrtErr = sqrtErr
-			low := prediction - 2*sqrtErr
-			high := prediction + 2*sqrtErr
-
-			if i > 1 {
-				if firstPrediction >= goal.Target && predictionForecast[len(predictionForecast)-1].Value < goal.Target {
-					haveETA = true
-					eta = i - 1
-					break
-				}
-
-				if firstPrediction <= goal.Target && predictionForecast[len(predictionForecast)-1].Value > goal.Target {
-					haveETA = true
-					eta = i - 1
-					break
-				}
-			}
-
-			predictionForecast = append(predictionForecast, forecastT{
-				Timestamp: timestamp,
-				Value:     float64(prediction) + shift,
-			})
-
-			if i == 0 {
-				lowForecast = append(lowForecast, forecastT{
-					Timestamp: timestamp,
-					Value:     float64(prediction) + shift,
-				})
-				highForecast = append(highForecast, forecastT{
-					Timestamp: timestamp,
-					Value:     float64(prediction) + shift,
-				})
-
-				continue
-			}
-
-			lowForecast = append(lowForecast, forecastT{
-				Timestamp: timestamp,
-				Value:     float64(low) + shift,
-			})
-			highForecast = append(highForecast, forecastT{
-				Timestamp: timestamp,
-				Value:     float64(high) + shift,
-			})
 		}
 	}
 
-	resp := map[string]interface{}{
-		"series":     goalData,
-		"prediction": predictionForecast,
-		"low":        lowForecast,
-		"high":       highForecast,
-	}
+	resp := response()
 	if haveETA {
+		// The ETA is a number of buckets at the goal's resolution.
 		resp["eta"] = eta
+		resp["eta_date"] = b.forecastTime(goalData[len(goalData)-1].Timestamp, eta).In(b.location).Format(time.RFC3339)
 	}
 	return resp
 }
 
+// goalForecast forecasts a goal's values with forecaster, or returns the
+// cached forecast and true. The forecast is empty if the last value is the
+// target, and ends at the first point past the target if there's an ETA.
+func goalForecast(ctx context.Context, goalID, model string, forecaster forecast.Forecaster, target float64, values []float64) (cachedForecast, bool) {
+	version := forecast.Version(forecaster)
+	key := forecastCacheKey(model, version, target, values)
+	if f, ok := forecasts.get(ctx, goalID, model, key); ok {
+		return f, true
+	}
+
+	f := cachedForecast{Key: key, Model: model, Version: version}
+	if values[len(values)-1] != target {
+		f.Points = forecaster.Forecast(values)
+	}
+	if n, ok := forecast.ETA(f.Points, target); ok {
+		f.HaveETA = true
+		f.ETA = n
+		f.Points = f.Points[:n+2]
+	}
+	forecasts.set(ctx, goalID, f)
+	return f, false
+}
+
+// validForecastModel returns true if model is empty or a registered
+// forecaster.
+func validForecastModel(model string) bool {
+	if model == "" {
+		return true
+	}
+	_, err := forecast.New(model)
+	return err == nil
+}
+
+// GetGoalData responds with a goal's data and forecast. model overrides
+// the goal's forecast model, to compare models.
 func (api *API) GetGoalData(c siesta.Context, w http.ResponseWriter, r *http.Request) {
 	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
 	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
 
 	var params siesta.Params
 	goalID := params.String("goalID", "", "Goal ID")
+	model := params.String("model", "", "Forecast model")
 	err := params.Parse(r.Form)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusBadRequest
 		return
 	}
+	if !validForecastModel(*model) {
+		requestData.ResponseError = "model must be one of " + strings.Join(forecast.Models(), ", ")
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
 
-	goal, err := MetadataClient.GetGoal(*goalID)
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -706,7 +822,7 @@ func (api *API) GetGoalData(c siesta.Context, w http.ResponseWriter, r *http.Req
 	}
 
 	getObjectStartTime := time.Now()
-	reader, err := api.os.GetObject(*goalID)
+	goalData, err := api.series.Read(r.Context(), *goalID, time.Time{}, time.Time{})
 	if err != nil {
 		if err == errDoesNotExist {
 			requestData.StatusCode = http.StatusNotFound
@@ -714,23 +830,20 @@ func (api *API) GetGoalData(c siesta.Context, w http.ResponseWriter, r *http.Req
 		}
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
+		if err == errInvalidGoalData {
+			requestData.StatusCode = http.StatusBadRequest
+		}
 		return
 	}
 	getObjectEndTime := time.Now()
 	getObjectLatencyMs := getObjectEndTime.Sub(getObjectStartTime).Seconds() * 1000
 	log.WithFields(map[string]interface{}{
 		"get_object_latency_ms": getObjectLatencyMs,
-	}).Printf("Getting object took %0.2f ms", getObjectLatencyMs)
-
-	goalData := []goalDataPoint{}
-
-	err = json.NewDecoder(reader).Decode(&goalData)
-	if err != nil {
-		log.Println(requestData.RequestID, err)
-		requestData.StatusCode = http.StatusBadRequest
-		return
+	}).Printf("Reading goal data took %0.2f ms", getObjectLatencyMs)
+	if *model != "" {
+		goal.Model = *model
 	}
-	requestData.ResponseData = getGoalDataInternal(goal, goalData)
+	requestData.ResponseData = getGoalDataInternal(r.Context(), goal, requestLocation(c), goalData)
 }
 
 func (api *API) GetGoalETA(c siesta.Context, w http.ResponseWriter, r *http.Request) {
@@ -746,12 +859,12 @@ func (api *API) GetGoalETA(c siesta.Context, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	goal, err := MetadataClient.GetGoal(*goalID)
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -775,7 +888,7 @@ func (api *API) GetGoalETA(c siesta.Context, w http.ResponseWriter, r *http.Requ
 	}
 
 	getObjectStartTime := time.Now()
-	reader, err := api.os.GetObject(*goalID)
+	goalData, err := api.series.Read(r.Context(), *goalID, time.Time{}, time.Time{})
 	if err != nil {
 		if err == errDoesNotExist {
 			requestData.StatusCode = http.StatusNotFound
@@ -783,24 +896,18 @@ func (api *API) GetGoalETA(c siesta.Context, w http.ResponseWriter, r *http.Requ
 		}
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
+		if err == errInvalidGoalData {
+			requestData.StatusCode = http.StatusBadRequest
+		}
 		return
 	}
 	getObjectEndTime := time.Now()
 	getObjectLatencyMs := getObjectEndTime.Sub(getObjectStartTime).Seconds() * 1000
 	log.WithFields(map[string]interface{}{
 		"get_object_latency_ms": getObjectLatencyMs,
-	}).Printf("Getting object took %0.2f ms", getObjectLatencyMs)
-
-	goalData := []goalDataPoint{}
-
-	err = json.NewDecoder(reader).Decode(&goalData)
-	if err != nil {
-		log.Println(requestData.RequestID, err)
-		requestData.StatusCode = http.StatusBadRequest
-		return
-	}
+	}).Printf("Reading goal data took %0.2f ms", getObjectLatencyMs)
 	resp := map[string]interface{}{}
-	resp["eta"] = getGoalDataInternal(goal, goalData)["eta"]
+	resp["eta"] = getGoalDataInternal(r.Context(), goal, requestLocation(c), goalData)["eta"]
 	requestData.ResponseData = resp
 
 	if resp["eta"] != nil {
@@ -808,7 +915,7 @@ func (api *API) GetGoalETA(c siesta.Context, w http.ResponseWriter, r *http.Requ
 	} else {
 		goal.ETA = -1
 	}
-	MetadataClient.UpdateGoal(goal)
+	MetadataClient.UpdateGoal(writeContext(r.Context()), goal)
 }
 
 type goalDataPoint struct {
@@ -830,25 +937,37 @@ func (p pointsByTime) Swap(i, j int) {
 	p[i], p[j] = p[j], p[i]
 }
 
+// PostGoalData stores a goal's data. The body is a JSON array of points, or
+// a CSV or TSV file if the content type says so. mode=replace (the
+// default) replaces all of the goal's data; mode=merge keeps existing
+// points that aren't in the body.
 func (api *API) PostGoalData(c siesta.Context, w http.ResponseWriter, r *http.Request) {
 	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
 	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
 
 	var params siesta.Params
 	goalID := params.String("goalID", "", "Goal ID")
+	mode := params.String("mode", "replace", "replace or merge")
+	column := params.String("column", "", "CSV value column name or zero-based index")
+	dateFormat := params.String("date_format", "", "CSV date format, e.g. DD/MM/YYYY")
 	err := params.Parse(r.Form)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusBadRequest
 		return
 	}
+	if *mode != "replace" && *mode != "merge" {
+		requestData.ResponseError = "mode must be replace or merge"
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
 
-	goal, err := MetadataClient.GetGoal(*goalID)
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -860,35 +979,154 @@ func (api *API) PostGoalData(c siesta.Context, w http.ResponseWriter, r *http.Re
 	}
 
 	goalData := []goalDataPoint{}
-	err = json.NewDecoder(r.Body).Decode(&goalData)
+	var imported *csvImport
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "text/csv", "text/tab-separated-values":
+		opts := csvImportOptions{Column: *column, DateFormat: *dateFormat, Location: requestLocation(c)}
+		if contentType == "text/tab-separated-values" {
+			opts.Delimiter = '\t'
+		}
+		data, err := readImportBody(r.Body)
+		if err == nil {
+			imported, err = parseDelimitedGoalData(data, opts)
+		}
+		if err != nil {
+			requestData.ResponseError = err.Error()
+			requestData.StatusCode = http.StatusBadRequest
+			return
+		}
+		if len(imported.Errors) > 0 {
+			// Nothing is imported unless every row is valid.
+			requestData.ResponseError = "invalid rows"
+			requestData.ResponseData = imported
+			requestData.StatusCode = http.StatusBadRequest
+			return
+		}
+		goalData = imported.Points
+	default:
+		err = json.NewDecoder(r.Body).Decode(&goalData)
+		if err != nil {
+			log.Println(requestData.RequestID, err)
+			requestData.StatusCode = http.StatusBadRequest
+			return
+		}
+		if errs := validateGoalData(goalData, time.Now()); len(errs) > 0 {
+			requestData.ResponseError = "invalid points"
+			requestData.ResponseData = map[string]interface{}{"errors": errs}
+			requestData.StatusCode = http.StatusBadRequest
+			return
+		}
+	}
+	goalData = normalizeGoalData(goalData, goalBucketing(goal, requestLocation(c)), duplicatePolicy(goal))
+
+	if *mode == "merge" {
+		patch := goalDataPatch{Operations: []goalDataOperation{{Op: patchOpUpsert, Points: goalData}}}
+		var years []int
+		years, err = patch.validate()
+		if err == nil {
+			err = api.series.Update(r.Context(), *goalID, years, func(existing []goalDataPoint) ([]goalDataPoint, error) {
+				return patch.apply(existing), nil
+			})
+		}
+	} else {
+		err = api.series.Replace(r.Context(), *goalID, goalData)
+	}
 	if err != nil {
 		log.Println(requestData.RequestID, err)
-		requestData.StatusCode = http.StatusBadRequest
+		requestData.StatusCode = http.StatusInternalServerError
+		if err == errPreconditionFailed {
+			requestData.StatusCode = http.StatusConflict
+		}
 		return
 	}
-	// Format as UTC
-	for i, p := range goalData {
-		p.Timestamp = p.Timestamp.UTC()
-		goalData[i] = p
+
+	forecasts.invalidate(r.Context(), goal.ID)
+	goal.Updated = time.Now().Unix()
+	MetadataClient.UpdateGoal(writeContext(r.Context()), goal)
+	if imported != nil {
+		requestData.ResponseData = imported
 	}
-	sort.Sort(pointsByTime(goalData))
+}
+
+// PatchGoalData applies a list of upserts and deletes to a goal's data in a
+// single update, and responds with the resulting point count and range.
+func (api *API) PatchGoalData(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
 
-	// marshal it for S3
-	marshaled, err := json.Marshal(goalData)
+	var params siesta.Params
+	goalID := params.String("goalID", "", "Goal ID")
+	err := params.Parse(r.Form)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
-		requestData.StatusCode = http.StatusInternalServerError
+		requestData.StatusCode = http.StatusBadRequest
 		return
 	}
-	err = api.os.PutObject(*goalID, bytes.NewReader(marshaled), int64(len(marshaled)))
+
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
+		}
+		return
+	}
+
+	if goal.User != userTokenData.User {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusForbidden
+		return
+	}
+
+	patch := goalDataPatch{}
+	err = json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	years, err := patch.validate()
+	if err == nil {
+		// Bucketing can move points into another year, so the years are
+		// found after normalizing.
+		patch.normalize(goalBucketing(goal, requestLocation(c)), duplicatePolicy(goal))
+		years, err = patch.validate()
+	}
+	if err != nil {
+		requestData.ResponseError = err.Error()
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+
+	err = api.series.Update(r.Context(), *goalID, years, func(goalData []goalDataPoint) ([]goalDataPoint, error) {
+		return patch.apply(goalData), nil
+	})
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		switch err {
+		case errPreconditionFailed:
+			requestData.StatusCode = http.StatusConflict
+		case errInvalidGoalData:
+			requestData.StatusCode = http.StatusBadRequest
+		default:
+			requestData.StatusCode = http.StatusInternalServerError
+		}
 		return
 	}
 
+	forecasts.invalidate(r.Context(), goal.ID)
 	goal.Updated = time.Now().Unix()
-	MetadataClient.UpdateGoal(goal)
+	MetadataClient.UpdateGoal(writeContext(r.Context()), goal)
+
+	stats, err := api.series.Stats(r.Context(), *goalID)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+	requestData.ResponseData = stats
 }
 
 func (api *API) PostGoalDataSingle(c siesta.Context, w http.ResponseWriter, r *http.Request) {
@@ -905,12 +1143,12 @@ func (api *API) PostGoalDataSingle(c siesta.Context, w http.ResponseWriter, r *h
 		return
 	}
 
-	goal, err := MetadataClient.GetGoal(*goalID)
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
-		if serverErr, ok := err.(client.ServerError); ok {
-			requestData.StatusCode = int(serverErr)
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
 		return
 	}
@@ -933,111 +1171,195 @@ func (api *API) PostGoalDataSingle(c siesta.Context, w http.ResponseWriter, r *h
 		return
 	}
 
-	reader, err := api.os.GetObject(*goalID)
+	err = api.setGoalDataPoint(r.Context(), goal, requestLocation(c), point.Date, point.Value, *add)
 	if err != nil {
-		if err != errDoesNotExist {
-			log.Println(requestData.RequestID, err)
+		log.Println(requestData.RequestID, err)
+		switch err {
+		case errPreconditionFailed:
+			// Still conflicting after retries.
+			requestData.StatusCode = http.StatusConflict
+		case errInvalidGoalData:
+			requestData.StatusCode = http.StatusBadRequest
+		default:
 			requestData.StatusCode = http.StatusInternalServerError
-			return
-		} else {
-			// Maybe it's the first point.
 		}
+		return
 	}
 
-	goalData := []goalDataPoint{}
+	forecasts.invalidate(r.Context(), goal.ID)
+	goal.Updated = time.Now().Unix()
+	MetadataClient.UpdateGoal(writeContext(r.Context()), goal)
+}
 
-	if err != errDoesNotExist {
-		err = json.NewDecoder(reader).Decode(&goalData)
-		if err != nil {
-			log.Println(requestData.RequestID, err)
-			requestData.StatusCode = http.StatusBadRequest
-			return
-		}
+func (api *API) GetGoalDataRevisions(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
+
+	var params siesta.Params
+	goalID := params.String("goalID", "", "Goal ID")
+	err := params.Parse(r.Form)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusBadRequest
+		return
 	}
 
-	hasPoint := false
-	today := point.Date.Truncate(24 * time.Hour).UTC()
-	for _, p := range goalData {
-		if p.Timestamp.Unix() == today.Unix() {
-			hasPoint = true
-			break
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
 		}
+		return
 	}
-	if !hasPoint {
-		goalData = append(goalData, goalDataPoint{
-			Timestamp: today,
-			Value:     0,
-		})
+
+	if goal.User != userTokenData.User {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusForbidden
+		return
 	}
-	sort.Sort(pointsByTime(goalData))
 
-	for i, p := range goalData {
-		if p.Timestamp.Unix() == today.Unix() {
-			newValue := point.Value
-			if *add {
-				newValue += p.Value
-			}
-			p.Value = newValue
-			goalData[i] = p
-			break
+	revisions, err := api.series.Revisions(r.Context(), *goalID)
+	if err != nil {
+		if err == errDoesNotExist {
+			requestData.StatusCode = http.StatusNotFound
+			return
 		}
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+
+	requestData.ResponseData = map[string]interface{}{
+		"revisions": revisions,
 	}
+}
+
+func (api *API) RestoreGoalDataRevision(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
 
-	// marshal it for S3
-	marshaled, err := json.Marshal(goalData)
+	var params siesta.Params
+	goalID := params.String("goalID", "", "Goal ID")
+	revision := params.Int64("rev", 0, "Revision")
+	err := params.Parse(r.Form)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
-		requestData.StatusCode = http.StatusInternalServerError
+		requestData.StatusCode = http.StatusBadRequest
 		return
 	}
-	err = api.os.PutObject(*goalID, bytes.NewReader(marshaled), int64(len(marshaled)))
+
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
 	if err != nil {
 		log.Println(requestData.RequestID, err)
 		requestData.StatusCode = http.StatusInternalServerError
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
+		}
 		return
 	}
 
-	goal.Updated = time.Now().Unix()
-	MetadataClient.UpdateGoal(goal)
-}
-
-func diff(vals []float64) []float64 {
-	differences := []float64{}
-	for i := 1; i < len(vals); i++ {
-		differences = append(differences, vals[i]-vals[i-1])
+	if goal.User != userTokenData.User {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusForbidden
+		return
 	}
-	return differences
-}
 
-func sum(vals []float64) float64 {
-	result := 0.0
-	for _, v := range vals {
-		result += v
+	err = api.series.Restore(r.Context(), *goalID, *revision)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		switch err {
+		case errRevisionNotFound:
+			requestData.StatusCode = http.StatusNotFound
+		case errPreconditionFailed:
+			requestData.StatusCode = http.StatusConflict
+		default:
+			requestData.StatusCode = http.StatusInternalServerError
+		}
+		return
 	}
-	return result
+
+	forecasts.invalidate(r.Context(), goal.ID)
+	goal.Updated = time.Now().Unix()
+	MetadataClient.UpdateGoal(writeContext(r.Context()), goal)
 }
 
-func unixDay(t time.Time) int {
-	return int(t.Unix() / int64(86400))
+var errInvalidGoalData = errors.New("invalid goal data")
+
+// setGoalDataPoint sets or adds to the value for date's bucket in a goal's
+// data, with buckets computed in loc. Only the chunk for that year is read
+// and rewritten.
+func (api *API) setGoalDataPoint(ctx context.Context, goal client.Goal, loc *time.Location, date time.Time, value float64, add bool) error {
+	today := goalBucketing(goal, loc).start(date)
+	if validateGoalDataPoint(goalDataPoint{Timestamp: today, Value: value}, time.Now()) != nil {
+		return errInvalidGoalData
+	}
+	return api.series.Update(ctx, goal.ID, []int{today.Year()}, func(goalData []goalDataPoint) ([]goalDataPoint, error) {
+		hasPoint := false
+		for _, p := range goalData {
+			if p.Timestamp.Unix() == today.Unix() {
+				hasPoint = true
+				break
+			}
+		}
+		if !hasPoint {
+			goalData = append(goalData, goalDataPoint{
+				Timestamp: today,
+				Value:     0,
+			})
+		}
+		sort.Sort(pointsByTime(goalData))
+
+		for i, p := range goalData {
+			if p.Timestamp.Unix() == today.Unix() {
+				newValue := value
+				if add {
+					newValue += p.Value
+				}
+				p.Value = newValue
+				goalData[i] = p
+				break
+			}
+		}
+		return goalData, nil
+	})
 }
 
-func fillGaps(p []goalDataPoint) []goalDataPoint {
+// fillGaps returns points with one point per bucket, interpolating buckets
+// without data in gaps up to b.maxFilledBuckets long. If a bucket has more
+// than one point, the last one is used. points don't need to be sorted.
+func fillGaps(p []goalDataPoint, b bucketing) []goalDataPoint {
+	sorted := append([]goalDataPoint{}, p...)
+	sort.Stable(pointsByTime(sorted))
+
 	points := []goalDataPoint{}
-	current := 0
-	end := p[len(p)-1].Timestamp
-	for now := p[0].Timestamp; unixDay(now) <= unixDay(end); now = now.Add(24 * time.Hour) {
-		if unixDay(p[current].Timestamp) == unixDay(now) {
-			points = append(points, p[current])
-			current++
+	for _, point := range sorted {
+		if len(points) == 0 {
+			points = append(points, point)
 			continue
 		}
-		weight := float64(unixDay(now)-unixDay(p[current-1].Timestamp)) /
-			float64(unixDay(p[current].Timestamp)-unixDay(p[current-1].Timestamp))
-		newPoint := goalDataPoint{
-			Timestamp: now,
-			Value:     p[current-1].Value + weight*(p[current].Value-p[current-1].Value),
+		prev := points[len(points)-1]
+		prevBucket, pointBucket := b.index(prev.Timestamp), b.index(point.Timestamp)
+		if pointBucket == prevBucket {
+			points[len(points)-1] = point
+			continue
+		}
+		if pointBucket-prevBucket-1 > b.maxFilledBuckets() {
+			points = append(points, point)
+			continue
+		}
+		// Interpolated points are at the same offset into their bucket as
+		// the previous point.
+		offset := prev.Timestamp.Sub(b.time(prevBucket))
+		for bucket := prevBucket + 1; bucket < pointBucket; bucket++ {
+			weight := float64(bucket-prevBucket) / float64(pointBucket-prevBucket)
+			points = append(points, goalDataPoint{
+				Timestamp: b.timeAt(bucket, offset),
+				Value:     prev.Value + weight*(point.Value-prev.Value),
+			})
 		}
-		points = append(points, newPoint)
+		points = append(points, point)
 	}
 	return points
 }
@@ -0,0 +1,46 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+func TestForecastModel(t *testing.T) {
+	points := []goalDataPoint{}
+	for i := 0; i < 10; i++ {
+		points = append(points, goalDataPoint{Timestamp: day(2018, 1, 1).AddDate(0, 0, i), Value: float64(i)})
+	}
+	ctx := context.Background()
+	if model := getGoalDataInternal(ctx, client.Goal{}, time.UTC, points)["model"]; model != defaultForecastModel {
+		t.Errorf("expected the default model, got %v", model)
+	}
+	if model := getGoalDataInternal(ctx, client.Goal{Model: "forecast1"}, time.UTC, points)["model"]; model != "forecast1" {
+		t.Errorf("expected forecast1, got %v", model)
+	}
+	if model := getGoalDataInternal(ctx, client.Goal{Model: "removed"}, time.UTC, points)["model"]; model != defaultForecastModel {
+		t.Errorf("expected unknown models to fall back to the default, got %v", model)
+	}
+	if validForecastModel("removed") || !validForecastModel("") {
+		t.Error("unexpected model validation")
+	}
+}
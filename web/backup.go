@@ -0,0 +1,120 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Preetam/transverse/internal/backup"
+	"github.com/Preetam/transverse/metadata/client"
+	log "github.com/Sirupsen/logrus"
+)
+
+// metadataSnapshotter takes metadata snapshots.
+type metadataSnapshotter interface {
+	Snapshot(ctx context.Context) (client.Snapshot, error)
+}
+
+// writeBackup writes a backup archive of the metadata and the data of every
+// goal that exists in it. Goal data is read after the metadata snapshot, so
+// it may include points written after the snapshot was taken. Goals
+// without data aren't included.
+func writeBackup(ctx context.Context, w io.Writer, metadata metadataSnapshotter, series *goalSeriesStore) (backup.Manifest, error) {
+	snapshot, err := metadata.Snapshot(ctx)
+	if err != nil {
+		return backup.Manifest{}, err
+	}
+	archive := backup.NewWriter(w)
+	err = archive.WriteMetadata(snapshot.Version, snapshot.Data)
+	if err != nil {
+		return archive.Manifest(), err
+	}
+
+	goalIDs := append([]string(nil), snapshot.Goals...)
+	sort.Strings(goalIDs)
+	for _, goalID := range goalIDs {
+		points, err := series.Read(ctx, goalID, time.Time{}, time.Time{})
+		if err == errDoesNotExist {
+			continue
+		}
+		if err != nil {
+			return archive.Manifest(), err
+		}
+		data, err := json.Marshal(points)
+		if err != nil {
+			return archive.Manifest(), err
+		}
+		err = archive.WriteGoal(goalID, len(points), data)
+		if err != nil {
+			return archive.Manifest(), err
+		}
+	}
+	return archive.Manifest(), archive.Close()
+}
+
+// restoreBackup writes the goal data in a backup archive to an empty object
+// store. The whole archive is checked before anything is written so an
+// incomplete archive doesn't leave a partial restore behind. The metadata
+// in the archive is restored by the metadata service.
+func restoreBackup(ctx context.Context, archivePath string, objectStore ObjectStore, series *goalSeriesStore) (backup.Manifest, error) {
+	objects, err := objectStore.List(ctx, "")
+	if err != nil {
+		return backup.Manifest{}, err
+	}
+	for _, object := range objects {
+		if !strings.Contains(object.Name, "/") {
+			return backup.Manifest{}, errors.New("object store already has goal data")
+		}
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return backup.Manifest{}, err
+	}
+	defer f.Close()
+	manifest, err := backup.Reader{}.Read(f)
+	if err != nil {
+		return manifest, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return manifest, err
+	}
+
+	return backup.Reader{
+		Goal: func(goalID string, r io.Reader) error {
+			points := []goalDataPoint{}
+			err := json.NewDecoder(r).Decode(&points)
+			if err != nil {
+				return err
+			}
+			log.WithFields(map[string]interface{}{
+				"goal":   goalID,
+				"points": len(points),
+			}).Println("backup: restoring goal data")
+			return series.Replace(ctx, goalID, points)
+		},
+	}.Read(f)
+}
@@ -0,0 +1,104 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+type fakeSnapshotter client.Snapshot
+
+func (s fakeSnapshotter) Snapshot(ctx context.Context) (client.Snapshot, error) {
+	return client.Snapshot(s), nil
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	source := newGoalSeriesStore(&fileObjectStore{basePath: filepath.Join(dir, "source")})
+
+	points := []goalDataPoint{
+		{Timestamp: day(2017, 12, 31), Value: 1},
+		{Timestamp: day(2018, 1, 1), Value: 2},
+	}
+	err = source.Replace(ctx, "a", points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = source.Replace(ctx, "deleted", points)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := fakeSnapshotter{
+		Version: 7,
+		// "empty" has no data so it isn't in the archive.
+		Goals: []string{"a", "empty"},
+		Data:  json.RawMessage(`[{"key":"zz:version","value":"7"}]`),
+	}
+	archivePath := filepath.Join(dir, "backup.tar.gz")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := writeBackup(ctx, f, metadata, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if manifest.MetadataVersion != 7 || len(manifest.Goals) != 1 || manifest.Goals[0].Points != 2 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+
+	destinationStore := &fileObjectStore{basePath: filepath.Join(dir, "destination")}
+	destination := newGoalSeriesStore(destinationStore)
+	_, err = restoreBackup(ctx, archivePath, destinationStore, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := destination.Read(ctx, "a", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, points) {
+		t.Errorf("expected %v, got %v", points, restored)
+	}
+	_, err = destination.Read(ctx, "deleted", time.Time{}, time.Time{})
+	if err != errDoesNotExist {
+		t.Errorf("expected errDoesNotExist for deleted goal, got %v", err)
+	}
+
+	// Restoring again would overwrite data.
+	_, err = restoreBackup(ctx, archivePath, destinationStore, destination)
+	if err == nil {
+		t.Error("expected an error restoring into a store with goal data")
+	}
+}
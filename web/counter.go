@@ -0,0 +1,88 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"sort"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+// Goal types for client.Goal.Type.
+const (
+	goalTypeLevel   = "level"
+	goalTypeCounter = "counter"
+)
+
+func validGoalType(goalType string) bool {
+	return goalType == "" || goalType == goalTypeLevel || goalType == goalTypeCounter
+}
+
+func isCounter(goal client.Goal) bool {
+	return goal.Type == goalTypeCounter
+}
+
+// duplicatePolicy returns how a goal's points with the same timestamp are
+// combined. Counter increments are added up unless the goal says
+// otherwise.
+func duplicatePolicy(goal client.Goal) string {
+	if goal.Duplicates == "" && isCounter(goal) {
+		return duplicatesSum
+	}
+	return goal.Duplicates
+}
+
+// cumulativeSeries returns a counter's increments with one point per
+// bucket, and the running total at each of them. Increments in the same
+// bucket are added up, and buckets without any are zero, except in gaps
+// longer than b.maxFilledBuckets. points don't need to be sorted.
+func cumulativeSeries(points []goalDataPoint, b bucketing) (increments, cumulative []goalDataPoint) {
+	sorted := append([]goalDataPoint{}, points...)
+	sort.Stable(pointsByTime(sorted))
+
+	increments = []goalDataPoint{}
+	for _, point := range sorted {
+		if len(increments) == 0 {
+			increments = append(increments, point)
+			continue
+		}
+		prev := increments[len(increments)-1]
+		prevBucket, pointBucket := b.index(prev.Timestamp), b.index(point.Timestamp)
+		if pointBucket == prevBucket {
+			increments[len(increments)-1].Value += point.Value
+			continue
+		}
+		if pointBucket-prevBucket-1 > b.maxFilledBuckets() {
+			increments = append(increments, point)
+			continue
+		}
+		offset := prev.Timestamp.Sub(b.time(prevBucket))
+		for bucket := prevBucket + 1; bucket < pointBucket; bucket++ {
+			increments = append(increments, goalDataPoint{Timestamp: b.timeAt(bucket, offset)})
+		}
+		increments = append(increments, point)
+	}
+
+	cumulative = make([]goalDataPoint, len(increments))
+	total := 0.0
+	for i, p := range increments {
+		total += p.Value
+		cumulative[i] = goalDataPoint{Timestamp: p.Timestamp, Value: total}
+	}
+	return increments, cumulative
+}
@@ -0,0 +1,91 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+func TestCumulativeSeries(t *testing.T) {
+	b := goalBucketing(client.Goal{}, time.UTC)
+	increments, cumulative := cumulativeSeries([]goalDataPoint{
+		{Timestamp: day(2018, 1, 4), Value: 4},
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 1, 1), Value: 2},
+	}, b)
+	expectedIncrements := []goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 3},
+		{Timestamp: day(2018, 1, 2), Value: 0},
+		{Timestamp: day(2018, 1, 3), Value: 0},
+		{Timestamp: day(2018, 1, 4), Value: 4},
+	}
+	expectedCumulative := []goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 3},
+		{Timestamp: day(2018, 1, 2), Value: 3},
+		{Timestamp: day(2018, 1, 3), Value: 3},
+		{Timestamp: day(2018, 1, 4), Value: 7},
+	}
+	if !reflect.DeepEqual(increments, expectedIncrements) {
+		t.Errorf("expected increments %v, got %v", expectedIncrements, increments)
+	}
+	if !reflect.DeepEqual(cumulative, expectedCumulative) {
+		t.Errorf("expected cumulative %v, got %v", expectedCumulative, cumulative)
+	}
+
+	if duplicatePolicy(client.Goal{Type: goalTypeCounter}) != duplicatesSum {
+		t.Error("expected counters to sum duplicates by default")
+	}
+	if duplicatePolicy(client.Goal{Type: goalTypeCounter, Duplicates: duplicatesMax}) != duplicatesMax {
+		t.Error("expected a counter's duplicates policy to be kept")
+	}
+	if validGoalType("gauge") {
+		t.Error("expected gauge to be invalid")
+	}
+}
+
+func TestCounterForecast(t *testing.T) {
+	points := []goalDataPoint{}
+	for i := 0; i < 30; i++ {
+		points = append(points, goalDataPoint{Timestamp: day(2018, 1, 1).AddDate(0, 0, i), Value: 10})
+	}
+	goal := client.Goal{Type: goalTypeCounter, Target: 500}
+	resp := getGoalDataInternal(context.Background(), goal, time.UTC, points)
+
+	if increments := resp["increments"].([]goalDataPoint); len(increments) != 30 || increments[29].Value != 10 {
+		t.Errorf("unexpected increments %v", increments)
+	}
+	series := resp["series"].([]goalDataPoint)
+	if last := series[len(series)-1]; last.Value != 300 {
+		t.Errorf("expected a running total of 300, got %v", last.Value)
+	}
+	if prediction := resp["prediction"].([]forecastT); len(prediction) == 0 || prediction[len(prediction)-1].Value <= 300 {
+		t.Errorf("expected the total to keep growing, got %v", prediction)
+	}
+	if resp["type"] != goalTypeCounter {
+		t.Errorf("expected type counter, got %v", resp["type"])
+	}
+
+	if _, ok := getGoalDataInternal(context.Background(), client.Goal{}, time.UTC, points)["increments"]; ok {
+		t.Error("expected no increments for level goals")
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportBytes is the largest CSV or TSV body accepted for import.
+const maxImportBytes = 10 << 20
+
+// csvDateFormat is a date format recognized in imported files and offered
+// for exports. Name is what's reported to clients and accepted as an
+// override. Layout parses dates with or without leading zeros, and Output
+// formats them with leading zeros.
+type csvDateFormat struct {
+	Name   string
+	Layout string
+	Output string
+}
+
+// csvDateFormats are tried in order, so ambiguous dates like 01/02/2018
+// are read as month first unless some date in the file rules that out or
+// the client picks a format.
+var csvDateFormats = []csvDateFormat{
+	{"RFC3339", time.RFC3339, time.RFC3339},
+	{"YYYY-MM-DDTHH:MM:SS", "2006-01-02T15:04:05", "2006-01-02T15:04:05"},
+	{"YYYY-MM-DD HH:MM:SS", "2006-01-02 15:04:05", "2006-01-02 15:04:05"},
+	{"YYYY-MM-DD HH:MM", "2006-01-02 15:04", "2006-01-02 15:04"},
+	{"YYYY-MM-DD", "2006-01-02", "2006-01-02"},
+	{"YYYY/MM/DD", "2006/1/2", "2006/01/02"},
+	{"MM/DD/YYYY", "1/2/2006", "01/02/2006"},
+	{"DD/MM/YYYY", "2/1/2006", "02/01/2006"},
+	{"MM/DD/YY", "1/2/06", "01/02/06"},
+	{"DD/MM/YY", "2/1/06", "02/01/06"},
+	{"MM-DD-YYYY", "1-2-2006", "01-02-2006"},
+	{"DD-MM-YYYY", "2-1-2006", "02-01-2006"},
+	{"DD.MM.YYYY", "2.1.2006", "02.01.2006"},
+	{"Mon DD, YYYY", "Jan 2, 2006", "Jan 2, 2006"},
+	{"Month DD, YYYY", "January 2, 2006", "January 2, 2006"},
+	{"DD Mon YYYY", "2 Jan 2006", "2 Jan 2006"},
+	{"DD Month YYYY", "2 January 2006", "2 January 2006"},
+}
+
+// csvDelimiters are the delimiters considered when detecting one.
+var csvDelimiters = []rune{',', '\t', ';', '|'}
+
+var (
+	csvDateColumns  = []string{"date", "day", "time", "timestamp", "ts", "datetime"}
+	csvValueColumns = []string{"value", "amount", "count", "total"}
+
+	// thousandsSeparated matches numbers like "12,345.6", which some
+	// exports quote.
+	thousandsSeparated = regexp.MustCompile(`^-?\d{1,3}(,\d{3})+(\.\d+)?$`)
+)
+
+// csvImport is the result of parsing an imported file.
+type csvImport struct {
+	Points    []goalDataPoint `json:"-"`
+	Rows      int             `json:"rows"`
+	Delimiter string          `json:"delimiter"`
+	Header    []string        `json:"header,omitempty"`
+	// DateColumn and ValueColumn are zero-based.
+	DateColumn  int           `json:"date_column"`
+	ValueColumn int           `json:"value_column"`
+	DateFormat  string        `json:"date_format"`
+	Errors      []csvRowError `json:"errors,omitempty"`
+}
+
+// csvRowError is a problem with one row. Row is the one-based record
+// number in the file, which is the line number unless fields span lines.
+type csvRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// csvImportOptions override detection. Zero values detect.
+type csvImportOptions struct {
+	Delimiter rune
+	// Column is the value column's header name or zero-based index.
+	Column     string
+	DateFormat string
+	// Location is the time zone of dates without one. nil means UTC.
+	Location *time.Location
+}
+
+// parseDelimitedGoalData reads goal data points from CSV or TSV data. The
+// delimiter, header, columns and date format are detected unless set in
+// opts. Leading "Activity" title lines, as in some activity tracker
+// exports, are skipped. Rows that can't be read are reported in Errors
+// rather than failing the whole parse; an error is only returned if the
+// file can't be read at all.
+func parseDelimitedGoalData(data []byte, opts csvImportOptions) (*csvImport, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	skipped := 0
+	for skipped < len(lines) && isCSVTitleLine(lines[skipped]) {
+		skipped++
+	}
+	lines = lines[skipped:]
+
+	delimiter := opts.Delimiter
+	if delimiter == 0 {
+		delimiter = detectDelimiter(lines)
+	}
+	if delimiter == 0 {
+		return nil, errors.New("couldn't detect a delimiter")
+	}
+
+	reader := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no rows")
+	}
+
+	result := &csvImport{
+		Delimiter:   string(delimiter),
+		ValueColumn: 1,
+	}
+	firstRow := skipped + 1
+	if isCSVHeader(records[0]) {
+		result.Header = records[0]
+		records = records[1:]
+		firstRow++
+		result.DateColumn = findColumn(result.Header, csvDateColumns, 0)
+		result.ValueColumn = -1
+		for i := range result.Header {
+			if i != result.DateColumn {
+				result.ValueColumn = findColumn(result.Header, csvValueColumns, i)
+				break
+			}
+		}
+	}
+	if opts.Column != "" {
+		result.ValueColumn = -1
+		if i, err := strconv.Atoi(opts.Column); err == nil && i >= 0 {
+			result.ValueColumn = i
+		} else {
+			for i, name := range result.Header {
+				if strings.EqualFold(strings.TrimSpace(name), opts.Column) {
+					result.ValueColumn = i
+				}
+			}
+		}
+		if result.ValueColumn < 0 {
+			return nil, fmt.Errorf("no column %q", opts.Column)
+		}
+	}
+	if result.ValueColumn < 0 || result.ValueColumn == result.DateColumn {
+		return nil, errors.New("no value column")
+	}
+	result.Rows = len(records)
+	result.Points = []goalDataPoint{}
+	if len(records) == 0 {
+		// Just a header.
+		return result, nil
+	}
+
+	dates := []string{}
+	for _, record := range records {
+		if result.DateColumn < len(record) {
+			dates = append(dates, strings.TrimSpace(record[result.DateColumn]))
+		}
+	}
+	location := opts.Location
+	if location == nil {
+		location = time.UTC
+	}
+	format, err := pickDateFormat(dates, opts.DateFormat)
+	if err != nil {
+		return nil, err
+	}
+	result.DateFormat = format.Name
+
+	now := time.Now()
+	for i, record := range records {
+		row := firstRow + i
+		if result.DateColumn >= len(record) || result.ValueColumn >= len(record) {
+			result.Errors = append(result.Errors, csvRowError{Row: row, Error: "missing columns"})
+			continue
+		}
+		date := strings.TrimSpace(record[result.DateColumn])
+		ts, err := time.ParseInLocation(format.Layout, date, location)
+		if err != nil {
+			result.Errors = append(result.Errors, csvRowError{
+				Row:   row,
+				Error: fmt.Sprintf("date %q isn't %s", date, format.Name),
+			})
+			continue
+		}
+		value, err := parseCSVNumber(record[result.ValueColumn])
+		if err != nil {
+			result.Errors = append(result.Errors, csvRowError{Row: row, Error: err.Error()})
+			continue
+		}
+		point := goalDataPoint{Timestamp: ts.UTC(), Value: value}
+		if err := validateGoalDataPoint(point, now); err != nil {
+			result.Errors = append(result.Errors, csvRowError{Row: row, Error: err.Error()})
+			continue
+		}
+		result.Points = append(result.Points, point)
+	}
+	sort.Stable(pointsByTime(result.Points))
+	return result, nil
+}
+
+func isCSVTitleLine(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || strings.HasPrefix(line, "Activity") || strings.HasPrefix(line, "Activities")
+}
+
+// detectDelimiter returns the delimiter that splits each of the first
+// lines into the same number of fields, preferring more fields. If none
+// do, it returns the one in the most lines. Delimiters in quotes aren't
+// counted. It returns 0 if none of them appear.
+func detectDelimiter(lines []string) rune {
+	sample := []string{}
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			sample = append(sample, line)
+		}
+		if len(sample) == 10 {
+			break
+		}
+	}
+	if len(sample) == 0 {
+		return 0
+	}
+
+	var best rune
+	bestCount := 0
+	for _, delimiter := range csvDelimiters {
+		count := countUnquoted(sample[0], delimiter)
+		for _, line := range sample[1:] {
+			if countUnquoted(line, delimiter) != count {
+				count = 0
+				break
+			}
+		}
+		if count > bestCount {
+			best, bestCount = delimiter, count
+		}
+	}
+	if best != 0 {
+		return best
+	}
+
+	bestLines := 0
+	for _, delimiter := range csvDelimiters {
+		linesWith := 0
+		for _, line := range sample {
+			if countUnquoted(line, delimiter) > 0 {
+				linesWith++
+			}
+		}
+		if linesWith > bestLines {
+			best, bestLines = delimiter, linesWith
+		}
+	}
+	return best
+}
+
+func countUnquoted(line string, delimiter rune) int {
+	count := 0
+	quoted := false
+	for _, c := range line {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case delimiter:
+			if !quoted {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// isCSVHeader returns true if the first record looks like column names:
+// no field is a date or a number.
+func isCSVHeader(record []string) bool {
+	for _, field := range record {
+		field = strings.TrimSpace(field)
+		if _, err := parseCSVNumber(field); err == nil {
+			return false
+		}
+		for _, format := range csvDateFormats {
+			if _, err := time.Parse(format.Layout, field); err == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// findColumn returns the index of the first header matching one of names,
+// or def.
+func findColumn(header []string, names []string, def int) int {
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		for _, name := range names {
+			if column == name {
+				return i
+			}
+		}
+	}
+	return def
+}
+
+// pickDateFormat returns the format named override, or the first format
+// that parses the most dates.
+func pickDateFormat(dates []string, override string) (csvDateFormat, error) {
+	if override != "" {
+		for _, format := range csvDateFormats {
+			if strings.EqualFold(format.Name, override) {
+				return format, nil
+			}
+		}
+		return csvDateFormat{}, fmt.Errorf("unknown date format %q", override)
+	}
+	best, bestCount := csvDateFormat{}, 0
+	for _, format := range csvDateFormats {
+		count := 0
+		for _, date := range dates {
+			if _, err := time.Parse(format.Layout, date); err == nil {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = format, count
+		}
+	}
+	if bestCount == 0 {
+		return best, errors.New("couldn't detect a date format")
+	}
+	return best, nil
+}
+
+func parseCSVNumber(field string) (float64, error) {
+	field = strings.TrimSpace(field)
+	if thousandsSeparated.MatchString(field) {
+		field = strings.Replace(field, ",", "", -1)
+	}
+	value, err := strconv.ParseFloat(field, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("value %q isn't a number", field)
+	}
+	return value, nil
+}
+
+// readImportBody reads at most maxImportBytes of r.
+func readImportBody(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxImportBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImportBytes {
+		return nil, errors.New("file too large")
+	}
+	return data, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDelimitedGoalData(t *testing.T) {
+	testCases := []struct {
+		name       string
+		data       string
+		opts       csvImportOptions
+		delimiter  string
+		dateFormat string
+		points     []goalDataPoint
+		errorRows  []int
+	}{
+		{
+			name:       "no header",
+			data:       "2018-01-02,5\n2018-01-01,4.5\n",
+			delimiter:  ",",
+			dateFormat: "YYYY-MM-DD",
+			points: []goalDataPoint{
+				{Timestamp: day(2018, 1, 1), Value: 4.5},
+				{Timestamp: day(2018, 1, 2), Value: 5},
+			},
+		},
+		{
+			name: "activity export",
+			data: "Activities\r\nDate,Calories Burned,Steps\r\n" +
+				"\"01/13/2018\",\"2,100\",\"10,250\"\r\n\"01/14/2018\",\"1,900\",\"8,001\"\r\n",
+			opts:       csvImportOptions{Column: "steps"},
+			delimiter:  ",",
+			dateFormat: "MM/DD/YYYY",
+			points: []goalDataPoint{
+				{Timestamp: day(2018, 1, 13), Value: 10250},
+				{Timestamp: day(2018, 1, 14), Value: 8001},
+			},
+		},
+		{
+			name:       "day first is detected",
+			data:       "Day;Weight\n02/01/2018;80\n13/01/2018;79\n",
+			delimiter:  ";",
+			dateFormat: "DD/MM/YYYY",
+			points: []goalDataPoint{
+				{Timestamp: day(2018, 1, 2), Value: 80},
+				{Timestamp: day(2018, 1, 13), Value: 79},
+			},
+		},
+		{
+			name:       "dates in the user's time zone",
+			data:       "date,value\n2018-01-01,1\n2018-01-02,2\n",
+			opts:       csvImportOptions{Location: time.FixedZone("UTC+9", 9*60*60)},
+			delimiter:  ",",
+			dateFormat: "YYYY-MM-DD",
+			points: []goalDataPoint{
+				{Timestamp: day(2017, 12, 31).Add(15 * time.Hour), Value: 1},
+				{Timestamp: day(2018, 1, 1).Add(15 * time.Hour), Value: 2},
+			},
+		},
+		{
+			name:       "tsv with value column and invalid rows",
+			data:       "note\tdate\tvalue\na\t2018-01-01\t1\nb\t2018-13-01\t2\nc\t2018-01-03\tNaN\nd\t2018-01-04\n",
+			opts:       csvImportOptions{Delimiter: '\t'},
+			delimiter:  "\t",
+			dateFormat: "YYYY-MM-DD",
+			points:     []goalDataPoint{{Timestamp: day(2018, 1, 1), Value: 1}},
+			errorRows:  []int{3, 4, 5},
+		},
+	}
+
+	for _, testCase := range testCases {
+		result, err := parseDelimitedGoalData([]byte(testCase.data), testCase.opts)
+		if err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+			continue
+		}
+		if result.Delimiter != testCase.delimiter {
+			t.Errorf("%s: expected delimiter %q, got %q", testCase.name, testCase.delimiter, result.Delimiter)
+		}
+		if result.DateFormat != testCase.dateFormat {
+			t.Errorf("%s: expected date format %s, got %s", testCase.name, testCase.dateFormat, result.DateFormat)
+		}
+		if !reflect.DeepEqual(result.Points, testCase.points) {
+			t.Errorf("%s: expected points %v, got %v", testCase.name, testCase.points, result.Points)
+		}
+		errorRows := []int{}
+		for _, rowErr := range result.Errors {
+			errorRows = append(errorRows, rowErr.Row)
+		}
+		if len(testCase.errorRows) == 0 {
+			testCase.errorRows = []int{}
+		}
+		if !reflect.DeepEqual(errorRows, testCase.errorRows) {
+			t.Errorf("%s: expected errors in rows %v, got %v", testCase.name, testCase.errorRows, result.Errors)
+		}
+	}
+
+	for _, invalid := range []struct {
+		data string
+		opts csvImportOptions
+	}{
+		{data: ""},
+		{data: "just some text\n"},
+		{data: "date,value\n2018-01-01,1\n", opts: csvImportOptions{Column: "missing"}},
+		{data: "date,value\n2018-01-01,1\n", opts: csvImportOptions{DateFormat: "unknown"}},
+	} {
+		if _, err := parseDelimitedGoalData([]byte(invalid.data), invalid.opts); err == nil {
+			t.Errorf("expected an error parsing %q with %+v", invalid.data, invalid.opts)
+		}
+	}
+}
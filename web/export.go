@@ -0,0 +1,382 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Preetam/siesta"
+	"github.com/Preetam/transverse/metadata/client"
+	"github.com/Preetam/transverse/metadata/middleware"
+	"github.com/Preetam/transverse/metadata/token"
+	log "github.com/Sirupsen/logrus"
+)
+
+// exportFormat is a file format goal data can be exported as.
+type exportFormat struct {
+	ContentType string
+	Extension   string
+	// Delimiter is zero for JSON Lines.
+	Delimiter rune
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv":   {"text/csv; charset=utf-8", "csv", ','},
+	"tsv":   {"text/tab-separated-values; charset=utf-8", "tsv", '\t'},
+	"jsonl": {"application/x-ndjson", "jsonl", 0},
+}
+
+// exportOptions are the options shared by the export endpoints.
+type exportOptions struct {
+	Format   exportFormat
+	Forecast bool
+	// DateFormat is nil to pick one based on the data.
+	DateFormat *csvDateFormat
+	// Location is the time zone dates are written in. nil means UTC.
+	Location *time.Location
+}
+
+// exportRow is a row of an export. Value is nil for forecast rows past the
+// end of the data, and the forecast fields are nil for rows before it.
+type exportRow struct {
+	Timestamp  time.Time
+	Value      *float64
+	Prediction *float64
+	Low        *float64
+	High       *float64
+}
+
+type exportJSONRow struct {
+	Date       string   `json:"date"`
+	Value      *float64 `json:"value"`
+	Prediction *float64 `json:"prediction,omitempty"`
+	Low        *float64 `json:"low,omitempty"`
+	High       *float64 `json:"high,omitempty"`
+}
+
+// parseExportOptions reads the format, forecast and date_format parameters.
+func parseExportOptions(format string, forecast bool, dateFormat string) (exportOptions, string) {
+	opts := exportOptions{Forecast: forecast}
+	var ok bool
+	opts.Format, ok = exportFormats[format]
+	if !ok {
+		return opts, "format must be csv, tsv or jsonl"
+	}
+	if dateFormat != "" {
+		for _, f := range csvDateFormats {
+			if strings.EqualFold(f.Name, dateFormat) {
+				f := f
+				opts.DateFormat = &f
+			}
+		}
+		if opts.DateFormat == nil {
+			return opts, "unknown date format " + strconv.Quote(dateFormat)
+		}
+	}
+	return opts, ""
+}
+
+// exportRows returns a goal's points, followed or joined by its forecast
+// if withForecast is set. The forecast's buckets are computed in loc.
+func exportRows(ctx context.Context, goal client.Goal, loc *time.Location, points []goalDataPoint, withForecast bool) []exportRow {
+	rows := []exportRow{}
+	index := map[int64]int{}
+	for _, p := range points {
+		value := p.Value
+		index[p.Timestamp.UnixNano()] = len(rows)
+		rows = append(rows, exportRow{Timestamp: p.Timestamp, Value: &value})
+	}
+	if !withForecast || len(points) == 0 {
+		return rows
+	}
+
+	forecast := getGoalDataInternal(ctx, goal, loc, points)
+	prediction := forecast["prediction"].([]forecastT)
+	low := forecast["low"].([]forecastT)
+	high := forecast["high"].([]forecastT)
+	for i := range prediction {
+		row := &exportRow{Timestamp: prediction[i].Timestamp}
+		if j, ok := index[row.Timestamp.UnixNano()]; ok {
+			row = &rows[j]
+		}
+		predicted := prediction[i].Value
+		row.Prediction = &predicted
+		if i < len(low) && i < len(high) {
+			l, h := low[i].Value, high[i].Value
+			row.Low, row.High = &l, &h
+		}
+		if _, ok := index[row.Timestamp.UnixNano()]; !ok {
+			index[row.Timestamp.UnixNano()] = len(rows)
+			rows = append(rows, *row)
+		}
+	}
+	return rows
+}
+
+// exportDateFormat picks a date only format if every row is at midnight
+// in loc, and RFC3339 otherwise.
+func exportDateFormat(rows []exportRow, loc *time.Location) csvDateFormat {
+	for _, row := range rows {
+		local := row.Timestamp.In(loc)
+		if local.Hour() != 0 || local.Minute() != 0 || local.Second() != 0 || local.Nanosecond() != 0 {
+			return csvDateFormats[0]
+		}
+	}
+	for _, format := range csvDateFormats {
+		if format.Name == "YYYY-MM-DD" {
+			return format
+		}
+	}
+	return csvDateFormats[0]
+}
+
+func writeExport(w io.Writer, rows []exportRow, opts exportOptions) error {
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	dateFormat := exportDateFormat(rows, loc)
+	if opts.DateFormat != nil {
+		dateFormat = *opts.DateFormat
+	}
+	formatDate := func(t time.Time) string {
+		return t.In(loc).Format(dateFormat.Output)
+	}
+
+	if opts.Format.Delimiter == 0 {
+		enc := json.NewEncoder(w)
+		for _, row := range rows {
+			err := enc.Encode(exportJSONRow{
+				Date:       formatDate(row.Timestamp),
+				Value:      row.Value,
+				Prediction: row.Prediction,
+				Low:        row.Low,
+				High:       row.High,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	formatValue := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Comma = opts.Format.Delimiter
+	header := []string{"date", "value"}
+	if opts.Forecast {
+		header = append(header, "prediction", "low", "high")
+	}
+	csvWriter.Write(header)
+	for _, row := range rows {
+		record := []string{formatDate(row.Timestamp), formatValue(row.Value)}
+		if opts.Forecast {
+			record = append(record, formatValue(row.Prediction), formatValue(row.Low), formatValue(row.High))
+		}
+		csvWriter.Write(record)
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// exportFileName returns a file name for a goal's export made from its
+// name and ID.
+func exportFileName(goal client.Goal, extension string) string {
+	slug := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		case r == ' ':
+			return '-'
+		}
+		return -1
+	}, goal.Name)
+	if slug == "" {
+		return goal.ID + "." + extension
+	}
+	return slug + "-" + goal.ID + "." + extension
+}
+
+// exportGoal returns a goal's export. Goals without data export as empty
+// files.
+func (api *API) exportGoal(ctx context.Context, goal client.Goal, opts exportOptions) ([]byte, error) {
+	points, err := api.series.Read(ctx, goal.ID, time.Time{}, time.Time{})
+	if err != nil && err != errDoesNotExist {
+		return nil, err
+	}
+	sort.Sort(pointsByTime(points))
+	buf := &bytes.Buffer{}
+	err = writeExport(buf, exportRows(ctx, goal, opts.Location, points, opts.Forecast), opts)
+	return buf.Bytes(), err
+}
+
+func setAttachment(w http.ResponseWriter, contentType string, fileName string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fileName,
+	}))
+}
+
+// ExportGoalData downloads a goal's data as CSV, TSV or JSON Lines.
+func (api *API) ExportGoalData(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
+
+	var params siesta.Params
+	goalID := params.String("goalID", "", "Goal ID")
+	format := params.String("format", "csv", "csv, tsv or jsonl")
+	withForecast := params.Bool("forecast", false, "Include prediction, low and high columns")
+	dateFormat := params.String("date_format", "", "Date format, e.g. DD/MM/YYYY")
+	err := params.Parse(r.Form)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	opts, errMessage := parseExportOptions(*format, *withForecast, *dateFormat)
+	if errMessage != "" {
+		requestData.ResponseError = errMessage
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	opts.Location = requestLocation(c)
+
+	goal, err := MetadataClient.GetGoal(r.Context(), *goalID)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
+		}
+		return
+	}
+
+	if goal.User != userTokenData.User {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusForbidden
+		return
+	}
+
+	data, err := api.exportGoal(r.Context(), goal, opts)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+	setAttachment(w, opts.Format.ContentType, exportFileName(goal, opts.Format.Extension))
+	requestData.RawResponse = func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+}
+
+// ExportGoals downloads a zip file with the data of each of the user's
+// goals, including archived ones, in the same formats as ExportGoalData.
+func (api *API) ExportGoals(c siesta.Context, w http.ResponseWriter, r *http.Request) {
+	requestData := c.Get(middleware.RequestDataKey).(*middleware.RequestData)
+	userTokenData := c.Get(UserContextKey).(*token.UserTokenData)
+
+	var params siesta.Params
+	format := params.String("format", "csv", "csv, tsv or jsonl")
+	withForecast := params.Bool("forecast", false, "Include prediction, low and high columns")
+	dateFormat := params.String("date_format", "", "Date format, e.g. DD/MM/YYYY")
+	err := params.Parse(r.Form)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	opts, errMessage := parseExportOptions(*format, *withForecast, *dateFormat)
+	if errMessage != "" {
+		requestData.ResponseError = errMessage
+		requestData.StatusCode = http.StatusBadRequest
+		return
+	}
+	opts.Location = requestLocation(c)
+
+	goals, err := MetadataClient.GetUserGoals(r.Context(), userTokenData.User, true)
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		if serverErr, ok := err.(*client.ServerError); ok {
+			requestData.StatusCode = serverErr.StatusCode
+		}
+		return
+	}
+	goalIDs := []string{}
+	for goalID, goal := range goals {
+		if goal.Deleted == 0 {
+			goalIDs = append(goalIDs, goalID)
+		}
+	}
+	sort.Strings(goalIDs)
+
+	// Build the zip before responding so errors still get a status code.
+	buf := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(buf)
+	for _, goalID := range goalIDs {
+		goal := goals[goalID]
+		data, err := api.exportGoal(r.Context(), goal, opts)
+		if err == nil {
+			var f io.Writer
+			f, err = zipWriter.CreateHeader(&zip.FileHeader{
+				Name:     exportFileName(goal, opts.Format.Extension),
+				Method:   zip.Deflate,
+				Modified: time.Unix(goal.Updated, 0),
+			})
+			if err == nil {
+				_, err = f.Write(data)
+			}
+		}
+		if err != nil {
+			log.Println(requestData.RequestID, err)
+			requestData.StatusCode = http.StatusInternalServerError
+			return
+		}
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		log.Println(requestData.RequestID, err)
+		requestData.StatusCode = http.StatusInternalServerError
+		return
+	}
+
+	setAttachment(w, "application/zip", "transverse-goals.zip")
+	requestData.RawResponse = func(w io.Writer) error {
+		_, err := buf.WriteTo(w)
+		return err
+	}
+}
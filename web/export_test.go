@@ -0,0 +1,112 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+func TestWriteExport(t *testing.T) {
+	points := []goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 1, 2), Value: 2.5},
+	}
+	rows := exportRows(context.Background(), client.Goal{}, time.UTC, points, false)
+
+	testCases := []struct {
+		format     string
+		dateFormat string
+		expected   string
+	}{
+		{"csv", "", "date,value\n2018-01-01,1\n2018-01-02,2.5\n"},
+		{"tsv", "DD/MM/YYYY", "date\tvalue\n01/01/2018\t1\n02/01/2018\t2.5\n"},
+		{"jsonl", "", `{"date":"2018-01-01","value":1}` + "\n" + `{"date":"2018-01-02","value":2.5}` + "\n"},
+	}
+	for _, testCase := range testCases {
+		opts, errMessage := parseExportOptions(testCase.format, false, testCase.dateFormat)
+		if errMessage != "" {
+			t.Fatal(errMessage)
+		}
+		buf := &bytes.Buffer{}
+		err := writeExport(buf, rows, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != testCase.expected {
+			t.Errorf("%s: expected %q, got %q", testCase.format, testCase.expected, buf.String())
+		}
+	}
+
+	// Times of day switch the default to RFC3339.
+	rows = exportRows(context.Background(), client.Goal{}, time.UTC, []goalDataPoint{
+		{Timestamp: day(2018, 1, 1).Add(90 * time.Minute), Value: 1},
+	}, false)
+	opts, _ := parseExportOptions("csv", false, "")
+	buf := &bytes.Buffer{}
+	writeExport(buf, rows, opts)
+	if expected := "date,value\n2018-01-01T01:30:00Z,1\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	if _, errMessage := parseExportOptions("xlsx", false, ""); errMessage == "" {
+		t.Error("expected an error for an unknown format")
+	}
+	if _, errMessage := parseExportOptions("csv", false, "YYYYMMDD"); errMessage == "" {
+		t.Error("expected an error for an unknown date format")
+	}
+}
+
+func TestExportRowsForecast(t *testing.T) {
+	points := []goalDataPoint{}
+	for i := 0; i < 30; i++ {
+		points = append(points, goalDataPoint{Timestamp: day(2018, 1, 1).AddDate(0, 0, i), Value: float64(i)})
+	}
+	rows := exportRows(context.Background(), client.Goal{Target: 1000}, time.UTC, points, true)
+	if len(rows) <= len(points) {
+		t.Fatalf("expected forecast rows after the data, got %d rows", len(rows))
+	}
+	// The forecast starts on the last day of data.
+	last := rows[len(points)-1]
+	if last.Value == nil || last.Prediction == nil {
+		t.Errorf("expected the last data row to have a prediction")
+	}
+	for _, row := range rows[len(points):] {
+		if row.Value != nil || row.Prediction == nil || row.Low == nil || row.High == nil {
+			t.Fatalf("unexpected forecast row %+v", row)
+		}
+		if !row.Timestamp.After(last.Timestamp) {
+			t.Fatalf("forecast row at %v isn't after the data", row.Timestamp)
+		}
+	}
+}
+
+func TestExportFileName(t *testing.T) {
+	name := exportFileName(client.Goal{ID: "abcd1234", Name: "Run 100 km!"}, "csv")
+	if name != "run-100-km-abcd1234.csv" {
+		t.Errorf("unexpected file name %q", name)
+	}
+	name = exportFileName(client.Goal{ID: "abcd1234", Name: "!!"}, "csv")
+	if name != "abcd1234.csv" {
+		t.Errorf("unexpected file name %q", name)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sync"
+
+	"github.com/Preetam/transverse/internal/forecast"
+	log "github.com/Sirupsen/logrus"
+)
+
+// forecastCachePrefix is where forecasts are stored in the object store.
+// Names under it have a "/", so garbage collection and restores leave
+// them alone.
+const forecastCachePrefix = "forecast-cache/"
+
+// forecasts caches forecasts for getGoalDataInternal. It's set in main;
+// nil disables caching.
+var forecasts *forecastCache
+
+// cachedForecast is a forecast of a goal's values, ending at the first
+// point past the target if there's an ETA.
+type cachedForecast struct {
+	// Key is the forecastCacheKey of the inputs.
+	Key     string                   `json:"key"`
+	Model   string                   `json:"model"`
+	Version int                      `json:"version"`
+	Points  []forecast.ForecastPoint `json:"points"`
+	ETA     int                      `json:"eta"`
+	HaveETA bool                     `json:"have_eta"`
+}
+
+// forecastCache keeps recent forecasts in memory, up to maxEntries, and
+// in the object store if os is set. Forecasts are looked up by a hash of
+// everything that goes into them, so a change to a goal's data, target or
+// model misses the cache without being invalidated. Writes to goals still
+// invalidate them so stale forecasts don't linger in the object store.
+//
+// The object store keeps one forecast per goal and model, so a forecast
+// survives restarts and is shared between web processes until the goal
+// changes.
+type forecastCache struct {
+	os         ObjectStore
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// lru holds *forecastCacheEntry values from most to least recently
+	// used.
+	lru *list.List
+}
+
+type forecastCacheEntry struct {
+	goalID   string
+	forecast cachedForecast
+}
+
+// newForecastCache returns a cache of up to maxEntries forecasts in
+// memory, also stored in os unless it's nil.
+func newForecastCache(os ObjectStore, maxEntries int) *forecastCache {
+	return &forecastCache{
+		os:         os,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// forecastCacheKey returns a hash of a forecast's inputs.
+func forecastCacheKey(model string, version int, target float64, values []float64) string {
+	hash := sha256.New()
+	hash.Write([]byte(model))
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(version))
+	hash.Write(buf)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(target))
+	hash.Write(buf)
+	for _, v := range values {
+		binary.BigEndian.PutUint64(buf, math.Float64bits(v))
+		hash.Write(buf)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func forecastCacheObject(goalID, model string) string {
+	return forecastCachePrefix + goalID + "/" + model
+}
+
+// get returns the forecast for key, checking the object store if it isn't
+// in memory.
+func (c *forecastCache) get(ctx context.Context, goalID, model, key string) (cachedForecast, bool) {
+	if c == nil {
+		return cachedForecast{}, false
+	}
+	c.lock.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		f := elem.Value.(*forecastCacheEntry).forecast
+		c.lock.Unlock()
+		return f, true
+	}
+	c.lock.Unlock()
+
+	if c.os == nil || goalID == "" {
+		return cachedForecast{}, false
+	}
+	reader, _, err := c.os.GetObject(ctx, forecastCacheObject(goalID, model))
+	if err != nil {
+		if err != errDoesNotExist {
+			log.Println("forecast cache:", err)
+		}
+		return cachedForecast{}, false
+	}
+	defer reader.Close()
+	f := cachedForecast{}
+	err = json.NewDecoder(reader).Decode(&f)
+	if err != nil || f.Key != key {
+		return cachedForecast{}, false
+	}
+	c.add(goalID, f)
+	return f, true
+}
+
+// set caches a forecast of a goal.
+func (c *forecastCache) set(ctx context.Context, goalID string, f cachedForecast) {
+	if c == nil {
+		return
+	}
+	c.add(goalID, f)
+	if c.os == nil || goalID == "" {
+		return
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		// Forecasts of values that aren't finite can't be stored.
+		return
+	}
+	err = c.os.PutObject(ctx, forecastCacheObject(goalID, f.Model), bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		log.Println("forecast cache:", err)
+	}
+}
+
+func (c *forecastCache) add(goalID string, f cachedForecast) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[f.Key]; ok {
+		c.remove(elem)
+	}
+	c.entries[f.Key] = c.lru.PushFront(&forecastCacheEntry{goalID: goalID, forecast: f})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes a goal's forecasts.
+func (c *forecastCache) invalidate(ctx context.Context, goalID string) {
+	if c == nil || goalID == "" {
+		return
+	}
+	c.lock.Lock()
+	for _, elem := range c.entries {
+		if elem.Value.(*forecastCacheEntry).goalID == goalID {
+			c.remove(elem)
+		}
+	}
+	c.lock.Unlock()
+
+	if c.os == nil {
+		return
+	}
+	for _, model := range forecast.Models() {
+		err := c.os.DeleteObject(ctx, forecastCacheObject(goalID, model))
+		if err != nil && err != errDoesNotExist {
+			log.Println("forecast cache:", err)
+		}
+	}
+}
+
+// remove must be called with the lock held.
+func (c *forecastCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*forecastCacheEntry).forecast.Key)
+}
@@ -0,0 +1,104 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+func TestForecastCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forecastcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	counting := &countingObjectStore{ObjectStore: &fileObjectStore{basePath: dir}}
+	forecasts = newForecastCache(counting, 2)
+	defer func() { forecasts = nil }()
+
+	points := []goalDataPoint{}
+	for i := 0; i < 10; i++ {
+		points = append(points, goalDataPoint{Timestamp: day(2018, 1, 1).AddDate(0, 0, i), Value: float64(i)})
+	}
+	goal := client.Goal{ID: "goal", Target: 15}
+	object := forecastCacheObject(goal.ID, defaultForecastModel)
+
+	expected := getGoalDataInternal(ctx, goal, time.UTC, points)
+	if !reflect.DeepEqual(counting.puts, []string{object}) {
+		t.Fatalf("expected the forecast to be stored, got puts %v", counting.puts)
+	}
+	if _, ok := expected["eta"]; !ok {
+		t.Fatal("expected an ETA")
+	}
+
+	counting.reset()
+	if resp := getGoalDataInternal(ctx, goal, time.UTC, points); !reflect.DeepEqual(resp, expected) {
+		t.Errorf("expected %v from memory, got %v", expected, resp)
+	}
+	if len(counting.gets) != 0 || len(counting.puts) != 0 {
+		t.Errorf("expected a memory hit, got gets %v and puts %v", counting.gets, counting.puts)
+	}
+
+	// Another process reads the stored forecast.
+	forecasts = newForecastCache(counting, 2)
+	counting.reset()
+	if resp := getGoalDataInternal(ctx, goal, time.UTC, points); !reflect.DeepEqual(resp, expected) {
+		t.Errorf("expected %v from the object store, got %v", expected, resp)
+	}
+	if !reflect.DeepEqual(counting.gets, []string{object}) || len(counting.puts) != 0 {
+		t.Errorf("expected an object store hit, got gets %v and puts %v", counting.gets, counting.puts)
+	}
+
+	// Changing the data or the target misses the cache.
+	counting.reset()
+	changed := append([]goalDataPoint{}, points...)
+	changed[9].Value = 12
+	getGoalDataInternal(ctx, goal, time.UTC, changed)
+	goal.Target = 30
+	getGoalDataInternal(ctx, goal, time.UTC, changed)
+	if len(counting.puts) != 2 {
+		t.Errorf("expected 2 new forecasts, got puts %v", counting.puts)
+	}
+	if forecasts.lru.Len() != 2 {
+		t.Errorf("expected 2 forecasts in memory, got %d", forecasts.lru.Len())
+	}
+
+	forecasts.invalidate(ctx, goal.ID)
+	if forecasts.lru.Len() != 0 {
+		t.Errorf("expected no forecasts in memory, got %d", forecasts.lru.Len())
+	}
+	if _, _, err := counting.GetObject(ctx, object); err != errDoesNotExist {
+		t.Errorf("expected the stored forecast to be deleted, got %v", err)
+	}
+
+	// Goals without an ID, like in exports of archives, are only cached
+	// in memory.
+	counting.reset()
+	getGoalDataInternal(ctx, client.Goal{Target: 15}, time.UTC, points)
+	if len(counting.puts) != 0 {
+		t.Errorf("expected nothing stored, got puts %v", counting.puts)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+	log "github.com/Sirupsen/logrus"
+)
+
+// gcBatchSize is the number of goals looked up in metadata at once.
+const gcBatchSize = 500
+
+// goalGetter looks up goals in metadata.
+type goalGetter interface {
+	GetGoals(ctx context.Context, ids []string) (client.GoalBatch, error)
+}
+
+// garbageCollector deletes goal data objects that nothing refers to:
+// objects for goals that were deleted or no longer exist in metadata,
+// chunks that aren't in any kept revision of their goal's manifest, and
+// single object goal data that has already been migrated to chunks.
+//
+// Only objects that haven't been modified for the grace period are
+// deleted, so objects being written by in-progress requests are left
+// alone. Objects with a "/" in their name aren't goal data and are
+// ignored.
+type garbageCollector struct {
+	os     ObjectStore
+	series *goalSeriesStore
+	goals  goalGetter
+	grace  time.Duration
+	dryRun bool
+}
+
+type orphanedObject struct {
+	objectInfo
+	Goal   string
+	Reason string
+}
+
+type gcReport struct {
+	Objects int
+	Orphans []orphanedObject
+	Bytes   int64
+	Deleted int
+}
+
+// goalIDForObject returns the ID of the goal an object belongs to.
+func goalIDForObject(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// Run finds orphaned objects and deletes them unless gc.dryRun is set.
+func (gc *garbageCollector) Run(ctx context.Context) (gcReport, error) {
+	report := gcReport{}
+	objects, err := gc.os.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+
+	objectsByGoal := map[string][]objectInfo{}
+	goalIDs := []string{}
+	for _, object := range objects {
+		if strings.Contains(object.Name, "/") {
+			continue
+		}
+		report.Objects++
+		goalID := goalIDForObject(object.Name)
+		if _, ok := objectsByGoal[goalID]; !ok {
+			goalIDs = append(goalIDs, goalID)
+		}
+		objectsByGoal[goalID] = append(objectsByGoal[goalID], object)
+	}
+
+	cutoff := time.Now().Add(-gc.grace)
+	for start := 0; start < len(goalIDs); start += gcBatchSize {
+		end := start + gcBatchSize
+		if end > len(goalIDs) {
+			end = len(goalIDs)
+		}
+		batch, err := gc.goals.GetGoals(ctx, goalIDs[start:end])
+		if err != nil {
+			return report, err
+		}
+		for _, goalID := range goalIDs[start:end] {
+			orphans, err := gc.orphans(ctx, goalID, batch.Goals[goalID], objectsByGoal[goalID])
+			if err != nil {
+				return report, err
+			}
+			for _, orphan := range orphans {
+				if orphan.Modified.After(cutoff) {
+					continue
+				}
+				report.Orphans = append(report.Orphans, orphan)
+				report.Bytes += orphan.Size
+			}
+		}
+	}
+
+	for _, orphan := range report.Orphans {
+		log.WithFields(map[string]interface{}{
+			"object":   orphan.Name,
+			"goal":     orphan.Goal,
+			"size":     orphan.Size,
+			"modified": orphan.Modified,
+			"reason":   orphan.Reason,
+			"dry_run":  gc.dryRun,
+		}).Println("gc: orphaned object")
+		if gc.dryRun {
+			continue
+		}
+		err := gc.os.DeleteObject(ctx, orphan.Name)
+		if err != nil && err != errDoesNotExist {
+			return report, err
+		}
+		report.Deleted++
+	}
+	return report, nil
+}
+
+// orphans returns a goal's objects that nothing refers to. goal is the
+// zero Goal if it doesn't exist.
+func (gc *garbageCollector) orphans(ctx context.Context, goalID string, goal client.Goal, objects []objectInfo) ([]orphanedObject, error) {
+	orphans := []orphanedObject{}
+	orphan := func(object objectInfo, reason string) {
+		orphans = append(orphans, orphanedObject{objectInfo: object, Goal: goalID, Reason: reason})
+	}
+
+	if goal.ID == "" || goal.Deleted != 0 {
+		reason := "goal does not exist"
+		if goal.Deleted != 0 {
+			reason = "goal deleted"
+		}
+		for _, object := range objects {
+			orphan(object, reason)
+		}
+		return orphans, nil
+	}
+
+	manifest, _, err := gc.series.loadManifest(ctx, goalID)
+	if err == errDoesNotExist {
+		// Not migrated yet, so there aren't any chunks to check.
+		return orphans, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	referenced := manifest.objects()
+	for _, object := range objects {
+		switch {
+		case object.Name == manifestObjectName(goalID) || referenced[object.Name]:
+		case object.Name == goalID:
+			orphan(object, "already migrated to chunks")
+		default:
+			orphan(object, "chunk not in manifest")
+		}
+	}
+	return orphans, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+type fakeGoals map[string]client.Goal
+
+func (goals fakeGoals) GetGoals(ctx context.Context, ids []string) (client.GoalBatch, error) {
+	batch := client.GoalBatch{Goals: map[string]client.Goal{}}
+	for _, id := range ids {
+		if goal, ok := goals[id]; ok {
+			batch.Goals[id] = goal
+		} else {
+			batch.NotFound = append(batch.NotFound, id)
+		}
+	}
+	return batch, nil
+}
+
+func TestGarbageCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	objectStore := &fileObjectStore{basePath: dir}
+	series := newGoalSeriesStore(objectStore)
+
+	put := func(name string) {
+		err := objectStore.PutObject(ctx, name, bytes.NewReader([]byte("[]")), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = series.Replace(ctx, "live", []goalDataPoint{{Timestamp: day(2018, 1, 1), Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("live")
+	put("live.2018.5.leaked")
+	put("deleted")
+	put("missing.manifest")
+	put("recent")
+	put("backups/unrelated")
+
+	// Everything but "recent" is outside the grace period.
+	old := time.Now().Add(-48 * time.Hour)
+	objects, err := objectStore.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		if object.Name != "recent" {
+			os.Chtimes(filepath.Join(dir, filepath.FromSlash(object.Name)), old, old)
+		}
+	}
+
+	gc := &garbageCollector{
+		os:     objectStore,
+		series: series,
+		goals: fakeGoals{
+			"live":    {ID: "live"},
+			"deleted": {ID: "deleted", Deleted: 1},
+		},
+		grace:  24 * time.Hour,
+		dryRun: true,
+	}
+	report, err := gc.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans := []string{}
+	for _, orphan := range report.Orphans {
+		orphans = append(orphans, orphan.Name)
+	}
+	sort.Strings(orphans)
+	expected := []string{"deleted", "live", "live.2018.5.leaked", "missing.manifest"}
+	if len(orphans) != len(expected) {
+		t.Fatalf("expected orphans %v, got %v", expected, orphans)
+	}
+	for i := range expected {
+		if orphans[i] != expected[i] {
+			t.Fatalf("expected orphans %v, got %v", expected, orphans)
+		}
+	}
+	if report.Deleted != 0 {
+		t.Errorf("expected a dry run to delete nothing, deleted %d", report.Deleted)
+	}
+
+	gc.dryRun = false
+	report, err = gc.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != len(expected) {
+		t.Errorf("expected %d deleted, got %d", len(expected), report.Deleted)
+	}
+	points, err := series.Read(ctx, "live", time.Time{}, time.Time{})
+	if err != nil || len(points) != 1 {
+		t.Errorf("expected live goal data to be kept, got %v %v", points, err)
+	}
+	if _, _, err := objectStore.GetObject(ctx, "backups/unrelated"); err != nil {
+		t.Errorf("expected unrelated object to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	patchOpUpsert      = "upsert"
+	patchOpDelete      = "delete"
+	patchOpDeleteRange = "delete_range"
+)
+
+// maxPatchOperations is the maximum number of operations in a patch.
+const maxPatchOperations = 1000
+
+// goalDataPatch is a list of changes to a goal's data, applied in order.
+type goalDataPatch struct {
+	Operations []goalDataOperation `json:"operations"`
+}
+
+// goalDataOperation is one change in a patch.
+//
+//	upsert        sets the value of each of Points, adding any that don't
+//	              exist
+//	delete        removes the points at Timestamps, if they exist
+//	delete_range  removes the points between Start and End, inclusive. A
+//	              zero Start or End leaves that side of the range open.
+//
+// Points and Timestamps are moved to the start of their bucket at the
+// goal's resolution by normalize, so Timestamps match the point in their
+// bucket.
+type goalDataOperation struct {
+	Op         string          `json:"op"`
+	Points     []goalDataPoint `json:"points,omitempty"`
+	Timestamps []time.Time     `json:"timestamps,omitempty"`
+	Start      time.Time       `json:"start"`
+	End        time.Time       `json:"end"`
+}
+
+// validate checks the patch and returns the years it changes, or nil if
+// it can change any year.
+func (patch goalDataPatch) validate() ([]int, error) {
+	if len(patch.Operations) == 0 {
+		return nil, errors.New("no operations")
+	}
+	if len(patch.Operations) > maxPatchOperations {
+		return nil, errors.New("too many operations")
+	}
+	seen := map[int]bool{}
+	years := []int{}
+	addYear := func(t time.Time) {
+		year := t.UTC().Year()
+		if !seen[year] {
+			seen[year] = true
+			years = append(years, year)
+		}
+	}
+	anyYear := false
+	now := time.Now()
+	for i, op := range patch.Operations {
+		switch op.Op {
+		case patchOpUpsert:
+			for j, p := range op.Points {
+				if err := validateGoalDataPoint(p, now); err != nil {
+					return nil, fmt.Errorf("operation %d, point %d: %v", i, j, err)
+				}
+				addYear(p.Timestamp)
+			}
+		case patchOpDelete:
+			for _, ts := range op.Timestamps {
+				addYear(ts)
+			}
+		case patchOpDeleteRange:
+			if !op.Start.IsZero() && !op.End.IsZero() && op.End.Before(op.Start) {
+				return nil, fmt.Errorf("operation %d: end is before start", i)
+			}
+			anyYear = true
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+	}
+	if anyYear {
+		return nil, nil
+	}
+	return years, nil
+}
+
+// normalize buckets the points and timestamps of each operation, and
+// combines upserted points in the same bucket using the duplicate policy.
+func (patch goalDataPatch) normalize(b bucketing, policy string) {
+	for i, op := range patch.Operations {
+		switch op.Op {
+		case patchOpUpsert:
+			patch.Operations[i].Points = normalizeGoalData(op.Points, b, policy)
+		case patchOpDelete:
+			for j, ts := range op.Timestamps {
+				op.Timestamps[j] = b.start(ts)
+			}
+		}
+	}
+}
+
+// apply applies the patch to points and returns the result, which isn't
+// sorted.
+func (patch goalDataPatch) apply(points []goalDataPoint) []goalDataPoint {
+	index := map[int64]int{}
+	for i, p := range points {
+		index[p.Timestamp.UnixNano()] = i
+	}
+	removed := map[int64]bool{}
+	for _, op := range patch.Operations {
+		switch op.Op {
+		case patchOpUpsert:
+			for _, p := range op.Points {
+				p.Timestamp = p.Timestamp.UTC()
+				key := p.Timestamp.UnixNano()
+				delete(removed, key)
+				if i, ok := index[key]; ok {
+					points[i] = p
+					continue
+				}
+				index[key] = len(points)
+				points = append(points, p)
+			}
+		case patchOpDelete:
+			for _, ts := range op.Timestamps {
+				if _, ok := index[ts.UnixNano()]; ok {
+					removed[ts.UnixNano()] = true
+				}
+			}
+		case patchOpDeleteRange:
+			for _, p := range pointsInRange(points, op.Start, op.End) {
+				removed[p.Timestamp.UnixNano()] = true
+			}
+		}
+	}
+
+	result := points[:0]
+	for _, p := range points {
+		if !removed[p.Timestamp.UnixNano()] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
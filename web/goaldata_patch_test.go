@@ -0,0 +1,124 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGoalDataPatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	series := newGoalSeriesStore(&fileObjectStore{basePath: dir})
+
+	err = series.Replace(ctx, "g", []goalDataPoint{
+		{Timestamp: day(2017, 12, 30), Value: 1},
+		{Timestamp: day(2017, 12, 31), Value: 2},
+		{Timestamp: day(2018, 1, 1), Value: 3},
+		{Timestamp: day(2018, 1, 2), Value: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := goalDataPatch{Operations: []goalDataOperation{
+		{Op: patchOpUpsert, Points: []goalDataPoint{
+			{Timestamp: day(2018, 1, 1), Value: 30},
+			{Timestamp: day(2018, 1, 3), Value: 5},
+		}},
+		{Op: patchOpDelete, Timestamps: []time.Time{day(2018, 1, 2), day(2018, 6, 1)}},
+	}}
+	years, err := patch.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(years, []int{2018}) {
+		t.Errorf("expected only 2018 to change, got %v", years)
+	}
+	err = series.Update(ctx, "g", years, func(points []goalDataPoint) ([]goalDataPoint, error) {
+		return patch.apply(points), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := series.Read(ctx, "g", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []goalDataPoint{
+		{Timestamp: day(2017, 12, 30), Value: 1},
+		{Timestamp: day(2017, 12, 31), Value: 2},
+		{Timestamp: day(2018, 1, 1), Value: 30},
+		{Timestamp: day(2018, 1, 3), Value: 5},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected %v, got %v", expected, points)
+	}
+
+	// Ranges can span years, and a later upsert brings a point back.
+	patch = goalDataPatch{Operations: []goalDataOperation{
+		{Op: patchOpDeleteRange, Start: day(2017, 12, 31), End: day(2018, 1, 1)},
+		{Op: patchOpUpsert, Points: []goalDataPoint{{Timestamp: day(2018, 1, 1), Value: 7}}},
+	}}
+	years, err = patch.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if years != nil {
+		t.Errorf("expected a range to change any year, got %v", years)
+	}
+	err = series.Update(ctx, "g", years, func(points []goalDataPoint) ([]goalDataPoint, error) {
+		return patch.apply(points), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := series.Stats(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Points != 3 || !stats.Start.Equal(day(2017, 12, 30)) || !stats.End.Equal(day(2018, 1, 3)) {
+		t.Errorf("unexpected stats %d %v %v", stats.Points, stats.Start, stats.End)
+	}
+
+	stats, err = series.Stats(ctx, "missing")
+	if err != nil || stats.Points != 0 || stats.Start != nil {
+		t.Errorf("unexpected stats %+v for a goal without data, error %v", stats, err)
+	}
+
+	for _, invalid := range []goalDataPatch{
+		{},
+		{Operations: []goalDataOperation{{Op: "replace"}}},
+		{Operations: []goalDataOperation{{Op: patchOpDeleteRange, Start: day(2018, 2, 1), End: day(2018, 1, 1)}}},
+	} {
+		if _, err := invalid.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", invalid)
+		}
+	}
+}
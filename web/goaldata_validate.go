@@ -0,0 +1,120 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// maxGoalDataFuture is how far in the future points may be.
+const maxGoalDataFuture = 366 * 24 * time.Hour
+
+// minGoalDataTime is the earliest time points may have. Day numbering
+// assumes points aren't before the Unix epoch.
+var minGoalDataTime = time.Unix(0, 0).UTC()
+
+var (
+	errNonFiniteValue = errors.New("value must be a finite number")
+	errTimeTooEarly   = errors.New("timestamp is before 1970")
+	errTimeTooLate    = errors.New("timestamp is more than a year in the future")
+)
+
+// Duplicate policies for client.Goal.Duplicates.
+const (
+	duplicatesLast = "last"
+	duplicatesSum  = "sum"
+	duplicatesMean = "mean"
+	duplicatesMax  = "max"
+)
+
+// goalDataPointError is a problem with a posted point. Index is the
+// point's position in the request.
+type goalDataPointError struct {
+	Index     int       `json:"index"`
+	Timestamp time.Time `json:"ts"`
+	Error     string    `json:"error"`
+}
+
+// validateGoalDataPoint returns an error if a point's value isn't finite
+// or its timestamp is absurd.
+func validateGoalDataPoint(p goalDataPoint, now time.Time) error {
+	if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+		return errNonFiniteValue
+	}
+	if p.Timestamp.Before(minGoalDataTime) {
+		return errTimeTooEarly
+	}
+	if p.Timestamp.After(now.Add(maxGoalDataFuture)) {
+		return errTimeTooLate
+	}
+	return nil
+}
+
+// validateGoalData returns the errors for each invalid point.
+func validateGoalData(points []goalDataPoint, now time.Time) []goalDataPointError {
+	errs := []goalDataPointError{}
+	for i, p := range points {
+		if err := validateGoalDataPoint(p, now); err != nil {
+			errs = append(errs, goalDataPointError{Index: i, Timestamp: p.Timestamp, Error: err.Error()})
+		}
+	}
+	return errs
+}
+
+func validDuplicatePolicy(policy string) bool {
+	switch policy {
+	case "", duplicatesLast, duplicatesSum, duplicatesMean, duplicatesMax:
+		return true
+	}
+	return false
+}
+
+// resolveDuplicates combines points with the same timestamp using policy.
+// points must be sorted by time, keeping the order they were posted in
+// for equal timestamps, so "last" means the last one posted.
+func resolveDuplicates(points []goalDataPoint, policy string) []goalDataPoint {
+	result := []goalDataPoint{}
+	for start := 0; start < len(points); {
+		end := start + 1
+		for end < len(points) && points[end].Timestamp.Equal(points[start].Timestamp) {
+			end++
+		}
+		group := points[start:end]
+		p := group[len(group)-1]
+		switch policy {
+		case duplicatesSum, duplicatesMean:
+			total := 0.0
+			for _, g := range group {
+				total += g.Value
+			}
+			p.Value = total
+			if policy == duplicatesMean {
+				p.Value = total / float64(len(group))
+			}
+		case duplicatesMax:
+			for _, g := range group {
+				p.Value = math.Max(p.Value, g.Value)
+			}
+		}
+		result = append(result, p)
+		start = end
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+func TestValidateGoalData(t *testing.T) {
+	now := day(2018, 6, 1)
+	errs := validateGoalData([]goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 1, 2), Value: math.NaN()},
+		{Timestamp: day(2018, 1, 3), Value: math.Inf(-1)},
+		{Timestamp: day(1969, 12, 31), Value: 1},
+		{Timestamp: day(2019, 6, 3), Value: 1},
+		{Timestamp: day(2019, 6, 1), Value: 1},
+	}, now)
+	indexes := []int{}
+	for _, err := range errs {
+		indexes = append(indexes, err.Index)
+	}
+	if !reflect.DeepEqual(indexes, []int{1, 2, 3, 4}) {
+		t.Errorf("unexpected errors %+v", errs)
+	}
+}
+
+func TestResolveDuplicates(t *testing.T) {
+	points := []goalDataPoint{
+		{Timestamp: day(2018, 1, 2), Value: 5},
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 1, 2), Value: 1},
+		{Timestamp: day(2018, 1, 2), Value: 3},
+	}
+	sort.Stable(pointsByTime(points))
+	expected := map[string]float64{
+		"":             3,
+		duplicatesLast: 3,
+		duplicatesSum:  9,
+		duplicatesMean: 3,
+		duplicatesMax:  5,
+	}
+	for policy, value := range expected {
+		resolved := resolveDuplicates(points, policy)
+		want := []goalDataPoint{
+			{Timestamp: day(2018, 1, 1), Value: 1},
+			{Timestamp: day(2018, 1, 2), Value: value},
+		}
+		if !reflect.DeepEqual(resolved, want) {
+			t.Errorf("%q: expected %v, got %v", policy, want, resolved)
+		}
+	}
+	if validDuplicatePolicy("min") {
+		t.Error("expected min to be invalid")
+	}
+}
+
+func TestFillGaps(t *testing.T) {
+	if points := fillGaps(nil, goalBucketing(client.Goal{}, time.UTC)); len(points) != 0 {
+		t.Errorf("expected no points, got %v", points)
+	}
+	points := fillGaps([]goalDataPoint{
+		{Timestamp: day(2018, 1, 4), Value: 4},
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 1, 1).Add(time.Hour), Value: 10},
+	}, goalBucketing(client.Goal{}, time.UTC))
+	expected := []goalDataPoint{
+		{Timestamp: day(2018, 1, 1).Add(time.Hour), Value: 10},
+		{Timestamp: day(2018, 1, 2).Add(time.Hour), Value: 8},
+		{Timestamp: day(2018, 1, 3).Add(time.Hour), Value: 6},
+		{Timestamp: day(2018, 1, 4), Value: 4},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected %v, got %v", expected, points)
+	}
+}
+
+func TestGetGoalDataInternalDegenerate(t *testing.T) {
+	ctx := context.Background()
+	for _, points := range [][]goalDataPoint{
+		nil,
+		{{Timestamp: day(2018, 1, 1), Value: math.NaN()}},
+		{{Timestamp: day(2018, 1, 1), Value: 1}},
+		{{Timestamp: day(2018, 1, 1), Value: 1}, {Timestamp: day(2018, 1, 1), Value: 2}},
+	} {
+		getGoalDataInternal(ctx, client.Goal{Target: 10}, time.UTC, points)
+	}
+}
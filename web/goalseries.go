@@ -0,0 +1,698 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Goal data is stored as a manifest object named "<goal ID>.manifest"
+// listing one chunk object per year. Chunks are JSON arrays of points,
+// like the original format, and are immutable: a write puts new chunk
+// objects for the years it changes and then commits them by conditionally
+// writing the manifest. Chunk names include a random write ID so writers
+// racing to commit the same generation never touch each other's chunks.
+// Goals still stored as a single "<goal ID>" object are migrated on their
+// first write.
+//
+// The manifest also keeps previous revisions of the series, which share
+// chunk objects with each other and the current revision. A chunk object
+// is deleted once no kept revision refers to it. This works the same way on
+// every ObjectStore, so it doesn't depend on S3 bucket versioning.
+
+const seriesManifestFormat = 1
+
+// maxGoalDataAttempts is the number of times an update is attempted
+// when it races with other updates to the same goal.
+const maxGoalDataAttempts = 5
+
+const (
+	defaultMaxSeriesRevisions   = 20
+	defaultMaxSeriesRevisionAge = 30 * 24 * time.Hour
+)
+
+var errRevisionNotFound = errors.New("revision not found")
+
+type seriesManifest struct {
+	Format int `json:"format"`
+	// Generation is incremented by each commit and is used to name
+	// new chunk objects.
+	Generation int64         `json:"generation"`
+	Updated    int64         `json:"updated"`
+	Chunks     []seriesChunk `json:"chunks"`
+	// Revisions holds previous revisions, newest first.
+	Revisions []seriesRevision `json:"revisions,omitempty"`
+}
+
+type seriesRevision struct {
+	Generation int64 `json:"generation"`
+	Updated    int64 `json:"updated"`
+	// Replaced is when the revision stopped being current.
+	Replaced int64         `json:"replaced"`
+	Chunks   []seriesChunk `json:"chunks"`
+}
+
+type seriesChunk struct {
+	Year   int    `json:"year"`
+	Object string `json:"object"`
+	Points int    `json:"points"`
+}
+
+// goalSeriesRevision describes a revision of a goal's data.
+type goalSeriesRevision struct {
+	Revision int64 `json:"revision"`
+	Updated  int64 `json:"updated"`
+	Points   int   `json:"points"`
+	Current  bool  `json:"current"`
+}
+
+// goalSeriesStore reads and writes goal data in an ObjectStore.
+type goalSeriesStore struct {
+	os ObjectStore
+
+	maxRevisions   int
+	maxRevisionAge time.Duration
+}
+
+func newGoalSeriesStore(os ObjectStore) *goalSeriesStore {
+	return &goalSeriesStore{
+		os:             os,
+		maxRevisions:   defaultMaxSeriesRevisions,
+		maxRevisionAge: defaultMaxSeriesRevisionAge,
+	}
+}
+
+// SetRevisionLimits sets how many previous revisions are kept for each
+// goal, and for how long after they're replaced.
+func (s *goalSeriesStore) SetRevisionLimits(count int, age time.Duration) {
+	s.maxRevisions = count
+	s.maxRevisionAge = age
+}
+
+func manifestObjectName(goalID string) string {
+	return goalID + ".manifest"
+}
+
+func chunkObjectName(goalID string, year int, generation int64, writeID string) string {
+	return fmt.Sprintf("%s.%d.%d.%s", goalID, year, generation, writeID)
+}
+
+// objects returns the chunk objects referenced by any revision.
+func (m *seriesManifest) objects() map[string]bool {
+	objects := map[string]bool{}
+	for _, chunk := range m.Chunks {
+		objects[chunk.Object] = true
+	}
+	for _, revision := range m.Revisions {
+		for _, chunk := range revision.Chunks {
+			objects[chunk.Object] = true
+		}
+	}
+	return objects
+}
+
+func countPoints(chunks []seriesChunk) int {
+	points := 0
+	for _, chunk := range chunks {
+		points += chunk.Points
+	}
+	return points
+}
+
+// chunkFor returns the chunk for year, or nil if there isn't one.
+func (m *seriesManifest) chunkFor(year int) *seriesChunk {
+	for i := range m.Chunks {
+		if m.Chunks[i].Year == year {
+			return &m.Chunks[i]
+		}
+	}
+	return nil
+}
+
+// Read returns a goal's points between start and end, inclusive, in time
+// order. A zero start or end leaves that side of the range open. It
+// returns errDoesNotExist if the goal has no data.
+func (s *goalSeriesStore) Read(ctx context.Context, goalID string, start, end time.Time) ([]goalDataPoint, error) {
+	var err error
+	for attempt := 0; attempt < maxGoalDataAttempts; attempt++ {
+		var points []goalDataPoint
+		points, err = s.read(ctx, goalID, start, end)
+		if err != errPreconditionFailed {
+			return points, err
+		}
+	}
+	return nil, err
+}
+
+func (s *goalSeriesStore) read(ctx context.Context, goalID string, start, end time.Time) ([]goalDataPoint, error) {
+	manifest, _, err := s.loadManifest(ctx, goalID)
+	if err == errDoesNotExist {
+		points, _, err := s.readLegacy(ctx, goalID)
+		if err != nil {
+			return nil, err
+		}
+		return pointsInRange(points, start, end), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	points := []goalDataPoint{}
+	for _, chunk := range manifest.Chunks {
+		if (!start.IsZero() && chunk.Year < start.UTC().Year()) ||
+			(!end.IsZero() && chunk.Year > end.UTC().Year()) {
+			continue
+		}
+		chunkPoints, _, err := s.readObject(ctx, chunk.Object)
+		if err == errDoesNotExist {
+			// Replaced by a concurrent write after we read the manifest.
+			s.forgetManifest(goalID)
+			return nil, errPreconditionFailed
+		}
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, pointsInRange(chunkPoints, start, end)...)
+	}
+	return points, nil
+}
+
+// Update applies fn to the points in the given years and commits the
+// result. If years is nil, fn gets the whole series. fn must only return
+// points in those years, and may be called again if the update races
+// with another one. Only the chunks that change are rewritten.
+func (s *goalSeriesStore) Update(ctx context.Context, goalID string, years []int, fn func([]goalDataPoint) ([]goalDataPoint, error)) error {
+	var err error
+	for attempt := 0; attempt < maxGoalDataAttempts; attempt++ {
+		err = s.update(ctx, goalID, years, fn)
+		if err != errPreconditionFailed {
+			return err
+		}
+	}
+	return err
+}
+
+// Replace replaces all of a goal's points.
+func (s *goalSeriesStore) Replace(ctx context.Context, goalID string, points []goalDataPoint) error {
+	return s.Update(ctx, goalID, nil, func([]goalDataPoint) ([]goalDataPoint, error) {
+		return points, nil
+	})
+}
+
+func (s *goalSeriesStore) update(ctx context.Context, goalID string, years []int, fn func([]goalDataPoint) ([]goalDataPoint, error)) error {
+	writeID := generateCode(8)
+	written := []string{}
+	manifest, etag, err := s.loadManifest(ctx, goalID)
+	migrating := false
+	if err == errDoesNotExist {
+		manifest, written, err = s.migrate(ctx, goalID, writeID)
+		migrating = true
+	}
+	if err != nil {
+		return err
+	}
+	if etag == unknownETag {
+		// The commit couldn't be checked, so don't write anything.
+		return errUnknownETag
+	}
+
+	inScope := map[int]bool{}
+	if years == nil {
+		for _, chunk := range manifest.Chunks {
+			inScope[chunk.Year] = true
+		}
+	} else {
+		for _, year := range years {
+			inScope[year] = true
+		}
+	}
+
+	// Load the chunks in scope, keeping their encoded contents so
+	// unchanged chunks aren't rewritten.
+	points := []goalDataPoint{}
+	previous := map[int][]byte{}
+	for _, chunk := range manifest.Chunks {
+		if !inScope[chunk.Year] {
+			continue
+		}
+		chunkPoints, raw, err := s.readObject(ctx, chunk.Object)
+		if err == errDoesNotExist {
+			s.forgetManifest(goalID)
+			err = errPreconditionFailed
+		}
+		if err != nil {
+			s.deleteObjects(ctx, written)
+			return err
+		}
+		points = append(points, chunkPoints...)
+		previous[chunk.Year] = raw
+	}
+
+	points, err = fn(points)
+	if err != nil {
+		s.deleteObjects(ctx, written)
+		return err
+	}
+	sort.Sort(pointsByTime(points))
+
+	byYear := map[int][]goalDataPoint{}
+	for _, p := range points {
+		year := p.Timestamp.UTC().Year()
+		if years == nil {
+			inScope[year] = true
+		} else if !inScope[year] {
+			s.deleteObjects(ctx, written)
+			return fmt.Errorf("goal series: point at %v is outside of the updated years", p.Timestamp)
+		}
+		byYear[year] = append(byYear[year], p)
+	}
+
+	generation := manifest.Generation + 1
+	chunks := []seriesChunk{}
+	changed := false
+	for _, chunk := range manifest.Chunks {
+		if !inScope[chunk.Year] {
+			chunks = append(chunks, chunk)
+		}
+	}
+	for year := range inScope {
+		existing := manifest.chunkFor(year)
+		yearPoints := byYear[year]
+		if len(yearPoints) == 0 {
+			if existing != nil {
+				changed = true
+			}
+			continue
+		}
+		marshaled, err := json.Marshal(yearPoints)
+		if err != nil {
+			s.deleteObjects(ctx, written)
+			return err
+		}
+		if existing != nil && bytes.Equal(marshaled, previous[year]) {
+			chunks = append(chunks, *existing)
+			continue
+		}
+		changed = true
+		object := chunkObjectName(goalID, year, generation, writeID)
+		err = s.os.PutObject(ctx, object, bytes.NewReader(marshaled), int64(len(marshaled)))
+		if err != nil {
+			s.deleteObjects(ctx, written)
+			return err
+		}
+		written = append(written, object)
+		chunks = append(chunks, seriesChunk{
+			Year:   year,
+			Object: object,
+			Points: len(yearPoints),
+		})
+	}
+	if !changed && !migrating {
+		return nil
+	}
+
+	err = s.commit(ctx, goalID, manifest, etag, chunks)
+	if err != nil {
+		s.deleteObjects(ctx, written)
+		return err
+	}
+	if migrating {
+		s.deleteObjects(ctx, []string{goalID})
+	}
+	return nil
+}
+
+// commit makes chunks the current revision by conditionally writing a new
+// manifest, keeping the previous one as a revision. Chunks that are no
+// longer referenced by any kept revision are deleted.
+func (s *goalSeriesStore) commit(ctx context.Context, goalID string, manifest *seriesManifest, etag string, chunks []seriesChunk) error {
+	now := time.Now()
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Year < chunks[j].Year
+	})
+	updated := &seriesManifest{
+		Format:     seriesManifestFormat,
+		Generation: manifest.Generation + 1,
+		Updated:    now.Unix(),
+		Chunks:     chunks,
+	}
+	if manifest.Generation > 0 || len(manifest.Chunks) > 0 {
+		updated.Revisions = append(updated.Revisions, seriesRevision{
+			Generation: manifest.Generation,
+			Updated:    manifest.Updated,
+			Replaced:   now.Unix(),
+			Chunks:     manifest.Chunks,
+		})
+	}
+	pruned := []seriesRevision{}
+	for _, revision := range manifest.Revisions {
+		if len(updated.Revisions) >= s.maxRevisions ||
+			now.Sub(time.Unix(revision.Replaced, 0)) > s.maxRevisionAge {
+			pruned = append(pruned, revision)
+			continue
+		}
+		updated.Revisions = append(updated.Revisions, revision)
+	}
+	if len(updated.Revisions) > s.maxRevisions {
+		pruned = append(pruned, updated.Revisions[s.maxRevisions:]...)
+		updated.Revisions = updated.Revisions[:s.maxRevisions]
+	}
+
+	marshaled, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	err = s.os.PutObjectIfMatch(ctx, manifestObjectName(goalID), bytes.NewReader(marshaled), int64(len(marshaled)), etag)
+	if err != nil {
+		return err
+	}
+
+	// Delete chunks that were only referenced by the previous current
+	// revision or pruned revisions.
+	referenced := updated.objects()
+	unreferenced := []string{}
+	candidates := append([]seriesRevision{{Chunks: manifest.Chunks}}, pruned...)
+	for _, revision := range candidates {
+		for _, chunk := range revision.Chunks {
+			if !referenced[chunk.Object] {
+				referenced[chunk.Object] = true
+				unreferenced = append(unreferenced, chunk.Object)
+			}
+		}
+	}
+	s.deleteObjects(ctx, unreferenced)
+	return nil
+}
+
+// Revisions returns the current and previous revisions of a goal's data,
+// newest first. It returns errDoesNotExist if the goal has no data.
+func (s *goalSeriesStore) Revisions(ctx context.Context, goalID string) ([]goalSeriesRevision, error) {
+	manifest, _, err := s.loadManifest(ctx, goalID)
+	if err == errDoesNotExist {
+		// Goals that haven't been migrated only have a current revision.
+		points, _, err := s.readLegacy(ctx, goalID)
+		if err != nil {
+			return nil, err
+		}
+		return []goalSeriesRevision{{Points: len(points), Current: true}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []goalSeriesRevision{{
+		Revision: manifest.Generation,
+		Updated:  manifest.Updated,
+		Points:   countPoints(manifest.Chunks),
+		Current:  true,
+	}}
+	for _, revision := range manifest.Revisions {
+		revisions = append(revisions, goalSeriesRevision{
+			Revision: revision.Generation,
+			Updated:  revision.Updated,
+			Points:   countPoints(revision.Chunks),
+		})
+	}
+	return revisions, nil
+}
+
+// goalSeriesStats summarizes a goal's current data. Start and End are nil
+// if it has no points.
+type goalSeriesStats struct {
+	Points int        `json:"points"`
+	Start  *time.Time `json:"start"`
+	End    *time.Time `json:"end"`
+}
+
+// Stats returns the number of points in a goal's data and its time range.
+// Only the first and last chunks are read. A goal without data has zero
+// stats.
+func (s *goalSeriesStore) Stats(ctx context.Context, goalID string) (goalSeriesStats, error) {
+	var err error
+	for attempt := 0; attempt < maxGoalDataAttempts; attempt++ {
+		var stats goalSeriesStats
+		stats, err = s.stats(ctx, goalID)
+		if err != errPreconditionFailed {
+			return stats, err
+		}
+	}
+	return goalSeriesStats{}, err
+}
+
+func (s *goalSeriesStore) stats(ctx context.Context, goalID string) (goalSeriesStats, error) {
+	stats := goalSeriesStats{}
+	manifest, _, err := s.loadManifest(ctx, goalID)
+	if err == errDoesNotExist {
+		points, _, err := s.readLegacy(ctx, goalID)
+		if err == errDoesNotExist {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		sort.Sort(pointsByTime(points))
+		return statsFor(len(points), points, points), nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	if len(manifest.Chunks) == 0 {
+		return stats, nil
+	}
+	first, _, err := s.readObject(ctx, manifest.Chunks[0].Object)
+	if err == nil {
+		var last []goalDataPoint
+		last, _, err = s.readObject(ctx, manifest.Chunks[len(manifest.Chunks)-1].Object)
+		if err == nil {
+			return statsFor(countPoints(manifest.Chunks), first, last), nil
+		}
+	}
+	if err == errDoesNotExist {
+		// Replaced by a concurrent update.
+		err = errPreconditionFailed
+	}
+	return stats, err
+}
+
+// statsFor returns stats using the first point of first and the last point
+// of last, which must be sorted.
+func statsFor(points int, first, last []goalDataPoint) goalSeriesStats {
+	stats := goalSeriesStats{Points: points}
+	if len(first) > 0 && len(last) > 0 {
+		start := first[0].Timestamp
+		end := last[len(last)-1].Timestamp
+		stats.Start, stats.End = &start, &end
+	}
+	return stats
+}
+
+// Restore makes a previous revision current again. The revision it
+// replaces is kept like any other. It returns errRevisionNotFound if
+// the revision isn't kept.
+func (s *goalSeriesStore) Restore(ctx context.Context, goalID string, generation int64) error {
+	var err error
+	for attempt := 0; attempt < maxGoalDataAttempts; attempt++ {
+		err = s.restore(ctx, goalID, generation)
+		if err != errPreconditionFailed {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *goalSeriesStore) restore(ctx context.Context, goalID string, generation int64) error {
+	manifest, etag, err := s.loadManifest(ctx, goalID)
+	if err == errDoesNotExist {
+		if generation == 0 {
+			// Restoring the only revision of an unmigrated goal.
+			return nil
+		}
+		return errRevisionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if etag == unknownETag {
+		return errUnknownETag
+	}
+	if generation == manifest.Generation {
+		return nil
+	}
+	for _, revision := range manifest.Revisions {
+		if revision.Generation == generation {
+			chunks := append([]seriesChunk{}, revision.Chunks...)
+			return s.commit(ctx, goalID, manifest, etag, chunks)
+		}
+	}
+	return errRevisionNotFound
+}
+
+// Delete removes all of a goal's data.
+func (s *goalSeriesStore) Delete(ctx context.Context, goalID string) error {
+	manifest, _, err := s.loadManifest(ctx, goalID)
+	if err != nil && err != errDoesNotExist {
+		return err
+	}
+	objects := []string{goalID}
+	if err == nil {
+		objects = append(objects, manifestObjectName(goalID))
+		for object := range manifest.objects() {
+			objects = append(objects, object)
+		}
+	}
+	s.deleteObjects(ctx, objects)
+	return nil
+}
+
+// migrate writes a legacy single object goal's points as chunks and returns
+// a manifest for them, which hasn't been committed yet, and the chunks it
+// wrote. It returns an empty manifest if the goal has no data.
+func (s *goalSeriesStore) migrate(ctx context.Context, goalID string, writeID string) (*seriesManifest, []string, error) {
+	manifest := &seriesManifest{Format: seriesManifestFormat}
+	written := []string{}
+	points, _, err := s.readLegacy(ctx, goalID)
+	if err == errDoesNotExist {
+		return manifest, written, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byYear := map[int][]goalDataPoint{}
+	for _, p := range points {
+		year := p.Timestamp.UTC().Year()
+		byYear[year] = append(byYear[year], p)
+	}
+	for year, yearPoints := range byYear {
+		sort.Sort(pointsByTime(yearPoints))
+		marshaled, err := json.Marshal(yearPoints)
+		if err != nil {
+			s.deleteObjects(ctx, written)
+			return nil, nil, err
+		}
+		object := chunkObjectName(goalID, year, manifest.Generation, writeID)
+		err = s.os.PutObject(ctx, object, bytes.NewReader(marshaled), int64(len(marshaled)))
+		if err != nil {
+			s.deleteObjects(ctx, written)
+			return nil, nil, err
+		}
+		written = append(written, object)
+		manifest.Chunks = append(manifest.Chunks, seriesChunk{
+			Year:   year,
+			Object: object,
+			Points: len(yearPoints),
+		})
+	}
+	sort.Slice(manifest.Chunks, func(i, j int) bool {
+		return manifest.Chunks[i].Year < manifest.Chunks[j].Year
+	})
+	log.WithFields(map[string]interface{}{
+		"goal":   goalID,
+		"points": len(points),
+		"chunks": len(manifest.Chunks),
+	}).Println("migrating goal data to chunks")
+	return manifest, written, nil
+}
+
+func (s *goalSeriesStore) loadManifest(ctx context.Context, goalID string) (*seriesManifest, string, error) {
+	reader, etag, err := s.os.GetObject(ctx, manifestObjectName(goalID))
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	manifest := &seriesManifest{}
+	err = json.NewDecoder(reader).Decode(manifest)
+	if err != nil {
+		return nil, "", err
+	}
+	if manifest.Format != seriesManifestFormat {
+		return nil, "", fmt.Errorf("goal series: unknown manifest format %d", manifest.Format)
+	}
+	return manifest, etag, nil
+}
+
+// forgetManifest drops any cached copy of a goal's manifest. It's called
+// when the manifest names a chunk that no longer exists, which means
+// another process replaced the chunk after the copy was cached, so a
+// retry would otherwise keep reading the same stale manifest.
+func (s *goalSeriesStore) forgetManifest(goalID string) {
+	if cache, ok := s.os.(objectInvalidator); ok {
+		cache.invalidate(manifestObjectName(goalID))
+	}
+}
+
+func (s *goalSeriesStore) readLegacy(ctx context.Context, goalID string) ([]goalDataPoint, []byte, error) {
+	return s.readObject(ctx, goalID)
+}
+
+// readObject reads a JSON array of points. It also returns the raw
+// contents of the object.
+func (s *goalSeriesStore) readObject(ctx context.Context, name string) ([]goalDataPoint, []byte, error) {
+	reader, _, err := s.os.GetObject(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	points := []goalDataPoint{}
+	err = json.Unmarshal(raw, &points)
+	if err != nil {
+		return nil, nil, errInvalidGoalData
+	}
+	return points, raw, nil
+}
+
+// deleteObjects deletes objects that are no longer referenced. Failures
+// are only logged since they leave garbage behind but don't lose data.
+func (s *goalSeriesStore) deleteObjects(ctx context.Context, objects []string) {
+	for _, object := range objects {
+		err := s.os.DeleteObject(ctx, object)
+		if err != nil && err != errDoesNotExist {
+			log.Warnln("goal series: error deleting", object, err)
+		}
+	}
+}
+
+func pointsInRange(points []goalDataPoint, start, end time.Time) []goalDataPoint {
+	if start.IsZero() && end.IsZero() {
+		return points
+	}
+	result := []goalDataPoint{}
+	for _, p := range points {
+		if !start.IsZero() && p.Timestamp.Before(start) {
+			continue
+		}
+		if !end.IsZero() && p.Timestamp.After(end) {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
@@ -0,0 +1,226 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+// countingObjectStore records the objects read and written.
+type countingObjectStore struct {
+	ObjectStore
+	gets []string
+	puts []string
+}
+
+func (objectStore *countingObjectStore) GetObject(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	objectStore.gets = append(objectStore.gets, name)
+	return objectStore.ObjectStore.GetObject(ctx, name)
+}
+
+func (objectStore *countingObjectStore) PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	objectStore.puts = append(objectStore.puts, name)
+	return objectStore.ObjectStore.PutObject(ctx, name, data, size)
+}
+
+func (objectStore *countingObjectStore) PutObjectIfMatch(ctx context.Context, name string, data io.ReadSeeker, size int64, etag string) error {
+	objectStore.puts = append(objectStore.puts, name)
+	return objectStore.ObjectStore.PutObjectIfMatch(ctx, name, data, size, etag)
+}
+
+func (objectStore *countingObjectStore) reset() {
+	objectStore.gets = nil
+	objectStore.puts = nil
+}
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestGoalSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goalseries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	objectStore := &countingObjectStore{ObjectStore: &fileObjectStore{basePath: dir}}
+	api := NewAPI(objectStore)
+
+	// A goal in the original single object format.
+	legacy := `[{"ts":"2017-12-30T00:00:00Z","value":1},{"ts":"2018-01-02T00:00:00Z","value":2}]`
+	err = objectStore.PutObject(ctx, "goal", bytes.NewReader([]byte(legacy)), int64(len(legacy)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := api.series.Read(ctx, "goal", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("expected 2 legacy points, got %v", points)
+	}
+
+	// The first write migrates it.
+	err = api.setGoalDataPoint(ctx, client.Goal{ID: "goal"}, time.UTC, day(2018, 1, 3), 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := objectStore.GetObject(ctx, "goal"); err != errDoesNotExist {
+		t.Errorf("expected legacy object to be deleted, got %v", err)
+	}
+	points, err = api.series.Read(ctx, "goal", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 || points[2].Value != 3 {
+		t.Fatalf("unexpected points after migration %v", points)
+	}
+
+	// Appends only touch the manifest and the newest chunk.
+	objectStore.reset()
+	err = api.setGoalDataPoint(ctx, client.Goal{ID: "goal"}, time.UTC, day(2018, 1, 4), 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objectStore.gets) != 2 || len(objectStore.puts) != 2 {
+		t.Errorf("expected 2 reads and 2 writes, got %v and %v", objectStore.gets, objectStore.puts)
+	}
+	for _, name := range append(objectStore.gets, objectStore.puts...) {
+		if strings.HasPrefix(name, "goal.2017.") {
+			t.Errorf("unexpected access to %s", name)
+		}
+	}
+
+	// Range reads only load the chunks they need.
+	objectStore.reset()
+	points, err = api.series.Read(ctx, "goal", day(2018, 1, 3), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || len(objectStore.gets) != 2 {
+		t.Errorf("expected 2 points from 2 objects, got %v from %v", points, objectStore.gets)
+	}
+
+	// Previous revisions are kept and can be restored.
+	revisions, err := api.series.Revisions(ctx, "goal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || !revisions[0].Current || revisions[2].Points != 2 {
+		t.Fatalf("unexpected revisions %+v", revisions)
+	}
+	err = api.series.Restore(ctx, "goal", revisions[2].Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err = api.series.Read(ctx, "goal", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Errorf("expected restored revision to have 2 points, got %v", points)
+	}
+	if err := api.series.Restore(ctx, "goal", 100); err != errRevisionNotFound {
+		t.Errorf("expected errRevisionNotFound, got %v", err)
+	}
+
+	// Chunks are deleted once no kept revision refers to them.
+	api.series.SetRevisionLimits(1, time.Hour)
+	err = api.setGoalDataPoint(ctx, client.Goal{ID: "goal"}, time.UTC, day(2018, 1, 5), 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	// The 2017 chunk is shared, and there's a 2018 chunk for each revision.
+	if len(names) != 4 || names[3] != "goal.manifest" {
+		t.Errorf("expected a manifest and 3 chunks, got %v", names)
+	}
+
+	err = api.series.Delete(ctx, "goal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.series.Read(ctx, "goal", time.Time{}, time.Time{}); err != errDoesNotExist {
+		t.Errorf("expected deleted goal to not exist, got %v", err)
+	}
+}
+
+func TestGoalSeriesStaleCachedManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goalseries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	// Two web processes, each with its own cache, sharing one store.
+	backend := &fileObjectStore{basePath: dir}
+	reader := newGoalSeriesStore(newCachedObjectStore(backend, 1<<20, time.Hour))
+	writer := newGoalSeriesStore(newCachedObjectStore(backend, 1<<20, time.Hour))
+	writer.SetRevisionLimits(0, 0)
+
+	err = writer.Replace(ctx, "goal", []goalDataPoint{{Timestamp: day(2018, 1, 1), Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Caches the manifest but not the 2018 chunk.
+	points, err := reader.Read(ctx, "goal", day(2019, 1, 1), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 0 {
+		t.Fatalf("expected no points, got %v", points)
+	}
+
+	// Replacing the chunk deletes the one named by the reader's cached
+	// manifest.
+	err = writer.Replace(ctx, "goal", []goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 1, 2), Value: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err = reader.Read(ctx, "goal", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Errorf("expected 2 points, got %v", points)
+	}
+}
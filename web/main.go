@@ -18,6 +18,7 @@ package main
  */
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/json"
@@ -32,6 +33,8 @@ import (
 	"time"
 
 	"github.com/Preetam/siesta"
+	"github.com/Preetam/transverse/internal/forecast"
+	"github.com/Preetam/transverse/internal/trace"
 	"github.com/Preetam/transverse/metadata/client"
 	"github.com/Preetam/transverse/metadata/middleware"
 	"github.com/Preetam/transverse/metadata/token"
@@ -47,7 +50,7 @@ import (
 var (
 	DevMode = false
 
-	MetadataClient *client.ServiceClient
+	MetadataClient *cachedMetadataClient
 	templ          *template.Template
 	TokenKey       string
 	TokenCodec     *token.TokenCodec
@@ -56,6 +59,10 @@ var (
 
 	CDNDomain  = ""
 	CDNVersion = "0.7.1"
+
+	// requestIdentifier assigns request IDs and starts traces. Headers
+	// from the browser aren't trusted unless -trust-request-headers is set.
+	requestIdentifier = middleware.PublicRequestIdentifier
 )
 
 func main() {
@@ -64,6 +71,11 @@ func main() {
 	templatesDir := flag.String("templates-dir", "./templates", "Path to templates")
 	metadataBaseAddr := flag.String("metadata-addr", "http://localhost:4000", "Address of metadata service")
 	metadataToken := flag.String("metadata-token", "", "Token for metadata service")
+	metadataAttempts := flag.Int("metadata-attempts", 4, "Maximum attempts for retryable metadata requests")
+	metadataCacheSize := flag.Int("metadata-cache-size", 10000, "Maximum users and goals cached in memory. 0 disables the cache.")
+	metadataCacheTTL := flag.Duration("metadata-cache-ttl", time.Minute, "Maximum age of cached users and goals")
+	metadataCacheVersionInterval := flag.Duration("metadata-cache-version-interval", time.Second,
+		"How often cached users and goals are checked against the metadata change log. 0 checks on every read.")
 	tokenKey := flag.String("token-key", "aaaaaaaaaaaaaaaa", "Key for token")
 	flag.BoolVar(&DevMode, "dev-mode", DevMode, "Developer mode")
 
@@ -72,6 +84,19 @@ func main() {
 	s3Region := flag.String("s3-region", "nyc3", "S3 region")
 	s3Endpoint := flag.String("s3-endpoint", "https://nyc3.digitaloceanspaces.com", "S3 endpoint")
 	s3Directory := flag.String("s3-directory", "/tmp/s3", "local S3 directory")
+	mirrorDirectory := flag.String("mirror-directory", "", "Mirror goal data to this local directory")
+	mirrorS3Bucket := flag.String("mirror-s3-bucket", "", "Mirror goal data to this S3 bucket")
+	mirrorS3Region := flag.String("mirror-s3-region", "", "Mirror S3 region. Defaults to -s3-region.")
+	mirrorS3Endpoint := flag.String("mirror-s3-endpoint", "", "Mirror S3 endpoint. Defaults to -s3-endpoint.")
+	mirrorS3Key := flag.String("mirror-s3-key", "", "Mirror S3 access key. Defaults to -s3-key.")
+	mirrorS3Secret := flag.String("mirror-s3-secret", "", "Mirror S3 secret access key. Defaults to -s3-secret.")
+	mirrorRepairLog := flag.String("mirror-repair-log", "./mirror-repair.log", "File recording failed mirror writes")
+	mirrorReconcile := flag.Bool("mirror-reconcile", false, "Copy differences from the primary store to the mirror and exit")
+	objectCacheSize := flag.Int64("object-cache-size", 64<<20, "Bytes of recently read goal data to cache in memory. 0 disables the cache.")
+	objectCacheTTL := flag.Duration("object-cache-ttl", time.Minute, "Maximum age of cached goal data. Only matters with multiple web processes.")
+	objectGzip := flag.Bool("object-gzip", false, "Compress goal data objects with gzip")
+	goalDataRevisions := flag.Int("goal-data-revisions", defaultMaxSeriesRevisions, "Previous revisions of goal data to keep")
+	goalDataRevisionAge := flag.Duration("goal-data-revision-age", defaultMaxSeriesRevisionAge, "How long to keep previous revisions of goal data")
 
 	mgDomain := flag.String("mg-domain", "mg.transverseapp.com", "Mailgun domain")
 	mgKey := flag.String("mg-key", "", "Mailgun key. Blank means emails are printed to stdout.")
@@ -79,8 +104,30 @@ func main() {
 
 	recaptchaKey := flag.String("recaptcha-key", "", "Key for recaptcha")
 
+	gcMode := flag.Bool("gc", false, "Delete orphaned goal data objects and exit")
+	gcDryRun := flag.Bool("gc-dry-run", false, "With -gc, only report orphaned objects")
+	gcGrace := flag.Duration("gc-grace", 7*24*time.Hour, "With -gc, only delete objects not modified for this long")
+
+	backupPath := flag.String("backup", "", "Write a backup archive of metadata and goal data to this file and exit")
+	restorePath := flag.String("restore", "", "Restore goal data from this backup archive into an empty object store and exit")
+
+	flag.StringVar(&defaultForecastModel, "forecast-model", defaultForecastModel,
+		"Forecast model for goals without one: "+strings.Join(forecast.Models(), ", "))
+
+	forecastCacheSize := flag.Int("forecast-cache-size", 10000, "Maximum forecasts cached in memory. 0 disables the cache.")
+	forecastCacheStore := flag.Bool("forecast-cache-store", false, "Also store cached forecasts in the object store")
+
+	traceFile := flag.String("trace-file", "", "Append OTLP JSON trace spans to this file")
+	traceEndpoint := flag.String("trace-endpoint", "", "OTLP/HTTP endpoint for trace spans, e.g. http://localhost:4318/v1/traces")
+	trustRequestHeaders := flag.Bool("trust-request-headers", false,
+		"Adopt X-Request-Id and traceparent headers from requests. Only set this behind a proxy that sets or strips them.")
+
 	flag.Parse()
 
+	if _, err := forecast.New(defaultForecastModel); err != nil {
+		log.Fatalf("unknown -forecast-model %q", defaultForecastModel)
+	}
+
 	if DevMode {
 		log.SetFormatter(&log.TextFormatter{})
 	} else {
@@ -88,11 +135,139 @@ func main() {
 		CDNDomain = "//d2zncawp28ewcu.cloudfront.net"
 	}
 
-	MetadataClient = client.NewServiceClient(*metadataBaseAddr, *metadataToken)
+	if *trustRequestHeaders {
+		requestIdentifier = middleware.RequestIdentifier
+	}
+
+	traceExporter, err := trace.NewExporter(*traceFile, *traceEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if traceExporter != nil {
+		trace.Start("transverse-web", traceExporter)
+	}
+
+	metadataClient := client.NewServiceClient(*metadataBaseAddr, *metadataToken)
+	metadataClient.SetMaxAttempts(*metadataAttempts)
+	MetadataClient = newCachedMetadataClient(metadataClient, *metadataCacheSize,
+		*metadataCacheTTL, *metadataCacheVersionInterval)
 	s3Service := s3.New(session.New(aws.NewConfig().WithRegion(*s3Region).WithEndpoint(*s3Endpoint).WithCredentials(credentials.NewStaticCredentials(*s3Key, *s3Secret, ""))))
 	mg = mailgun.NewMailgun(*mgDomain, *mgKey, *mgPublicKey)
 
-	var err error
+	var objectStore ObjectStore
+	if *s3Key != "" {
+		objectStore = &s3ObjectStore{s3: s3Service, bucket: "transverse"}
+	} else {
+		os.MkdirAll(*s3Directory, 0755)
+		objectStore = &fileObjectStore{basePath: *s3Directory}
+	}
+	objectStore = tracedObjectStore{objectStore: objectStore}
+	var mirror *mirrorObjectStore
+	if *mirrorS3Bucket != "" || *mirrorDirectory != "" {
+		var secondary ObjectStore
+		if *mirrorS3Bucket != "" {
+			region, endpoint, key, secret := *s3Region, *s3Endpoint, *s3Key, *s3Secret
+			if *mirrorS3Region != "" {
+				region = *mirrorS3Region
+			}
+			if *mirrorS3Endpoint != "" {
+				endpoint = *mirrorS3Endpoint
+			}
+			if *mirrorS3Key != "" {
+				key, secret = *mirrorS3Key, *mirrorS3Secret
+			}
+			mirrorS3Service := s3.New(session.New(aws.NewConfig().WithRegion(region).WithEndpoint(endpoint).WithCredentials(credentials.NewStaticCredentials(key, secret, ""))))
+			secondary = &s3ObjectStore{s3: mirrorS3Service, bucket: *mirrorS3Bucket}
+		} else {
+			os.MkdirAll(*mirrorDirectory, 0755)
+			secondary = &fileObjectStore{basePath: *mirrorDirectory}
+		}
+		mirror = &mirrorObjectStore{
+			primary:   objectStore,
+			secondary: tracedObjectStore{objectStore: secondary},
+			repairLog: &repairLog{path: *mirrorRepairLog},
+		}
+		objectStore = mirror
+	}
+	if *mirrorReconcile {
+		if mirror == nil {
+			log.Fatal("-mirror-reconcile requires -mirror-s3-bucket or -mirror-directory")
+		}
+		report, err := mirror.Reconcile(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(map[string]interface{}{
+			"copied":  report.Copied,
+			"deleted": report.Deleted,
+			"extra":   report.Extra,
+		}).Println("mirror: reconciled")
+		return
+	}
+	if *objectGzip {
+		objectStore = gzipObjectStore{objectStore: objectStore}
+	}
+	if *objectCacheSize > 0 {
+		objectStore = newCachedObjectStore(objectStore, *objectCacheSize, *objectCacheTTL)
+	}
+
+	if *gcMode {
+		gc := &garbageCollector{
+			os:     objectStore,
+			series: newGoalSeriesStore(objectStore),
+			goals:  MetadataClient,
+			grace:  *gcGrace,
+			dryRun: *gcDryRun,
+		}
+		report, err := gc.Run(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(map[string]interface{}{
+			"objects": report.Objects,
+			"orphans": len(report.Orphans),
+			"bytes":   report.Bytes,
+			"deleted": report.Deleted,
+			"dry_run": *gcDryRun,
+		}).Println("gc: done")
+		return
+	}
+
+	if *backupPath != "" {
+		f, err := os.Create(*backupPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		manifest, err := writeBackup(context.Background(), f, MetadataClient, newGoalSeriesStore(objectStore))
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*backupPath)
+			log.Fatal(err)
+		}
+		log.WithFields(map[string]interface{}{
+			"metadata_version": manifest.MetadataVersion,
+			"goals":            len(manifest.Goals),
+		}).Println("backup: wrote", *backupPath)
+		return
+	}
+
+	if *restorePath != "" {
+		manifest, err := restoreBackup(context.Background(), *restorePath, objectStore, newGoalSeriesStore(objectStore))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(map[string]interface{}{
+			"metadata_version": manifest.MetadataVersion,
+			"goals":            len(manifest.Goals),
+		}).Println("backup: restored", *restorePath)
+		return
+	}
+
 	templ, err = template.ParseGlob(filepath.Join(*templatesDir, "*"))
 	if err != nil {
 		log.Fatal(err)
@@ -103,7 +278,7 @@ func main() {
 
 	service := siesta.NewService("/")
 	service.DisableTrimSlash() // required for static file handler
-	service.AddPre(middleware.RequestIdentifier)
+	service.AddPre(requestIdentifier)
 
 	service.Route("GET", "/", "serves index", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -219,7 +394,7 @@ func main() {
 			templateName = "login_password"
 		}
 
-		user, err := MetadataClient.GetUserByEmail(*loginEmail)
+		user, err := MetadataClient.GetUserByEmail(r.Context(), *loginEmail)
 		if err != nil {
 			log.Println(err)
 			templ.ExecuteTemplate(w, templateName, map[string]string{
@@ -317,7 +492,7 @@ func main() {
 			}
 
 			user.LastEmail = time.Now().Unix()
-			MetadataClient.UpdateUser(user)
+			MetadataClient.UpdateUser(writeContext(r.Context()), user)
 
 			w.Header().Set("Refresh", "0; /verify?action=register")
 			return
@@ -409,9 +584,9 @@ func main() {
 		}
 
 		notFound := false
-		user, err := MetadataClient.GetUserByEmail(*registerEmail)
+		user, err := MetadataClient.GetUserByEmail(r.Context(), *registerEmail)
 		if err != nil {
-			if serverErr, ok := err.(client.ServerError); ok && serverErr == http.StatusNotFound {
+			if client.IsNotFound(err) {
 				notFound = true
 
 				if *mgPublicKey != "" {
@@ -456,7 +631,7 @@ func main() {
 				Updated:   time.Now().Unix(),
 				LastEmail: time.Now().Unix(),
 			}
-			err = MetadataClient.CreateUser(user)
+			err = MetadataClient.CreateUser(writeContext(r.Context()), user)
 			if err != nil {
 				log.Println(err)
 				templ.ExecuteTemplate(w, "register", map[string]string{
@@ -497,7 +672,7 @@ func main() {
 		}
 
 		user.LastEmail = time.Now().Unix()
-		MetadataClient.UpdateUser(user)
+		MetadataClient.UpdateUser(writeContext(r.Context()), user)
 
 		w.Header().Set("Refresh", "0; /verify?action=register")
 		return
@@ -558,15 +733,16 @@ func main() {
 	log.Println("static directory set to", *staticDir)
 	log.Println("listening on", *addr)
 
-	var objectStore ObjectStore
-	if *s3Key != "" {
-		objectStore = &s3ObjectStore{s3: s3Service, bucket: "transverse"}
-	} else {
-		os.MkdirAll(*s3Directory, 0755)
-		objectStore = &fileObjectStore{basePath: *s3Directory}
+	api := NewAPI(objectStore)
+	api.series.SetRevisionLimits(*goalDataRevisions, *goalDataRevisionAge)
+	if *forecastCacheSize > 0 {
+		var forecastStore ObjectStore
+		if *forecastCacheStore {
+			forecastStore = objectStore
+		}
+		forecasts = newForecastCache(forecastStore, *forecastCacheSize)
 	}
-
-	http.Handle(APIBasePath, NewAPI(objectStore).Service())
+	http.Handle(APIBasePath, api.Service())
 	http.Handle("/", service)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
@@ -706,7 +882,7 @@ func verifyRegister(w http.ResponseWriter, r *http.Request, tokenCode int) {
 
 	for _, code := range codes {
 		if code == tokenCode {
-			user, err := MetadataClient.GetUserByID(userTokenData.User)
+			user, err := MetadataClient.GetUserByID(r.Context(), userTokenData.User)
 			if err != nil {
 				log.Println(err)
 				templ.ExecuteTemplate(w, "verify", map[string]string{
@@ -717,7 +893,7 @@ func verifyRegister(w http.ResponseWriter, r *http.Request, tokenCode int) {
 				return
 			}
 			user.Verified = true
-			err = MetadataClient.UpdateUser(user)
+			err = MetadataClient.UpdateUser(writeContext(r.Context()), user)
 			if err != nil {
 				log.Println(err)
 				templ.ExecuteTemplate(w, "verify", map[string]string{
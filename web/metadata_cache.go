@@ -0,0 +1,311 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+	log "github.com/Sirupsen/logrus"
+)
+
+// cachedMetadataClient is a metadata client that caches users and goals
+// fetched by ID. Writes made through it invalidate the affected entries.
+//
+// Writes made by other web processes are picked up by following the
+// metadata service's change log: the users and goals written since the
+// last version seen are dropped. Changes are checked at most once per
+// versionInterval, so that bounds how long another process's write can go
+// unnoticed. A zero interval checks on every lookup.
+//
+// One check runs at a time, in the background, and lookups wait for it. If
+// it fails, lookups skip the cache for versionRetryInterval instead of
+// each waiting for the metadata service in turn.
+type cachedMetadataClient struct {
+	*client.ServiceClient
+
+	maxEntries      int
+	ttl             time.Duration
+	versionInterval time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// lru holds *cacheEntry values from most to least recently used.
+	lru *list.List
+	// generation is incremented by every invalidation so a read that
+	// raced with a write doesn't cache what it read.
+	generation uint64
+
+	versionLock sync.Mutex
+	// version is the version the cache has dropped changes up to.
+	version      uint64
+	versionCheck time.Time
+	versionError time.Time
+	// check is the check in progress, if any.
+	check *versionCheck
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// versionCheck is a check of the metadata change log. done is closed once
+// it completes, and ok is set if it succeeded.
+type versionCheck struct {
+	done chan struct{}
+	ok   bool
+}
+
+const (
+	// versionCheckTimeout bounds a check of the metadata change log,
+	// including retries.
+	versionCheckTimeout = 5 * time.Second
+	// versionRetryInterval is how long lookups skip the cache after a
+	// check fails.
+	versionRetryInterval = 10 * time.Second
+)
+
+// newCachedMetadataClient returns a cache in front of c holding up to
+// maxEntries users and goals. A maxEntries of 0 disables caching.
+func newCachedMetadataClient(c *client.ServiceClient, maxEntries int, ttl, versionInterval time.Duration) *cachedMetadataClient {
+	return &cachedMetadataClient{
+		ServiceClient:   c,
+		maxEntries:      maxEntries,
+		ttl:             ttl,
+		versionInterval: versionInterval,
+		entries:         map[string]*list.Element{},
+		lru:             list.New(),
+	}
+}
+
+func userCacheKey(id string) string {
+	return "user:" + id
+}
+
+func goalCacheKey(id string) string {
+	return "goal:" + id
+}
+
+func (c *cachedMetadataClient) GetUserByID(ctx context.Context, id string) (client.User, error) {
+	key := userCacheKey(id)
+	ok := c.sync(ctx)
+	value, generation, found := c.get(key)
+	if ok && found {
+		return value.(client.User), nil
+	}
+	user, err := c.ServiceClient.GetUserByID(ctx, id)
+	if err != nil {
+		return user, err
+	}
+	if ok {
+		c.set(key, user, generation)
+	}
+	return user, nil
+}
+
+func (c *cachedMetadataClient) GetGoal(ctx context.Context, id string) (client.Goal, error) {
+	key := goalCacheKey(id)
+	ok := c.sync(ctx)
+	value, generation, found := c.get(key)
+	if ok && found {
+		return value.(client.Goal), nil
+	}
+	goal, err := c.ServiceClient.GetGoal(ctx, id)
+	if err != nil {
+		return goal, err
+	}
+	if ok {
+		c.set(key, goal, generation)
+	}
+	return goal, nil
+}
+
+func (c *cachedMetadataClient) CreateUser(ctx context.Context, user client.User) error {
+	defer c.invalidate(userCacheKey(user.ID))
+	return c.ServiceClient.CreateUser(ctx, user)
+}
+
+func (c *cachedMetadataClient) UpdateUser(ctx context.Context, user client.User) error {
+	defer c.invalidate(userCacheKey(user.ID))
+	return c.ServiceClient.UpdateUser(ctx, user)
+}
+
+func (c *cachedMetadataClient) DeleteUser(ctx context.Context, user client.User) error {
+	defer c.invalidateUser(user.ID)
+	return c.ServiceClient.DeleteUser(ctx, user)
+}
+
+func (c *cachedMetadataClient) CreateGoal(ctx context.Context, goal client.Goal) error {
+	defer c.invalidate(goalCacheKey(goal.ID))
+	return c.ServiceClient.CreateGoal(ctx, goal)
+}
+
+func (c *cachedMetadataClient) UpdateGoal(ctx context.Context, goal client.Goal) error {
+	defer c.invalidate(goalCacheKey(goal.ID))
+	return c.ServiceClient.UpdateGoal(ctx, goal)
+}
+
+// sync drops entries written by other processes, checking the metadata
+// change log if versionInterval has passed. It returns false if the cache
+// is disabled or the changes couldn't be checked, in which case the cache
+// shouldn't be used.
+func (c *cachedMetadataClient) sync(ctx context.Context) bool {
+	if c.maxEntries <= 0 {
+		return false
+	}
+
+	c.versionLock.Lock()
+	if !c.versionCheck.IsZero() && time.Since(c.versionCheck) < c.versionInterval {
+		c.versionLock.Unlock()
+		return true
+	}
+	if time.Since(c.versionError) < versionRetryInterval {
+		c.versionLock.Unlock()
+		return false
+	}
+	check := c.check
+	if check == nil {
+		check = &versionCheck{done: make(chan struct{})}
+		c.check = check
+		go c.checkVersion(check, c.version)
+	}
+	c.versionLock.Unlock()
+
+	select {
+	case <-check.done:
+		return check.ok
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// checkVersion drops the entries written after version since.
+func (c *cachedMetadataClient) checkVersion(check *versionCheck, since uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionCheckTimeout)
+	defer cancel()
+	changes, err := c.ServiceClient.Changes(ctx, since)
+	if err == nil {
+		if !changes.Complete {
+			c.invalidateAll()
+		}
+		for _, id := range changes.Users {
+			c.invalidateUser(id)
+		}
+		for _, id := range changes.Goals {
+			c.invalidate(goalCacheKey(id))
+		}
+	}
+
+	c.versionLock.Lock()
+	if err != nil {
+		log.Warnln("metadata cache: error checking changes:", err)
+		c.versionError = time.Now()
+	} else {
+		c.version = changes.Version
+		c.versionCheck = time.Now()
+	}
+	check.ok = err == nil
+	c.check = nil
+	c.versionLock.Unlock()
+	close(check.done)
+}
+
+// get returns the cached value for key if it's unexpired. It also returns
+// the current generation, to pass to set after fetching a missing value.
+func (c *cachedMetadataClient) get(key string) (interface{}, uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, c.generation, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, c.generation, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value, c.generation, true
+}
+
+// set caches value for key unless something was invalidated since
+// generation was returned by get.
+func (c *cachedMetadataClient) set(key string, value interface{}, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:     key,
+		value:   value,
+		expires: time.Now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes key.
+func (c *cachedMetadataClient) invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// invalidateUser removes a user and their goals.
+func (c *cachedMetadataClient) invalidateUser(userID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	for _, elem := range c.entries {
+		entry := elem.Value.(*cacheEntry)
+		if goal, ok := entry.value.(client.Goal); ok && goal.User == userID {
+			c.remove(elem)
+		}
+	}
+	if elem, ok := c.entries[userCacheKey(userID)]; ok {
+		c.remove(elem)
+	}
+}
+
+// invalidateAll removes every entry.
+func (c *cachedMetadataClient) invalidateAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+// remove must be called with the lock held.
+func (c *cachedMetadataClient) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
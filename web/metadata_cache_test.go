@@ -0,0 +1,211 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+// fakeMetadata serves goals whose names are "v" followed by the data
+// version they were last written at. Writes go through write, or /do for
+// goal abc.
+type fakeMetadata struct {
+	lock    sync.Mutex
+	version uint64
+	written map[string]uint64
+	// changesStatus, if set, is returned by /changes.
+	changesStatus int
+
+	goalReads    int32
+	changesReads int32
+}
+
+func newFakeMetadata() *fakeMetadata {
+	return &fakeMetadata{written: map[string]uint64{}}
+}
+
+// write writes a goal as another web process would.
+func (f *fakeMetadata) write(id string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.version++
+	f.written[id] = f.version
+}
+
+func (f *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/changes":
+		atomic.AddInt32(&f.changesReads, 1)
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.changesStatus != 0 {
+			w.WriteHeader(f.changesStatus)
+			return
+		}
+		since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		changes := client.Changes{Version: f.version, Complete: true}
+		for id, version := range f.written {
+			if version > since {
+				changes.Goals = append(changes.Goals, id)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": changes})
+	case strings.HasPrefix(r.URL.Path, "/goals/"):
+		atomic.AddInt32(&f.goalReads, 1)
+		id := strings.TrimPrefix(r.URL.Path, "/goals/")
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		fmt.Fprintf(w, `{"data": {"id": %q, "user": "u", "name": "v%d"}}`, id, f.written[id])
+	case r.URL.Path == "/do":
+		f.write("abc")
+		w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	fake := newFakeMetadata()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	ctx := context.Background()
+	c := newCachedMetadataClient(client.NewServiceClient(server.URL, ""), 10, time.Minute, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		goal, err := c.GetGoal(ctx, "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if goal.Name != "v0" {
+			t.Errorf("expected v0, got %q", goal.Name)
+		}
+	}
+	if fake.goalReads != 1 {
+		t.Errorf("expected 1 goal read, got %d", fake.goalReads)
+	}
+
+	// A write through the cache is visible immediately.
+	err := c.UpdateGoal(ctx, client.Goal{ID: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	goal, err := c.GetGoal(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if goal.Name != "v1" {
+		t.Errorf("expected v1 after update, got %q", goal.Name)
+	}
+
+	// A write by another process is only noticed once the changes are
+	// checked again, and only drops what it wrote.
+	c.GetGoal(ctx, "def")
+	fake.write("abc")
+	goal, _ = c.GetGoal(ctx, "abc")
+	if goal.Name != "v1" {
+		t.Errorf("expected cached v1, got %q", goal.Name)
+	}
+	c.versionInterval = 0
+	atomic.StoreInt32(&fake.goalReads, 0)
+	goal, _ = c.GetGoal(ctx, "abc")
+	if goal.Name != "v2" {
+		t.Errorf("expected v2 after the change, got %q", goal.Name)
+	}
+	c.GetGoal(ctx, "def")
+	if fake.goalReads != 1 {
+		t.Errorf("expected only the changed goal to be read again, got %d reads", fake.goalReads)
+	}
+}
+
+func TestMetadataCacheChangesFail(t *testing.T) {
+	fake := newFakeMetadata()
+	fake.changesStatus = http.StatusServiceUnavailable
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	metadata := client.NewServiceClient(server.URL, "")
+	metadata.SetMaxAttempts(1)
+	c := newCachedMetadataClient(metadata, 10, time.Minute, 0)
+
+	// Lookups share one failed check, and then skip the cache without
+	// checking again.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.GetGoal(context.Background(), "abc"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		if _, err := c.GetGoal(context.Background(), "abc"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&fake.changesReads); n != 1 {
+		t.Errorf("expected 1 check, got %d", n)
+	}
+	if n := atomic.LoadInt32(&fake.goalReads); n != 20 {
+		t.Errorf("expected every lookup to skip the cache, got %d goal reads", n)
+	}
+}
+
+func TestMetadataCacheEviction(t *testing.T) {
+	c := newCachedMetadataClient(nil, 2, time.Minute, time.Hour)
+	c.set("a", 1, 0)
+	c.set("b", 2, 0)
+	c.get("a")
+	c.set("c", 3, 0)
+	if _, _, ok := c.get("b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if _, _, ok := c.get("a"); !ok {
+		t.Error("expected a to be cached")
+	}
+
+	c.ttl = -time.Second
+	c.set("d", 4, 0)
+	if _, _, ok := c.get("d"); ok {
+		t.Error("expected expired entry to be dropped")
+	}
+
+	// A value read before an invalidation isn't cached.
+	c.ttl = time.Minute
+	_, generation, _ := c.get("e")
+	c.invalidate("e")
+	c.set("e", 5, generation)
+	if _, _, ok := c.get("e"); ok {
+		t.Error("expected a value read before an invalidation not to be cached")
+	}
+}
@@ -19,22 +19,59 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Preetam/transverse/internal/trace"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-var errDoesNotExist = errors.New("does not exist")
+var (
+	errDoesNotExist       = errors.New("does not exist")
+	errPreconditionFailed = errors.New("precondition failed")
+	errInvalidObjectName  = errors.New("invalid object name")
+	errUnknownETag        = errors.New("object's ETag is unknown")
+)
+
+// unknownETag is returned by GetObject for an object read from somewhere
+// its ETag doesn't come from, like a mirror's secondary. A conditional
+// write can't be checked against it, so PutObjectIfMatch fails with
+// errUnknownETag.
+const unknownETag = "unknown"
 
 type ObjectStore interface {
-	GetObject(name string) (io.ReadCloser, error)
-	DeleteObject(name string) error
-	PutObject(name string, data io.ReadSeeker, size int64) error
+	// GetObject returns the object's contents and its ETag.
+	GetObject(ctx context.Context, name string) (io.ReadCloser, string, error)
+	DeleteObject(ctx context.Context, name string) error
+	PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error
+	// PutObjectIfMatch writes the object only if its current ETag is etag,
+	// or, if etag is empty, only if it doesn't exist. It returns
+	// errPreconditionFailed if the object has changed.
+	PutObjectIfMatch(ctx context.Context, name string, data io.ReadSeeker, size int64, etag string) error
+	// List returns the objects whose names start with prefix, in
+	// name order.
+	List(ctx context.Context, prefix string) ([]objectInfo, error)
+}
+
+type objectInfo struct {
+	Name     string
+	Size     int64
+	Modified time.Time
 }
 
 type s3ObjectStore struct {
@@ -42,35 +79,140 @@ type s3ObjectStore struct {
 	bucket string
 }
 
-func (objectStore *s3ObjectStore) GetObject(name string) (io.ReadCloser, error) {
+func (objectStore *s3ObjectStore) GetObject(ctx context.Context, name string) (io.ReadCloser, string, error) {
 	input := &s3.GetObjectInput{}
 	input = input.SetBucket(objectStore.bucket).SetKey(name)
-	output, err := objectStore.s3.GetObject(input)
+	output, err := objectStore.s3.GetObjectWithContext(ctx, input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
-			return nil, errDoesNotExist
+			return nil, "", errDoesNotExist
 		}
-		return nil, err
+		return nil, "", err
 	}
-	return output.Body, nil
+	return output.Body, aws.StringValue(output.ETag), nil
 }
 
-func (objectStore *s3ObjectStore) DeleteObject(name string) error {
+func (objectStore *s3ObjectStore) DeleteObject(ctx context.Context, name string) error {
 	input := &s3.DeleteObjectInput{}
 	input = input.SetBucket(objectStore.bucket).SetKey(name)
-	_, err := objectStore.s3.DeleteObject(input)
+	_, err := objectStore.s3.DeleteObjectWithContext(ctx, input)
 	return err
 }
 
-func (objectStore *s3ObjectStore) PutObject(name string, data io.ReadSeeker, size int64) error {
+func (objectStore *s3ObjectStore) PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
 	input := &s3.PutObjectInput{}
 	input = input.SetBucket(objectStore.bucket).SetKey(name).SetContentLength(size).SetBody(data)
-	_, err := objectStore.s3.PutObject(input)
+	_, err := objectStore.s3.PutObjectWithContext(ctx, input)
+	return err
+}
+
+func (objectStore *s3ObjectStore) PutObjectIfMatch(ctx context.Context, name string, data io.ReadSeeker, size int64, etag string) error {
+	input := &s3.PutObjectInput{}
+	input = input.SetBucket(objectStore.bucket).SetKey(name).SetContentLength(size).SetBody(data)
+	// This version of the SDK doesn't have conditional write fields on
+	// PutObjectInput, so set the headers directly.
+	condition := func(r *request.Request) {
+		if etag == "" {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		} else {
+			r.HTTPRequest.Header.Set("If-Match", etag)
+		}
+	}
+	_, err := objectStore.s3.PutObjectWithContext(ctx, input, condition)
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		// S3 returns 409 if a concurrent conditional write is in progress.
+		if rerr.StatusCode() == http.StatusPreconditionFailed || rerr.StatusCode() == http.StatusConflict {
+			return errPreconditionFailed
+		}
+	}
 	return err
 }
 
+func (objectStore *s3ObjectStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	input := &s3.ListObjectsV2Input{}
+	input = input.SetBucket(objectStore.bucket).SetPrefix(prefix)
+	objects := []objectInfo{}
+	err := objectStore.s3.ListObjectsV2PagesWithContext(ctx, input, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			objects = append(objects, objectInfo{
+				Name:     aws.StringValue(object.Key),
+				Size:     aws.Int64Value(object.Size),
+				Modified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// fileObjectStore stores objects as files under basePath. Names with
+// slashes are stored in subdirectories. Writes go to a temporary file which
+// is synced and renamed over the object, so a crash leaves either the old
+// or the new contents. It assumes it's the only process using basePath.
 type fileObjectStore struct {
 	basePath string
+
+	// lock serializes writes so conditional writes can compare
+	// and write atomically.
+	lock sync.RWMutex
+}
+
+// path returns the file path for an object. Names must be relative,
+// slash separated paths without "." or ".." elements, so an object
+// can't be outside of basePath.
+func (objectStore *fileObjectStore) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || path.Clean("/"+name) != "/"+name {
+		return "", errInvalidObjectName
+	}
+	for _, element := range strings.Split(name, "/") {
+		if strings.HasPrefix(element, ".") {
+			// Also reserves names starting with "." for temporary files.
+			return "", errInvalidObjectName
+		}
+	}
+	return filepath.Join(objectStore.basePath, filepath.FromSlash(name)), nil
+}
+
+// writeFile atomically replaces the file at path with data.
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir syncs a directory so a rename in it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 type nopCloser struct {
@@ -81,25 +223,186 @@ func (_ nopCloser) Close() error {
 	return nil
 }
 
-func (objectStore fileObjectStore) GetObject(name string) (io.ReadCloser, error) {
-	res, err := ioutil.ReadFile(filepath.Join(objectStore.basePath, name))
+// fileETag returns the ETag of an object stored as a file.
+func fileETag(contents []byte) string {
+	hash := sha256.Sum256(contents)
+	return hex.EncodeToString(hash[:])
+}
+
+func (objectStore *fileObjectStore) GetObject(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	path, err := objectStore.path(name)
+	if err != nil {
+		return nil, "", err
+	}
+	objectStore.lock.RLock()
+	defer objectStore.lock.RUnlock()
+	res, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, errDoesNotExist
+			return nil, "", errDoesNotExist
 		}
-		return nil, err
+		return nil, "", err
+	}
+	return nopCloser{bytes.NewReader(res)}, fileETag(res), nil
+}
+
+func (objectStore *fileObjectStore) PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
 	}
-	return nopCloser{bytes.NewReader(res)}, nil
+	path, err := objectStore.path(name)
+	if err != nil {
+		return err
+	}
+	objectStore.lock.Lock()
+	defer objectStore.lock.Unlock()
+	return writeFile(path, buf)
 }
 
-func (objectStore fileObjectStore) PutObject(name string, data io.ReadSeeker, size int64) error {
+func (objectStore *fileObjectStore) PutObjectIfMatch(ctx context.Context, name string, data io.ReadSeeker, size int64, etag string) error {
 	buf, err := ioutil.ReadAll(data)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filepath.Join(objectStore.basePath, name), buf, 0666)
+	path, err := objectStore.path(name)
+	if err != nil {
+		return err
+	}
+	objectStore.lock.Lock()
+	defer objectStore.lock.Unlock()
+	current, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.IsNotExist(err) {
+		if etag != "" {
+			return errPreconditionFailed
+		}
+	} else if etag != fileETag(current) {
+		return errPreconditionFailed
+	}
+	return writeFile(path, buf)
+}
+
+func (objectStore *fileObjectStore) DeleteObject(ctx context.Context, name string) error {
+	path, err := objectStore.path(name)
+	if err != nil {
+		return err
+	}
+	objectStore.lock.Lock()
+	defer objectStore.lock.Unlock()
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return errDoesNotExist
+	}
+	if err != nil {
+		return err
+	}
+	// Clean up directories left empty. Removing a directory that
+	// isn't empty fails, which stops this.
+	dir := filepath.Dir(path)
+	for dir != filepath.Clean(objectStore.basePath) && os.Remove(dir) == nil {
+		dir = filepath.Dir(dir)
+	}
+	return syncDir(dir)
+}
+
+func (objectStore *fileObjectStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	objectStore.lock.RLock()
+	defer objectStore.lock.RUnlock()
+	objects := []objectInfo{}
+	err := filepath.Walk(objectStore.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			// Temporary file
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(objectStore.basePath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, objectInfo{
+				Name:     name,
+				Size:     info.Size(),
+				Modified: info.ModTime(),
+			})
+		}
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, err
+}
+
+// tracedObjectStore records a span for each call to an ObjectStore.
+type tracedObjectStore struct {
+	objectStore ObjectStore
+}
+
+func startObjectStoreSpan(ctx context.Context, method, name string) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, "objectstore "+method, trace.KindClient)
+	span.SetAttribute("object", name)
+	return ctx, span
+}
+
+func (objectStore tracedObjectStore) GetObject(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	ctx, span := startObjectStoreSpan(ctx, "GetObject", name)
+	defer span.Finish()
+	r, etag, err := objectStore.objectStore.GetObject(ctx, name)
+	if err != errDoesNotExist {
+		span.SetError(err)
+	}
+	return r, etag, err
+}
+
+func (objectStore tracedObjectStore) DeleteObject(ctx context.Context, name string) error {
+	ctx, span := startObjectStoreSpan(ctx, "DeleteObject", name)
+	defer span.Finish()
+	err := objectStore.objectStore.DeleteObject(ctx, name)
+	span.SetError(err)
+	return err
+}
+
+func (objectStore tracedObjectStore) PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	ctx, span := startObjectStoreSpan(ctx, "PutObject", name)
+	defer span.Finish()
+	span.SetAttribute("size", size)
+	err := objectStore.objectStore.PutObject(ctx, name, data, size)
+	span.SetError(err)
+	return err
+}
+
+func (objectStore tracedObjectStore) PutObjectIfMatch(ctx context.Context, name string, data io.ReadSeeker, size int64, etag string) error {
+	ctx, span := startObjectStoreSpan(ctx, "PutObjectIfMatch", name)
+	defer span.Finish()
+	span.SetAttribute("size", size)
+	err := objectStore.objectStore.PutObjectIfMatch(ctx, name, data, size, etag)
+	if err != errPreconditionFailed {
+		span.SetError(err)
+	}
+	return err
 }
 
-func (objectStore fileObjectStore) DeleteObject(name string) error {
-	return os.Remove(filepath.Join(objectStore.basePath, name))
+func (objectStore tracedObjectStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	ctx, span := startObjectStoreSpan(ctx, "List", prefix)
+	defer span.Finish()
+	objects, err := objectStore.objectStore.List(ctx, prefix)
+	span.SetAttribute("objects", len(objects))
+	span.SetError(err)
+	return objects, err
 }
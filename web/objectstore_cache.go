@@ -0,0 +1,155 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// cachedObjectStore keeps recently read objects in memory, up to maxBytes
+// in total. Writes and deletes through it invalidate the object. Writes by
+// other processes aren't seen until the entry expires, which only matters
+// for goal data manifests since chunks are never modified. A conditional
+// write that fails also invalidates the object so the retry reads it again,
+// and so does a read that finds a cached manifest naming a deleted chunk.
+type cachedObjectStore struct {
+	objectStore ObjectStore
+	maxBytes    int64
+	ttl         time.Duration
+
+	lock    sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	// lru holds *objectCacheEntry values from most to least recently used.
+	lru *list.List
+	// generation is incremented by every invalidation so a read that
+	// raced with a write doesn't cache what it read.
+	generation uint64
+}
+
+type objectCacheEntry struct {
+	name    string
+	data    []byte
+	etag    string
+	expires time.Time
+}
+
+// objectInvalidator is implemented by object stores that cache reads, so
+// callers that find a cached object is stale can drop it.
+type objectInvalidator interface {
+	invalidate(name string)
+}
+
+func newCachedObjectStore(objectStore ObjectStore, maxBytes int64, ttl time.Duration) *cachedObjectStore {
+	return &cachedObjectStore{
+		objectStore: objectStore,
+		maxBytes:    maxBytes,
+		ttl:         ttl,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+}
+
+func (objectStore *cachedObjectStore) GetObject(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	objectStore.lock.Lock()
+	if elem, ok := objectStore.entries[name]; ok {
+		entry := elem.Value.(*objectCacheEntry)
+		if time.Now().Before(entry.expires) {
+			objectStore.lru.MoveToFront(elem)
+			objectStore.lock.Unlock()
+			return nopCloser{bytes.NewReader(entry.data)}, entry.etag, nil
+		}
+		objectStore.remove(elem)
+	}
+	generation := objectStore.generation
+	objectStore.lock.Unlock()
+
+	reader, etag, err := objectStore.objectStore.GetObject(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	objectStore.lock.Lock()
+	// Objects with an unknown ETag aren't cached so the next read can get
+	// one that a conditional write can use.
+	if generation == objectStore.generation && etag != unknownETag && int64(len(data)) <= objectStore.maxBytes {
+		if elem, ok := objectStore.entries[name]; ok {
+			// Cached by a concurrent read.
+			objectStore.remove(elem)
+		}
+		objectStore.entries[name] = objectStore.lru.PushFront(&objectCacheEntry{
+			name:    name,
+			data:    data,
+			etag:    etag,
+			expires: time.Now().Add(objectStore.ttl),
+		})
+		objectStore.size += int64(len(data))
+		for objectStore.size > objectStore.maxBytes {
+			objectStore.remove(objectStore.lru.Back())
+		}
+	}
+	objectStore.lock.Unlock()
+	return nopCloser{bytes.NewReader(data)}, etag, nil
+}
+
+func (objectStore *cachedObjectStore) DeleteObject(ctx context.Context, name string) error {
+	defer objectStore.invalidate(name)
+	return objectStore.objectStore.DeleteObject(ctx, name)
+}
+
+func (objectStore *cachedObjectStore) PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	defer objectStore.invalidate(name)
+	return objectStore.objectStore.PutObject(ctx, name, data, size)
+}
+
+func (objectStore *cachedObjectStore) PutObjectIfMatch(ctx context.Context, name string, data io.ReadSeeker, size int64, etag string) error {
+	defer objectStore.invalidate(name)
+	return objectStore.objectStore.PutObjectIfMatch(ctx, name, data, size, etag)
+}
+
+func (objectStore *cachedObjectStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	return objectStore.objectStore.List(ctx, prefix)
+}
+
+func (objectStore *cachedObjectStore) invalidate(name string) {
+	objectStore.lock.Lock()
+	defer objectStore.lock.Unlock()
+	objectStore.generation++
+	if elem, ok := objectStore.entries[name]; ok {
+		objectStore.remove(elem)
+	}
+}
+
+// remove must be called with the lock held.
+func (objectStore *cachedObjectStore) remove(elem *list.Element) {
+	entry := elem.Value.(*objectCacheEntry)
+	objectStore.lru.Remove(elem)
+	delete(objectStore.entries, entry.name)
+	objectStore.size -= int64(len(entry.data))
+}
@@ -0,0 +1,100 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// gzipObjectStore compresses objects when they're written and decompresses
+// them when they're read. Objects that aren't compressed, like ones written
+// before compression was enabled, are read as they are.
+type gzipObjectStore struct {
+	objectStore ObjectStore
+}
+
+// gzipMagic starts every gzip stream. JSON objects can't start with it.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (objectStore gzipObjectStore) GetObject(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	reader, etag, err := objectStore.objectStore.GetObject(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return nopCloser{bytes.NewReader(data)}, etag, nil
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	data, err = ioutil.ReadAll(gzipReader)
+	if err != nil {
+		return nil, "", err
+	}
+	return nopCloser{bytes.NewReader(data)}, etag, nil
+}
+
+func (objectStore gzipObjectStore) DeleteObject(ctx context.Context, name string) error {
+	return objectStore.objectStore.DeleteObject(ctx, name)
+}
+
+func (objectStore gzipObjectStore) PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	compressed, err := gzipCompress(data)
+	if err != nil {
+		return err
+	}
+	return objectStore.objectStore.PutObject(ctx, name, bytes.NewReader(compressed), int64(len(compressed)))
+}
+
+func (objectStore gzipObjectStore) PutObjectIfMatch(ctx context.Context, name string, data io.ReadSeeker, size int64, etag string) error {
+	compressed, err := gzipCompress(data)
+	if err != nil {
+		return err
+	}
+	return objectStore.objectStore.PutObjectIfMatch(ctx, name, bytes.NewReader(compressed), int64(len(compressed)), etag)
+}
+
+// List returns the sizes of objects as they're stored, which is
+// compressed for objects written with compression enabled.
+func (objectStore gzipObjectStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	return objectStore.objectStore.List(ctx, prefix)
+}
+
+func gzipCompress(data io.Reader) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	_, err := io.Copy(writer, data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,350 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// mirrorObjectStore writes objects to a primary and a secondary store and
+// reads them from the primary, falling back to the secondary if the
+// primary fails. Writes only fail if the primary write fails. Failed
+// secondary writes are recorded in a repair log so reconcile can fix them.
+//
+// ETags and conditional writes only apply to the primary. Reads that fall
+// back to the secondary return unknownETag, so a write conditional on
+// what they read fails instead of being checked against the wrong ETag.
+type mirrorObjectStore struct {
+	primary   ObjectStore
+	secondary ObjectStore
+	repairLog *repairLog
+}
+
+func (objectStore *mirrorObjectStore) GetObject(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	reader, etag, err := objectStore.primary.GetObject(ctx, name)
+	if err == nil || err == errDoesNotExist {
+		return reader, etag, err
+	}
+	log.Warnln("mirror: error reading", name, "from primary, falling back to secondary:", err)
+	reader, _, secondaryErr := objectStore.secondary.GetObject(ctx, name)
+	if secondaryErr != nil {
+		// The primary's error is the interesting one.
+		return nil, "", err
+	}
+	return reader, unknownETag, nil
+}
+
+func (objectStore *mirrorObjectStore) DeleteObject(ctx context.Context, name string) error {
+	err := objectStore.primary.DeleteObject(ctx, name)
+	if err != nil && err != errDoesNotExist {
+		return err
+	}
+	secondaryErr := objectStore.secondary.DeleteObject(ctx, name)
+	if secondaryErr != nil && secondaryErr != errDoesNotExist {
+		objectStore.repairLog.record(name, secondaryErr)
+	}
+	return err
+}
+
+func (objectStore *mirrorObjectStore) PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	err := objectStore.primary.PutObject(ctx, name, data, size)
+	if err != nil {
+		return err
+	}
+	objectStore.putSecondary(ctx, name, data, size)
+	return nil
+}
+
+func (objectStore *mirrorObjectStore) PutObjectIfMatch(ctx context.Context, name string, data io.ReadSeeker, size int64, etag string) error {
+	if etag == unknownETag {
+		return errUnknownETag
+	}
+	err := objectStore.primary.PutObjectIfMatch(ctx, name, data, size, etag)
+	if err != nil {
+		return err
+	}
+	objectStore.putSecondary(ctx, name, data, size)
+	return nil
+}
+
+func (objectStore *mirrorObjectStore) putSecondary(ctx context.Context, name string, data io.ReadSeeker, size int64) {
+	_, err := data.Seek(0, io.SeekStart)
+	if err == nil {
+		err = objectStore.secondary.PutObject(ctx, name, data, size)
+	}
+	if err != nil {
+		objectStore.repairLog.record(name, err)
+	}
+}
+
+func (objectStore *mirrorObjectStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	return objectStore.primary.List(ctx, prefix)
+}
+
+// reconcileReport summarizes a reconcile.
+type reconcileReport struct {
+	Copied  int
+	Deleted int
+	// Extra is the number of objects only in the secondary. They're
+	// left alone since the primary may be the one missing data.
+	Extra int
+}
+
+// Reconcile makes the secondary match the primary. Objects in the repair
+// log are copied from the primary, or deleted from the secondary if the
+// primary doesn't have them. Then any object missing from the secondary or
+// with different contents is copied. The repair log is cleared of the
+// entries that were repaired. Comparing contents also catches failures
+// recorded by other processes while the log was being rewritten, and ones
+// lost from the log. Sizes aren't enough: manifests are rewritten often
+// and usually keep their size.
+func (objectStore *mirrorObjectStore) Reconcile(ctx context.Context) (reconcileReport, error) {
+	report := reconcileReport{}
+
+	start := time.Now()
+	names, err := objectStore.repairLog.names()
+	if err != nil {
+		return report, err
+	}
+	repaired := map[string]bool{}
+	for _, name := range names {
+		copied, err := objectStore.repair(ctx, name)
+		if err != nil {
+			return report, err
+		}
+		if copied {
+			report.Copied++
+		} else {
+			report.Deleted++
+		}
+		repaired[name] = true
+	}
+	err = objectStore.repairLog.remove(repaired, start)
+	if err != nil {
+		return report, err
+	}
+
+	primaryObjects, err := objectStore.primary.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	secondaryObjects, err := objectStore.secondary.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	secondarySizes := map[string]int64{}
+	for _, object := range secondaryObjects {
+		secondarySizes[object.Name] = object.Size
+	}
+	for _, object := range primaryObjects {
+		size, ok := secondarySizes[object.Name]
+		delete(secondarySizes, object.Name)
+		if ok && size == object.Size {
+			same, err := objectStore.sameContents(ctx, object.Name)
+			if err != nil {
+				return report, err
+			}
+			if same {
+				continue
+			}
+		}
+		if _, err := objectStore.repair(ctx, object.Name); err != nil {
+			return report, err
+		}
+		report.Copied++
+	}
+	report.Extra = len(secondarySizes)
+	for name := range secondarySizes {
+		log.Warnln("mirror: object only in secondary:", name)
+	}
+	return report, nil
+}
+
+// sameContents returns true if an object has the same contents in the
+// primary and the secondary. ETags can't be compared since stores compute
+// them differently.
+func (objectStore *mirrorObjectStore) sameContents(ctx context.Context, name string) (bool, error) {
+	primaryHash, err := objectHash(ctx, objectStore.primary, name)
+	if err != nil {
+		return false, err
+	}
+	secondaryHash, err := objectHash(ctx, objectStore.secondary, name)
+	if err == errDoesNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return primaryHash == secondaryHash, nil
+}
+
+// objectHash returns the SHA-256 hash of an object's contents.
+func objectHash(ctx context.Context, objectStore ObjectStore, name string) (string, error) {
+	reader, _, err := objectStore.GetObject(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// repair copies an object from the primary to the secondary, or deletes it
+// from the secondary if it isn't in the primary. It returns true if it
+// copied the object.
+func (objectStore *mirrorObjectStore) repair(ctx context.Context, name string) (bool, error) {
+	reader, _, err := objectStore.primary.GetObject(ctx, name)
+	if err == errDoesNotExist {
+		err = objectStore.secondary.DeleteObject(ctx, name)
+		if err == errDoesNotExist {
+			err = nil
+		}
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return false, err
+	}
+	return true, objectStore.secondary.PutObject(ctx, name, bytes.NewReader(data), int64(len(data)))
+}
+
+// repairLog is a file of JSON lines naming objects whose secondary write
+// failed.
+type repairLog struct {
+	path string
+	lock sync.Mutex
+}
+
+type repairLogEntry struct {
+	Time   time.Time `json:"time"`
+	Object string    `json:"object"`
+	Error  string    `json:"error"`
+}
+
+func (l *repairLog) record(name string, err error) {
+	log.Warnln("mirror: error writing", name, "to secondary:", err)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, openErr := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		log.Errorln("mirror: couldn't record", name, "in repair log:", openErr)
+		return
+	}
+	defer f.Close()
+	entry, _ := json.Marshal(repairLogEntry{
+		Time:   time.Now(),
+		Object: name,
+		Error:  err.Error(),
+	})
+	_, writeErr := f.Write(append(entry, '\n'))
+	if writeErr == nil {
+		writeErr = f.Sync()
+	}
+	if writeErr != nil {
+		log.Errorln("mirror: couldn't record", name, "in repair log:", writeErr)
+	}
+}
+
+// names returns the distinct objects in the log.
+func (l *repairLog) names() ([]string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entries, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	names := []string{}
+	for _, entry := range entries {
+		if !seen[entry.Object] {
+			seen[entry.Object] = true
+			names = append(names, entry.Object)
+		}
+	}
+	return names, nil
+}
+
+// remove rewrites the log without entries for the given objects that were
+// recorded before a time. Later entries are for writes that may have
+// failed after the object was repaired, so they're kept.
+func (l *repairLog) remove(objects map[string]bool, before time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entries, err := l.read()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		if objects[entry.Object] && entry.Time.Before(before) {
+			continue
+		}
+		line, _ := json.Marshal(entry)
+		buf.Write(append(line, '\n'))
+	}
+	if buf.Len() == 0 {
+		err = os.Remove(l.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return writeFile(l.path, buf.Bytes())
+}
+
+func (l *repairLog) read() ([]repairLogEntry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	entries := []repairLogEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := repairLogEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Probably a partial line from a crash.
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,209 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingObjectStore fails every call while failing is set.
+type failingObjectStore struct {
+	ObjectStore
+	failing bool
+}
+
+var errFailing = errors.New("failing")
+
+func (objectStore *failingObjectStore) GetObject(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	if objectStore.failing {
+		return nil, "", errFailing
+	}
+	return objectStore.ObjectStore.GetObject(ctx, name)
+}
+
+func (objectStore *failingObjectStore) PutObject(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	if objectStore.failing {
+		return errFailing
+	}
+	return objectStore.ObjectStore.PutObject(ctx, name, data, size)
+}
+
+func (objectStore *failingObjectStore) DeleteObject(ctx context.Context, name string) error {
+	if objectStore.failing {
+		return errFailing
+	}
+	return objectStore.ObjectStore.DeleteObject(ctx, name)
+}
+
+func TestMirrorObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	primary := &failingObjectStore{ObjectStore: &fileObjectStore{basePath: filepath.Join(dir, "primary")}}
+	secondary := &failingObjectStore{ObjectStore: &fileObjectStore{basePath: filepath.Join(dir, "secondary")}}
+	mirror := &mirrorObjectStore{
+		primary:   primary,
+		secondary: secondary,
+		repairLog: &repairLog{path: filepath.Join(dir, "repair.log")},
+	}
+
+	put := func(name, data string) {
+		err := mirror.PutObject(ctx, name, bytes.NewReader([]byte(data)), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(objectStore ObjectStore, name string) string {
+		reader, _, err := objectStore.GetObject(ctx, name)
+		if err != nil {
+			return err.Error()
+		}
+		data, _ := ioutil.ReadAll(reader)
+		return string(data)
+	}
+
+	put("a", "1")
+	put("b", "1")
+	if get(secondary, "a") != "1" {
+		t.Error("expected write to be mirrored")
+	}
+
+	// Reads fall back to the secondary.
+	primary.failing = true
+	if data := get(mirror, "a"); data != "1" {
+		t.Errorf("expected fallback read, got %q", data)
+	}
+	primary.failing = false
+
+	// Secondary failures are recorded and repaired.
+	secondary.failing = true
+	put("a", "2")
+	put("c", "3")
+	if err := mirror.DeleteObject(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	secondary.failing = false
+	if names, _ := mirror.repairLog.names(); len(names) != 3 {
+		t.Errorf("expected 3 objects in the repair log, got %v", names)
+	}
+
+	// Written to the stores directly, so reconcile only finds them by
+	// comparing them: d has a different size, and the manifest has the
+	// same size but different contents, like a lost repair log entry.
+	direct := func(objectStore ObjectStore, name, data string) {
+		err := objectStore.PutObject(ctx, name, bytes.NewReader([]byte(data)), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	direct(secondary, "d", "4")
+	direct(primary, "d", "44")
+	direct(secondary, "e.manifest", `{"generation":1}`)
+	direct(primary, "e.manifest", `{"generation":2}`)
+	put("f", "5")
+
+	report, err := mirror.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 4 || report.Deleted != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	for name, expected := range map[string]string{
+		"a":          "2",
+		"b":          errDoesNotExist.Error(),
+		"c":          "3",
+		"d":          "44",
+		"e.manifest": `{"generation":2}`,
+		"f":          "5",
+	} {
+		if data := get(secondary, name); data != expected {
+			t.Errorf("expected %s to be %q, got %q", name, expected, data)
+		}
+	}
+	if names, _ := mirror.repairLog.names(); len(names) != 0 {
+		t.Errorf("expected empty repair log, got %v", names)
+	}
+}
+
+func TestMirrorGoalSeriesPrimaryReadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	primary := &failingObjectStore{ObjectStore: &fileObjectStore{basePath: filepath.Join(dir, "primary")}}
+	mirror := &mirrorObjectStore{
+		primary:   primary,
+		secondary: &fileObjectStore{basePath: filepath.Join(dir, "secondary")},
+		repairLog: &repairLog{path: filepath.Join(dir, "repair.log")},
+	}
+	series := newGoalSeriesStore(newCachedObjectStore(mirror, 1<<20, time.Hour))
+
+	err = series.Replace(ctx, "goal", []goalDataPoint{{Timestamp: day(2018, 1, 1), Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := primary.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads fall back to the secondary, but a write can't be committed
+	// against what they read, so it fails without writing anything.
+	primary.failing = true
+	points, err := series.Read(ctx, "goal", time.Time{}, time.Time{})
+	if err != nil || len(points) != 1 {
+		t.Fatalf("expected to read 1 point from the secondary, got %v, %v", points, err)
+	}
+	err = series.Replace(ctx, "goal", []goalDataPoint{{Timestamp: day(2018, 1, 2), Value: 2}})
+	if err != errUnknownETag {
+		t.Errorf("expected errUnknownETag, got %v", err)
+	}
+	primary.failing = false
+	after, err := primary.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("expected no objects to be written, got %v", after)
+	}
+
+	// Once the primary is back, writes work without waiting for the
+	// secondary's read to expire from the cache.
+	err = series.Replace(ctx, "goal", []goalDataPoint{{Timestamp: day(2018, 1, 2), Value: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err = series.Read(ctx, "goal", time.Time{}, time.Time{})
+	if err != nil || len(points) != 1 || points[0].Value != 2 {
+		t.Errorf("expected the new point, got %v, %v", points, err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+func TestFileObjectStoreIfMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	objectStore := &fileObjectStore{basePath: dir}
+
+	put := func(data, etag string) error {
+		return objectStore.PutObjectIfMatch(ctx, "obj", bytes.NewReader([]byte(data)), int64(len(data)), etag)
+	}
+
+	if err := put("a", "stale"); err != errPreconditionFailed {
+		t.Errorf("expected precondition failure for missing object, got %v", err)
+	}
+	if err := put("a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("b", ""); err != errPreconditionFailed {
+		t.Errorf("expected precondition failure for existing object, got %v", err)
+	}
+
+	_, etag, err := objectStore.GetObject(ctx, "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := put("b", etag); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("c", etag); err != errPreconditionFailed {
+		t.Errorf("expected precondition failure for stale etag, got %v", err)
+	}
+}
+
+func TestConcurrentGoalDataPoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	api := NewAPI(&fileObjectStore{basePath: dir})
+	date := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	const writers = 20
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := api.setGoalDataPoint(ctx, client.Goal{ID: "goal"}, time.UTC, date, 1, true)
+				if err == errPreconditionFailed {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	goalData, err := api.series.Read(ctx, "goal", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(goalData) != 1 || goalData[0].Value != writers {
+		t.Errorf("expected a single point with value %d, got %v", writers, goalData)
+	}
+}
+
+func TestGzipObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	base := &fileObjectStore{basePath: dir}
+	objectStore := gzipObjectStore{objectStore: base}
+
+	// Written before compression was enabled.
+	old := `[{"ts":"2018-01-01T00:00:00Z","value":1}]`
+	err = base.PutObject(ctx, "old", bytes.NewReader([]byte(old)), int64(len(old)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = objectStore.PutObject(ctx, "new", bytes.NewReader([]byte(old)), int64(len(old)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _, err := base.GetObject(ctx, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, _ := ioutil.ReadAll(raw)
+	if !bytes.HasPrefix(compressed, gzipMagic) {
+		t.Error("expected object to be compressed")
+	}
+
+	for _, name := range []string{"old", "new"} {
+		reader, _, err := objectStore.GetObject(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(reader)
+		if string(data) != old {
+			t.Errorf("unexpected contents of %s: %q", name, data)
+		}
+	}
+}
+
+func TestCachedObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	counting := &countingObjectStore{ObjectStore: &fileObjectStore{basePath: dir}}
+	objectStore := newCachedObjectStore(counting, 8, time.Minute)
+
+	put := func(name, data string) {
+		err := objectStore.PutObject(ctx, name, bytes.NewReader([]byte(data)), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(name string) string {
+		reader, _, err := objectStore.GetObject(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(reader)
+		return string(data)
+	}
+
+	put("a", "1234")
+	get("a")
+	get("a")
+	if len(counting.gets) != 1 {
+		t.Errorf("expected 1 read, got %v", counting.gets)
+	}
+
+	// Writes invalidate.
+	put("a", "5678")
+	if data := get("a"); data != "5678" {
+		t.Errorf("expected new contents, got %q", data)
+	}
+
+	// The cache holds up to 8 bytes.
+	put("b", "1234")
+	put("c", "1234")
+	get("b")
+	get("c")
+	counting.reset()
+	get("a")
+	if len(counting.gets) != 1 {
+		t.Errorf("expected least recently used object to be evicted, got %v", counting.gets)
+	}
+}
+
+func TestFileObjectStorePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objectstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	objectStore := &fileObjectStore{basePath: filepath.Join(dir, "objects")}
+
+	for _, name := range []string{"", "../escape", "a/../../escape", "/abs", "a//b", "a/", ".hidden", "a/./b", `a\b`} {
+		err := objectStore.PutObject(ctx, name, bytes.NewReader([]byte("x")), 1)
+		if err != errInvalidObjectName {
+			t.Errorf("expected %q to be rejected, got %v", name, err)
+		}
+	}
+
+	err = objectStore.PutObject(ctx, "backups/2018/a", bytes.NewReader([]byte("x")), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "objects", "backups", "2018", "a")); err != nil {
+		t.Errorf("expected nested file: %v", err)
+	}
+	err = objectStore.DeleteObject(ctx, "backups/2018/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "objects", "backups")); !os.IsNotExist(err) {
+		t.Errorf("expected empty directories to be removed, got %v", err)
+	}
+
+	// No temporary files are left behind.
+	err = objectStore.PutObject(ctx, "a", bytes.NewReader([]byte("x")), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "objects"))
+	if len(files) != 1 || files[0].Name() != "a" {
+		t.Errorf("expected only a, got %v", files)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+// Goal resolutions for client.Goal.Resolution. Points are bucketed to the
+// start of their hour, day, week (starting on Monday) or month in the
+// owner's time zone.
+const (
+	resolutionHourly  = "hourly"
+	resolutionDaily   = "daily"
+	resolutionWeekly  = "weekly"
+	resolutionMonthly = "monthly"
+)
+
+func validResolution(resolution string) bool {
+	switch resolution {
+	case "", resolutionHourly, resolutionDaily, resolutionWeekly, resolutionMonthly:
+		return true
+	}
+	return false
+}
+
+// goalResolution returns a goal's resolution. Goals without one are daily.
+func goalResolution(goal client.Goal) string {
+	if goal.Resolution == "" {
+		return resolutionDaily
+	}
+	return goal.Resolution
+}
+
+// locations caches loaded time zones by name, since time.LoadLocation
+// reads the zone from disk every time.
+var locations sync.Map
+
+// loadLocation is time.LoadLocation, cached. Only zones that load are
+// cached, so there's at most one entry for each zone in the database.
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// userLocation returns a user's time zone. Users without one, or with one
+// that can't be loaded, use UTC.
+func userLocation(user client.User) *time.Location {
+	if user.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := loadLocation(user.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// bucketing groups a goal's points into buckets at its resolution in its
+// owner's time zone. Bucket boundaries are computed in the time zone but
+// the times it returns are in UTC, which is how points are stored.
+type bucketing struct {
+	resolution string
+	location   *time.Location
+}
+
+func goalBucketing(goal client.Goal, loc *time.Location) bucketing {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return bucketing{resolution: goalResolution(goal), location: loc}
+}
+
+// index numbers buckets so consecutive buckets have consecutive numbers.
+func (b bucketing) index(t time.Time) int {
+	local := t.In(b.location)
+	year, month, day := local.Date()
+	// Days are counted by the local date so DST changes don't move
+	// boundaries.
+	days := floorDiv(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix(), 86400)
+	switch b.resolution {
+	case resolutionHourly:
+		return int(days*24 + int64(local.Hour()))
+	case resolutionWeekly:
+		// 1970-01-01 was a Thursday, so shift weeks to start on Monday.
+		return int(floorDiv(days+3, 7))
+	case resolutionMonthly:
+		return year*12 + int(month) - 1
+	default:
+		return int(days)
+	}
+}
+
+// maxFilledBuckets is the longest gap, in buckets, that's filled in when a
+// goal's data is bucketed. Longer gaps are left as they are, so a point
+// recorded long before the rest doesn't add a bucket for every hour or day
+// in between.
+func (b bucketing) maxFilledBuckets() int {
+	switch b.resolution {
+	case resolutionHourly:
+		return 31 * 24
+	case resolutionWeekly:
+		return 2 * 52
+	case resolutionMonthly:
+		return 10 * 12
+	default:
+		return 366
+	}
+}
+
+// time returns the start of a bucket.
+func (b bucketing) time(index int) time.Time {
+	date := func(days int64, hour int) time.Time {
+		d := time.Unix(days*86400, 0).UTC()
+		return time.Date(d.Year(), d.Month(), d.Day(), hour, 0, 0, 0, b.location).UTC()
+	}
+	switch b.resolution {
+	case resolutionHourly:
+		days := floorDiv(int64(index), 24)
+		return date(days, int(int64(index)-days*24))
+	case resolutionWeekly:
+		return date(int64(index)*7-3, 0)
+	case resolutionMonthly:
+		return time.Date(index/12, time.Month(index%12+1), 1, 0, 0, 0, 0, b.location).UTC()
+	default:
+		return date(int64(index), 0)
+	}
+}
+
+// start returns the start of t's bucket.
+func (b bucketing) start(t time.Time) time.Time {
+	return b.time(b.index(t))
+}
+
+// timeAt returns the time offset into a bucket. Buckets have different
+// lengths, so an offset past the end of the bucket is dropped.
+func (b bucketing) timeAt(index int, offset time.Duration) time.Time {
+	t := b.time(index).Add(offset)
+	if !t.Before(b.time(index + 1)) {
+		return b.time(index)
+	}
+	return t
+}
+
+// forecastTime returns the time of the forecast i buckets after last, at
+// the same offset into its bucket as last.
+func (b bucketing) forecastTime(last time.Time, i int) time.Time {
+	index := b.index(last)
+	return b.timeAt(index+i, last.Sub(b.time(index)))
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// normalizeGoalData moves points to the start of their bucket, sorts them
+// and combines points in the same bucket with the duplicate policy. The
+// order of points in the same bucket is kept for the "last" policy.
+func normalizeGoalData(points []goalDataPoint, b bucketing, policy string) []goalDataPoint {
+	bucketed := make([]goalDataPoint, len(points))
+	for i, p := range points {
+		bucketed[i] = goalDataPoint{Timestamp: b.start(p.Timestamp), Value: p.Value}
+	}
+	sort.Stable(pointsByTime(bucketed))
+	return resolveDuplicates(bucketed, policy)
+}
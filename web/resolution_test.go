@@ -0,0 +1,169 @@
+package main
+
+/**
+ * Copyright (C) 2018 Preetam Jinka
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Preetam/transverse/metadata/client"
+)
+
+func TestBucketStart(t *testing.T) {
+	// 2018-01-03 was a Wednesday.
+	ts := day(2018, 1, 3).Add(13*time.Hour + 45*time.Minute)
+	expected := map[string]time.Time{
+		resolutionHourly:  day(2018, 1, 3).Add(13 * time.Hour),
+		resolutionDaily:   day(2018, 1, 3),
+		resolutionWeekly:  day(2018, 1, 1),
+		resolutionMonthly: day(2018, 1, 1),
+	}
+	for resolution, start := range expected {
+		b := goalBucketing(client.Goal{Resolution: resolution}, time.UTC)
+		if got := b.start(ts); !got.Equal(start) {
+			t.Errorf("%s: expected %v, got %v", resolution, start, got)
+		}
+		index := b.index(ts)
+		if got := b.index(b.time(index + 1)); got != index+1 {
+			t.Errorf("%s: expected bucket %d, got %d", resolution, index+1, got)
+		}
+	}
+	weekly := goalBucketing(client.Goal{Resolution: resolutionWeekly}, time.UTC)
+	if got := weekly.start(day(2017, 12, 31)); !got.Equal(day(2017, 12, 25)) {
+		t.Errorf("expected the week to start on Monday, got %v", got)
+	}
+	monthly := goalBucketing(client.Goal{Resolution: resolutionMonthly}, time.UTC)
+	if got := monthly.time(monthly.index(day(2018, 12, 15)) + 1); !got.Equal(day(2019, 1, 1)) {
+		t.Errorf("expected 2019-01-01, got %v", got)
+	}
+	if validResolution("yearly") {
+		t.Error("expected yearly to be invalid")
+	}
+}
+
+func TestBucketTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	b := goalBucketing(client.Goal{}, loc)
+
+	// 9pm in California is the next day in UTC.
+	evening := time.Date(2018, 1, 1, 21, 0, 0, 0, loc)
+	start := b.start(evening)
+	if !start.Equal(time.Date(2018, 1, 1, 0, 0, 0, 0, loc)) || start.Location() != time.UTC {
+		t.Errorf("expected local midnight in UTC, got %v", start)
+	}
+
+	// Days are still consecutive across DST changes, which are 23 and 25
+	// hours long.
+	index := b.index(time.Date(2018, 3, 10, 12, 0, 0, 0, loc))
+	if got := b.time(index + 1); !got.Equal(time.Date(2018, 3, 11, 0, 0, 0, 0, loc)) {
+		t.Errorf("expected 2018-03-11 local midnight, got %v", got)
+	}
+	if got := b.time(index + 2); !got.Equal(time.Date(2018, 3, 12, 0, 0, 0, 0, loc)) {
+		t.Errorf("expected 2018-03-12 local midnight, got %v", got)
+	}
+	if got := b.forecastTime(time.Date(2018, 3, 10, 0, 0, 0, 0, loc), 2); !got.Equal(time.Date(2018, 3, 12, 0, 0, 0, 0, loc)) {
+		t.Errorf("expected 2018-03-12 local midnight, got %v", got)
+	}
+
+	if !validTimeZone("America/Los_Angeles") || !validTimeZone("") {
+		t.Error("expected valid time zones")
+	}
+	if validTimeZone("Mars/Olympus_Mons") || validTimeZone("Local") {
+		t.Error("expected invalid time zones")
+	}
+	if userLocation(client.User{TimeZone: "Mars/Olympus_Mons"}) != time.UTC {
+		t.Error("expected unknown time zones to use UTC")
+	}
+}
+
+func TestNormalizeGoalData(t *testing.T) {
+	b := goalBucketing(client.Goal{Resolution: resolutionWeekly}, time.UTC)
+	points := normalizeGoalData([]goalDataPoint{
+		{Timestamp: day(2018, 1, 9), Value: 4},
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 1, 7).Add(23 * time.Hour), Value: 2},
+	}, b, duplicatesSum)
+	expected := []goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 3},
+		{Timestamp: day(2018, 1, 8), Value: 4},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected %v, got %v", expected, points)
+	}
+}
+
+func TestFillGapsMonthly(t *testing.T) {
+	b := goalBucketing(client.Goal{Resolution: resolutionMonthly}, time.UTC)
+	points := fillGaps([]goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 4, 1), Value: 4},
+	}, b)
+	expected := []goalDataPoint{
+		{Timestamp: day(2018, 1, 1), Value: 1},
+		{Timestamp: day(2018, 2, 1), Value: 2},
+		{Timestamp: day(2018, 3, 1), Value: 3},
+		{Timestamp: day(2018, 4, 1), Value: 4},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected %v, got %v", expected, points)
+	}
+	if got := b.forecastTime(day(2018, 1, 31), 1); !got.Equal(day(2018, 2, 1)) {
+		t.Errorf("expected 2018-02-01, got %v", got)
+	}
+}
+
+func TestFillGapsLimit(t *testing.T) {
+	b := goalBucketing(client.Goal{Resolution: resolutionHourly}, time.UTC)
+	old := goalDataPoint{Timestamp: day(2000, 1, 1), Value: 1}
+	recent := goalDataPoint{Timestamp: day(2018, 1, 1), Value: 2}
+	points := fillGaps([]goalDataPoint{recent, old}, b)
+	if expected := []goalDataPoint{old, recent}; !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected a long gap not to be filled, got %d points", len(points))
+	}
+	_, cumulative := cumulativeSeries([]goalDataPoint{recent, old}, b)
+	if len(cumulative) != 2 {
+		t.Errorf("expected a long gap in a counter not to be filled, got %d points", len(cumulative))
+	}
+
+	// A gap of exactly the limit is still filled.
+	end := goalDataPoint{Timestamp: old.Timestamp.Add(time.Duration(b.maxFilledBuckets()+1) * time.Hour), Value: 2}
+	if points := fillGaps([]goalDataPoint{old, end}, b); len(points) != b.maxFilledBuckets()+2 {
+		t.Errorf("expected %d points, got %d", b.maxFilledBuckets()+2, len(points))
+	}
+}
+
+func TestLoadLocationCached(t *testing.T) {
+	first, err := loadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	second, _ := loadLocation("America/New_York")
+	if first != second {
+		t.Error("expected the second load to be cached")
+	}
+	if _, err := loadLocation("Not/AZone"); err == nil {
+		t.Error("expected an unknown zone to fail")
+	}
+	if _, ok := locations.Load("Not/AZone"); ok {
+		t.Error("expected an unknown zone not to be cached")
+	}
+}